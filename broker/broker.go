@@ -7,7 +7,13 @@ package main
 
 import (
 	"container/heap"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -17,16 +23,26 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"git.torproject.org/pluggable-transports/snowflake.git/common/amp"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/messages"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/safelog"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/util"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
 	"golang.org/x/crypto/acme/autocert"
 )
 
+// The default seconds that a client offer waits for a proxy's answer, and that a
+// proxy poll waits for a client offer. See BrokerContext.clientTimeout and
+// BrokerContext.proxyTimeout.
 const (
 	ClientTimeout = 10
 	ProxyTimeout  = 10
@@ -37,6 +53,45 @@ const (
 	NATUnrestricted = "unrestricted"
 )
 
+// The default number of proxy polls that may wait for the matcher. Polls
+// beyond that are rejected, rather than left blocking their handlers.
+const defaultProxyPollQueueSize = 512
+
+// The default number of client offers that may wait for a proxy to poll, when
+// none is available. Offers beyond that are rejected at once.
+const defaultClientOfferQueueSize = 128
+
+// Seconds that a proxy whose poll was rejected is asked to wait before
+// polling again.
+const proxyPollRetryAfter = "5"
+
+// Bounds, in seconds, of the Retry-After that a client whose offer went
+// unanswered is asked to wait: the minimum when there are proxies waiting to be
+// matched, and otherwise about how long it takes proxies to poll again.
+const (
+	clientRetryAfterMin = 1
+	clientRetryAfterMax = 5
+)
+
+// Limits on how long an HTTP request may take, so that slow clients can't tie up
+// connections. Writing the response must also allow for a client offer or a
+// proxy poll to wait to be matched, so the write timeout is
+// httpWriteTimeoutExtra on top of the client and proxy timeouts. Upgraded
+// WebSocket connections are not limited, except that they are closed after
+// httpIdleTimeout without a message from the proxy.
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpReadTimeout       = 30 * time.Second
+	httpWriteTimeoutExtra = 10 * time.Second
+	httpIdleTimeout       = 2 * time.Minute
+)
+
+// How long the broker reuses a status response, so that frequent requests for
+// /status cost little.
+const statusCacheDuration = time.Second
+
+var errProxyPollsFull = errors.New("too many proxy polls waiting to be matched")
+
 type BrokerContext struct {
 	snowflakes           *SnowflakeHeap
 	restrictedSnowflakes *SnowflakeHeap
@@ -48,6 +103,31 @@ type BrokerContext struct {
 	snowflakeLock sync.Mutex
 	proxyPolls    chan *ProxyPoll
 	metrics       *Metrics
+	// Aggregated ICE candidate counts, only collected when non-nil.
+	candidateCounts *CandidateCounts
+	// Whether to take remote addresses from the X-Forwarded-For header,
+	// set when the broker runs behind a reverse proxy.
+	trustForwardedFor bool
+	// Limits the rate of requests from each IP address, if non-nil.
+	rateLimiter *RateLimiter
+	// Whether clients may send offers in the query string of a GET request.
+	allowGetOffers bool
+	// Whether to serve Prometheus metrics as OpenMetrics with exemplars,
+	// and log the hashed proxy IDs that the exemplars refer to.
+	metricsExemplars bool
+	// How long a client offer waits for a proxy's answer, and how long a
+	// proxy poll waits for a client offer.
+	clientTimeout time.Duration
+	proxyTimeout  time.Duration
+	// Client offers waiting for a proxy to poll, oldest first, and how
+	// many may wait. Guarded by snowflakeLock.
+	waitingOffers        []*offerWaiter
+	clientOfferQueueSize int
+
+	// The last response to /status, and when it was made.
+	statusLock sync.Mutex
+	statusBody []byte
+	statusTime time.Time
 }
 
 func NewBrokerContext(metricsLogger *log.Logger) *BrokerContext {
@@ -69,11 +149,23 @@ func NewBrokerContext(metricsLogger *log.Logger) *BrokerContext {
 		snowflakes:           snowflakes,
 		restrictedSnowflakes: rSnowflakes,
 		idToSnowflake:        make(map[string]*Snowflake),
-		proxyPolls:           make(chan *ProxyPoll),
+		proxyPolls:           make(chan *ProxyPoll, defaultProxyPollQueueSize),
 		metrics:              metrics,
+		clientTimeout:        time.Second * ClientTimeout,
+		proxyTimeout:         time.Second * ProxyTimeout,
+		clientOfferQueueSize: defaultClientOfferQueueSize,
 	}
 }
 
+// Matches the session IDs that proxies generate: 16 random bytes in unpadded
+// base64. Go regexps can't look around, so the characters on either side are
+// captured and put back.
+var sessionIDPattern = regexp.MustCompile(`(^|[^A-Za-z0-9+/])[A-Za-z0-9+/]{22}($|[^A-Za-z0-9+/=])`)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
 // Implements the http.Handler interface
 type SnowflakeHandler struct {
 	*BrokerContext
@@ -88,11 +180,16 @@ type MetricsHandler struct {
 
 func (sh SnowflakeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Session-ID, Snowflake-NAT-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Session-ID, Snowflake-NAT-Type, "+messages.NonceHeader)
+	w.Header().Set("Access-Control-Expose-Headers", "Snowflake-NAT-Type, "+messages.NonceHeader)
 	// Return early if it's CORS preflight.
 	if "OPTIONS" == r.Method {
 		return
 	}
+	if sh.rateLimiter != nil && !sh.rateLimiter.Allow(sh.remoteIP(r)) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
 	sh.handle(sh.BrokerContext, w, r)
 }
 
@@ -108,24 +205,33 @@ func (mh MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // Proxies may poll for client offers concurrently.
 type ProxyPoll struct {
-	id           string
-	proxyType    string
-	natType      string
+	id        string
+	proxyType string
+	natType   string
+	// Done when the proxy stops waiting for the poll's response.
+	ctx          context.Context
 	offerChannel chan *ClientOffer
 }
 
 // Registers a Snowflake and waits for some Client to send an offer,
-// as part of the polling logic of the proxy handler.
-func (ctx *BrokerContext) RequestOffer(id string, proxyType string, natType string) *ClientOffer {
+// as part of the polling logic of the proxy handler. Returns errProxyPollsFull
+// at once if too many polls are already waiting to be registered. Returns a nil
+// offer if none comes within proxyTimeout, or if reqCtx is done first.
+func (ctx *BrokerContext) RequestOffer(reqCtx context.Context, id string, proxyType string, natType string) (*ClientOffer, error) {
 	request := new(ProxyPoll)
+	request.ctx = reqCtx
 	request.id = id
 	request.proxyType = proxyType
 	request.natType = natType
 	request.offerChannel = make(chan *ClientOffer)
-	ctx.proxyPolls <- request
+	select {
+	case ctx.proxyPolls <- request:
+	default:
+		return nil, errProxyPollsFull
+	}
 	// Block until an offer is available, or timeout which sends a nil offer.
 	offer := <-request.offerChannel
-	return offer
+	return offer, nil
 }
 
 // goroutine which matches clients to proxies and sends SDP offers along.
@@ -136,13 +242,15 @@ func (ctx *BrokerContext) Broker() {
 		snowflake := ctx.AddSnowflake(request.id, request.proxyType, request.natType)
 		// Wait for a client to avail an offer to the snowflake.
 		go func(request *ProxyPoll) {
+			pollCtx, cancel := context.WithTimeout(request.ctx, ctx.proxyTimeout)
+			defer cancel()
 			select {
 			case offer := <-snowflake.offerChannel:
 				request.offerChannel <- offer
-			case <-time.After(time.Second * ProxyTimeout):
-				// This snowflake is no longer available to serve clients.
+			case <-pollCtx.Done():
+				// This snowflake is no longer available to serve
+				// clients: it timed out, or the proxy went away.
 				ctx.snowflakeLock.Lock()
-				defer ctx.snowflakeLock.Unlock()
 				if snowflake.index != -1 {
 					if request.natType == NATUnrestricted {
 						heap.Remove(ctx.snowflakes, snowflake.index)
@@ -151,7 +259,16 @@ func (ctx *BrokerContext) Broker() {
 					}
 					delete(ctx.idToSnowflake, snowflake.id)
 					close(request.offerChannel)
+					ctx.snowflakeLock.Unlock()
+					return
 				}
+				snowflake.pollEnded = true
+				ctx.snowflakeLock.Unlock()
+				// The snowflake was popped off the heap by clientOffers
+				// just as it timed out. The client's offer is on its way,
+				// so hand it to the proxy rather than abandoning the match.
+				// If the client gave up instead, the offer is nil.
+				request.offerChannel <- <-snowflake.offerChannel
 			}
 		}(request)
 	}
@@ -168,17 +285,95 @@ func (ctx *BrokerContext) AddSnowflake(id string, proxyType string, natType stri
 	snowflake.natType = natType
 	snowflake.offerChannel = make(chan *ClientOffer)
 	snowflake.answerChannel = make(chan []byte)
+	snowflake.clientDone = make(chan struct{})
 	ctx.snowflakeLock.Lock()
-	if natType == NATUnrestricted {
+	if waiter := ctx.takeWaitingOffer(natType); waiter != nil {
+		// Matched at once with a client offer that was waiting, so
+		// never on a heap.
+		snowflake.index = -1
+		waiter.snowflake <- snowflake
+	} else if natType == NATUnrestricted {
 		heap.Push(ctx.snowflakes, snowflake)
 	} else {
 		heap.Push(ctx.restrictedSnowflakes, snowflake)
 	}
-	ctx.snowflakeLock.Unlock()
 	ctx.idToSnowflake[id] = snowflake
+	ctx.snowflakeLock.Unlock()
 	return snowflake
 }
 
+// A client offer waiting for a proxy to poll.
+type offerWaiter struct {
+	natType string
+	// Receives the snowflake matched with the offer. Buffered, so that
+	// AddSnowflake doesn't block.
+	snowflake chan *Snowflake
+}
+
+// Removes and returns the oldest waiting client offer that a proxy of the given
+// NAT type can serve, or nil if none is waiting. Restricted proxies are best
+// given to unrestricted clients, but if none is waiting, the proxy goes to the
+// oldest waiting client anyway, as matchClientOffer falls back to an
+// incompatible proxy rather than deny a client. The caller must hold
+// snowflakeLock.
+func (ctx *BrokerContext) takeWaitingOffer(proxyNATType string) *offerWaiter {
+	if len(ctx.waitingOffers) == 0 {
+		return nil
+	}
+	i := 0
+	for j, waiter := range ctx.waitingOffers {
+		if proxyNATType == NATUnrestricted || waiter.natType == NATUnrestricted {
+			i = j
+			break
+		}
+	}
+	waiter := ctx.waitingOffers[i]
+	ctx.waitingOffers = append(ctx.waitingOffers[:i], ctx.waitingOffers[i+1:]...)
+	return waiter
+}
+
+// Waits for a proxy to poll and be matched with a waiting client offer, until
+// matchCtx is done. Returns nil if none is.
+func (ctx *BrokerContext) waitForSnowflake(matchCtx context.Context, waiter *offerWaiter) *Snowflake {
+	var snowflake *Snowflake
+	select {
+	case snowflake = <-waiter.snowflake:
+	case <-matchCtx.Done():
+	}
+	if matchCtx.Err() == nil {
+		return snowflake
+	}
+
+	ctx.snowflakeLock.Lock()
+	for i, other := range ctx.waitingOffers {
+		if other == waiter {
+			ctx.waitingOffers = append(ctx.waitingOffers[:i], ctx.waitingOffers[i+1:]...)
+			ctx.snowflakeLock.Unlock()
+			return nil
+		}
+	}
+	// A proxy was matched just as the wait ended. The client won't wait
+	// for its answer, so give the proxy back for another client, rather
+	// than make it do the WebRTC work for nothing.
+	if snowflake == nil {
+		snowflake = <-waiter.snowflake
+	}
+	if snowflake.pollEnded {
+		// Its poll is over, and waiting for an offer. End it with none.
+		delete(ctx.idToSnowflake, snowflake.id)
+		ctx.snowflakeLock.Unlock()
+		snowflake.offerChannel <- nil
+		return nil
+	}
+	if snowflake.natType == NATUnrestricted {
+		heap.Push(ctx.snowflakes, snowflake)
+	} else {
+		heap.Push(ctx.restrictedSnowflakes, snowflake)
+	}
+	ctx.snowflakeLock.Unlock()
+	return nil
+}
+
 /*
 For snowflake proxies to request a client from the Broker.
 */
@@ -190,16 +385,62 @@ func proxyPolls(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sid, proxyType, natType, err := messages.DecodePollRequest(body)
+	sid, proxyType, natType, version, err := messages.DecodePollRequest(body)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	// Log geoip stats
-	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	b, err := ctx.handleProxyPoll(r.Context(), sid, proxyType, natType, version, ctx.remoteIP(r))
+	if err == errProxyPollsFull {
+		w.Header().Set("Retry-After", proxyPollRetryAfter)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
-		log.Println("Error processing proxy IP: ", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, err := w.Write(b); err != nil {
+		log.Printf("proxyPolls unable to write offer with error: %v", err)
+	}
+}
+
+// Returns the IP address of the host that made a request, or "" if it can't be
+// determined. Behind a reverse proxy, this is the last address in the
+// X-Forwarded-For header, which is the one added by the reverse proxy itself.
+func (ctx *BrokerContext) remoteIP(r *http.Request) string {
+	if ctx.trustForwardedFor {
+		if header := r.Header.Get("X-Forwarded-For"); header != "" {
+			addrs := strings.Split(header, ",")
+			ip := net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1]))
+			if ip == nil {
+				return ""
+			}
+			return ip.String()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// Records a proxy poll and waits for a client offer for it. Returns the
+// encoded poll response, which carries no offer if the poll timed out, or
+// errProxyPollsFull if the poll was rejected. The response is in the version of
+// the protocol negotiated with the proxy.
+func (ctx *BrokerContext) handleProxyPoll(reqCtx context.Context, sid, proxyType, natType string, version messages.Version, remoteIP string) ([]byte, error) {
+	version = messages.NegotiateVersion(version)
+
+	ctx.metrics.lock.Lock()
+	ctx.metrics.totals.proxyPolls++
+	ctx.metrics.lock.Unlock()
+
+	// Log geoip stats
+	if remoteIP == "" {
+		log.Println("Error processing proxy IP")
 	} else {
 		ctx.metrics.lock.Lock()
 		ctx.metrics.UpdateCountryStats(remoteIP, proxyType, natType)
@@ -207,30 +448,21 @@ func proxyPolls(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Wait for a client to avail an offer to the snowflake, or timeout if nil.
-	offer := ctx.RequestOffer(sid, proxyType, natType)
-	var b []byte
+	offer, err := ctx.RequestOffer(reqCtx, sid, proxyType, natType)
+	if err != nil {
+		ctx.metrics.lock.Lock()
+		ctx.metrics.totals.proxyPollsRejected++
+		ctx.metrics.lock.Unlock()
+		return nil, err
+	}
 	if nil == offer {
 		ctx.metrics.lock.Lock()
 		ctx.metrics.proxyIdleCount++
 		ctx.metrics.lock.Unlock()
 
-		b, err = messages.EncodePollResponse("", false, "")
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		w.Write(b)
-		return
-	}
-	b, err = messages.EncodePollResponse(string(offer.sdp), true, offer.natType)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	if _, err := w.Write(b); err != nil {
-		log.Printf("proxyPolls unable to write offer with error: %v", err)
+		return messages.EncodePollResponse("", false, "", version)
 	}
+	return messages.EncodePollResponse(string(offer.sdp), true, offer.natType, version)
 }
 
 // Client offer contains an SDP and the NAT type of the client
@@ -249,7 +481,15 @@ func clientOffers(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
 
 	startTime := time.Now()
 	offer := &ClientOffer{}
-	offer.sdp, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, readLimit))
+	if r.Method == http.MethodGet {
+		if !ctx.allowGetOffers {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		offer.sdp, err = decodeQueryOffer(r.URL.Query().Get("offer"))
+	} else {
+		offer.sdp, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, readLimit))
+	}
 	if nil != err {
 		log.Println("Invalid data.")
 		w.WriteHeader(http.StatusBadRequest)
@@ -257,64 +497,300 @@ func clientOffers(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
 	}
 
 	offer.natType = r.Header.Get("Snowflake-NAT-Type")
+	// Echo the client's nonce, so that it can tell the answer is for this
+	// offer.
+	if nonce := r.Header.Get(messages.NonceHeader); nonce != "" {
+		w.Header().Set(messages.NonceHeader, nonce)
+	}
+	answer, proxyNATType, status := ctx.matchClientOffer(r.Context(), offer, startTime)
+	switch status {
+	case http.StatusOK:
+		// Tell the client the NAT type of its proxy, to help explain a
+		// failure to connect.
+		w.Header().Set("Snowflake-NAT-Type", proxyNATType)
+		if _, err := w.Write(answer); err != nil {
+			log.Printf("unable to write answer with error: %v", err)
+		}
+	case http.StatusGatewayTimeout:
+		w.Header().Set("Retry-After", strconv.Itoa(ctx.clientRetryAfter()))
+		w.WriteHeader(status)
+		if _, err := w.Write([]byte("timed out waiting for answer!")); err != nil {
+			log.Printf("unable to write timeout error, failed with error: %v", err)
+		}
+	case http.StatusServiceUnavailable:
+		w.Header().Set("Retry-After", strconv.Itoa(ctx.clientRetryAfter()))
+		w.WriteHeader(status)
+	default:
+		w.WriteHeader(status)
+	}
+}
+
+// Returns the number of idle proxies, and an estimate of the seconds until an
+// offer could be matched: none if proxies are idle, a little if their polls
+// are waiting to be matched, and otherwise about how long it takes proxies to
+// poll again.
+func (ctx *BrokerContext) availability() (int, int) {
+	ctx.snowflakeLock.Lock()
+	idle := ctx.snowflakes.Len() + ctx.restrictedSnowflakes.Len()
+	ctx.snowflakeLock.Unlock()
+	if idle > 0 {
+		return idle, 0
+	}
+	if len(ctx.proxyPolls) > 0 {
+		return 0, clientRetryAfterMin
+	}
+	return 0, clientRetryAfterMax
+}
+
+// Returns how many seconds a client whose offer went unanswered should wait
+// before sending another.
+func (ctx *BrokerContext) clientRetryAfter() int {
+	_, wait := ctx.availability()
+	if wait < clientRetryAfterMin {
+		return clientRetryAfterMin
+	}
+	return wait
+}
+
+// Returns the encoded response to /status at time now, which is reused for
+// statusCacheDuration.
+func (ctx *BrokerContext) status(now time.Time) ([]byte, error) {
+	ctx.statusLock.Lock()
+	defer ctx.statusLock.Unlock()
+	if ctx.statusBody != nil && now.Sub(ctx.statusTime) < statusCacheDuration {
+		return ctx.statusBody, nil
+	}
+	b, err := messages.EncodeClientStatusResponse(ctx.availability())
+	if err != nil {
+		return nil, err
+	}
+	ctx.statusBody = b
+	ctx.statusTime = now
+	return b, nil
+}
+
+/*
+For clients to learn whether proxies are available before sending an offer.
+The response is cached briefly and takes no request body, so it is cheap to
+serve.
+*/
+func clientStatus(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := ctx.status(time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(b); err != nil {
+		log.Printf("unable to write status with error: %v", err)
+	}
+}
+
+/*
+Passes a client's offer to the most available snowflake proxy, and waits for
+the proxy's answer. If no proxy is available, the offer waits in a queue for
+one to poll. Returns the answer, the proxy's NAT type, and an HTTP status:
+http.StatusOK on a match, http.StatusBadRequest if the offer is not a valid
+offer, http.StatusServiceUnavailable if no proxy became available, or
+http.StatusGatewayTimeout if the proxy did not answer in time or the request
+was given up on, which reqCtx signals.
+*/
+func (ctx *BrokerContext) matchClientOffer(reqCtx context.Context, offer *ClientOffer, startTime time.Time) ([]byte, string, int) {
+	if err := validateSessionDescription(offer.sdp, webrtc.SDPTypeOffer); err != nil {
+		log.Printf("Invalid offer: %v", err)
+		return nil, "", http.StatusBadRequest
+	}
+
+	ctx.metrics.lock.Lock()
+	ctx.metrics.totals.clientOffers++
+	ctx.metrics.lock.Unlock()
+
+	if ctx.candidateCounts != nil {
+		ctx.candidateCounts.AddOffer(offer.sdp)
+	}
+
 	if offer.natType == "" {
 		offer.natType = NATUnknown
 	}
 
-	// Only hand out known restricted snowflakes to unrestricted clients
-	var snowflakeHeap *SnowflakeHeap
+	// Waiting in the queue for a proxy and waiting for its answer share one
+	// deadline, so that the client gets a response within clientTimeout.
+	matchCtx, cancel := context.WithTimeout(reqCtx, ctx.clientTimeout)
+	defer cancel()
+
+	// Only hand out known restricted snowflakes to unrestricted clients. If
+	// there are no compatible snowflakes, fall back to the other heap rather
+	// than denying the client outright.
+	var snowflakeHeap, fallbackHeap *SnowflakeHeap
 	if offer.natType == NATUnrestricted {
 		snowflakeHeap = ctx.restrictedSnowflakes
+		fallbackHeap = ctx.snowflakes
 	} else {
 		snowflakeHeap = ctx.snowflakes
+		fallbackHeap = ctx.restrictedSnowflakes
 	}
 
-	// Immediately fail if there are no snowflakes available.
+	// Find the most available snowflake proxy, and pass the offer to it.
+	// Delete must be deferred in order to correctly process answer request later.
+	// If there is none, wait in the queue for one to poll, if there is
+	// room.
+	var snowflake *Snowflake
+	var waiter *offerWaiter
+	mismatch := false
 	ctx.snowflakeLock.Lock()
-	numSnowflakes := snowflakeHeap.Len()
+	if snowflakeHeap.Len() > 0 {
+		snowflake = heap.Pop(snowflakeHeap).(*Snowflake)
+	} else if fallbackHeap.Len() > 0 {
+		snowflake = heap.Pop(fallbackHeap).(*Snowflake)
+		// Only a client that isn't known to be unrestricted can be
+		// incompatible with a restricted snowflake.
+		mismatch = offer.natType != NATUnrestricted
+	} else if len(ctx.waitingOffers) < ctx.clientOfferQueueSize {
+		waiter = &offerWaiter{natType: offer.natType, snowflake: make(chan *Snowflake, 1)}
+		ctx.waitingOffers = append(ctx.waitingOffers, waiter)
+	}
 	ctx.snowflakeLock.Unlock()
-	if numSnowflakes <= 0 {
+	if waiter != nil {
+		snowflake = ctx.waitForSnowflake(matchCtx, waiter)
+		mismatch = snowflake != nil && snowflake.natType != NATUnrestricted &&
+			offer.natType != NATUnrestricted
+	}
+
+	// Fail if there are no snowflakes available.
+	if snowflake == nil {
 		ctx.metrics.lock.Lock()
 		ctx.metrics.clientDeniedCount++
+		ctx.metrics.totals.clientDenied++
 		if offer.natType == NATUnrestricted {
 			ctx.metrics.clientUnrestrictedDeniedCount++
 		} else {
 			ctx.metrics.clientRestrictedDeniedCount++
 		}
 		ctx.metrics.lock.Unlock()
-		w.WriteHeader(http.StatusServiceUnavailable)
-		return
+		return nil, "", http.StatusServiceUnavailable
+	}
+	if mismatch {
+		ctx.metrics.lock.Lock()
+		ctx.metrics.clientNATMismatchCount++
+		ctx.metrics.totals.clientNATMismatches++
+		ctx.metrics.lock.Unlock()
 	}
-	// Otherwise, find the most available snowflake proxy, and pass the offer to it.
-	// Delete must be deferred in order to correctly process answer request later.
-	ctx.snowflakeLock.Lock()
-	snowflake := heap.Pop(snowflakeHeap).(*Snowflake)
-	ctx.snowflakeLock.Unlock()
 	snowflake.offerChannel <- offer
 
 	// Wait for the answer to be returned on the channel or timeout.
+	var answer []byte
+	status := http.StatusGatewayTimeout
 	select {
-	case answer := <-snowflake.answerChannel:
+	case answer = <-snowflake.answerChannel:
+		if len(answer) == 0 {
+			// The proxy couldn't answer. Let the client try
+			// another one at once, rather than wait out the
+			// timeout.
+			log.Println("Client: Proxy could not answer.")
+			status = http.StatusServiceUnavailable
+			break
+		}
+		status = http.StatusOK
 		ctx.metrics.lock.Lock()
 		ctx.metrics.clientProxyMatchCount++
+		ctx.metrics.totals.clientMatches++
 		ctx.metrics.lock.Unlock()
-		if _, err := w.Write(answer); err != nil {
-			log.Printf("unable to write answer with error: %v", err)
-		}
 		// Initial tracking of elapsed time.
-		ctx.metrics.clientRoundtripEstimate = time.Since(startTime) /
-			time.Millisecond
-	case <-time.After(time.Second * ClientTimeout):
-		log.Println("Client: Timed out.")
-		w.WriteHeader(http.StatusGatewayTimeout)
-		if _, err := w.Write([]byte("timed out waiting for answer!")); err != nil {
-			log.Printf("unable to write timeout error, failed with error: %v", err)
+		latency := time.Since(startTime)
+		ctx.metrics.lock.Lock()
+		ctx.metrics.clientRoundtripEstimate = latency / time.Millisecond
+		ctx.metrics.totals.matchLatency.observe(latency, debugSnowflakeID(snowflake.id), time.Now())
+		ctx.metrics.lock.Unlock()
+		if ctx.metricsExemplars {
+			log.Printf("Client: matched with snowflake %s in %v", debugSnowflakeID(snowflake.id), latency)
+		}
+	case <-matchCtx.Done():
+		if reqCtx.Err() != nil {
+			log.Println("Client: Gone before an answer.")
+			break
 		}
+		log.Println("Client: Timed out.")
+		ctx.metrics.lock.Lock()
+		ctx.metrics.totals.clientTimeouts++
+		ctx.metrics.lock.Unlock()
 	}
 
+	close(snowflake.clientDone)
 	ctx.snowflakeLock.Lock()
 	delete(ctx.idToSnowflake, snowflake.id)
 	ctx.snowflakeLock.Unlock()
+
+	return answer, snowflake.natType, status
+}
+
+// Decodes an offer sent as unpadded URL-safe base64 in a query parameter, for
+// clients that can't send a POST body. The same size limit applies as to the
+// body of a POST.
+func decodeQueryOffer(encoded string) ([]byte, error) {
+	if encoded == "" {
+		return nil, fmt.Errorf("no offer in query")
+	}
+	if len(encoded) > base64.RawURLEncoding.EncodedLen(readLimit) {
+		return nil, fmt.Errorf("offer in query is too long")
+	}
+	return base64.RawURLEncoding.DecodeString(encoded)
+}
+
+/*
+Like clientOffers, but for a client that rendezvouses through an AMP cache. The
+request is a GET of /amp/client/[NAT type]/[offer], with the offer encoded as
+for decodeQueryOffer. An AMP cache only passes on successful responses in AMP
+HTML, so the response is always 200 OK with a messages.AMPClientResponse,
+armored as an AMP document, that carries either the answer or an error.
+*/
+func ampClientOffers(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	var answer []byte
+	var proxyNATType, errorMessage string
+
+	offer := &ClientOffer{}
+	var err error
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/amp/client/"), "/", 2)
+	if r.Method != http.MethodGet || len(path) != 2 {
+		err = fmt.Errorf("malformed AMP cache request")
+	} else {
+		offer.natType = path[0]
+		offer.sdp, err = decodeQueryOffer(path[1])
+	}
+	if err != nil {
+		log.Println("Invalid data.")
+		errorMessage = messages.AMPErrorBadOffer
+	} else {
+		var status int
+		answer, proxyNATType, status = ctx.matchClientOffer(r.Context(), offer, startTime)
+		switch status {
+		case http.StatusBadRequest:
+			errorMessage = messages.AMPErrorBadOffer
+		case http.StatusServiceUnavailable:
+			errorMessage = messages.AMPErrorNoProxies
+		case http.StatusGatewayTimeout:
+			errorMessage = messages.AMPErrorTimeout
+		}
+	}
+
+	body, err := messages.EncodeAMPClientResponse(string(answer), proxyNATType,
+		r.URL.Query().Get("nonce"), errorMessage)
+	if err != nil {
+		log.Printf("Error encoding AMP response: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	// The offer makes each URL unique, so there is no use in the cache
+	// keeping the response.
+	w.Header().Set("Cache-Control", "no-store")
+	if err := amp.Armor(w, body); err != nil {
+		log.Printf("unable to write AMP response with error: %v", err)
+	}
 }
 
 /*
@@ -331,22 +807,21 @@ func proxyAnswers(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	answer, id, err := messages.DecodeAnswerRequest(body)
-	if err != nil || answer == "" {
+	answer, answerError, id, err := messages.DecodeAnswerRequestWithError(body)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-
-	var success = true
-	ctx.snowflakeLock.Lock()
-	snowflake, ok := ctx.idToSnowflake[id]
-	ctx.snowflakeLock.Unlock()
-	if !ok || nil == snowflake {
-		// The snowflake took too long to respond with an answer, so its client
-		// disappeared / the snowflake is no longer recognized by the Broker.
-		success = false
+	if answerError != "" {
+		log.Printf("Proxy could not answer: %s", answerError)
+	} else if err := validateSessionDescription([]byte(answer), webrtc.SDPTypeAnswer); err != nil {
+		log.Printf("Invalid answer: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
-	b, err := messages.EncodeAnswerResponse(success)
+
+	snowflake := ctx.answeredSnowflake(id)
+	b, err := messages.EncodeAnswerResponse(snowflake != nil)
 	if err != nil {
 		log.Printf("Error encoding answer: %s", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
@@ -354,10 +829,131 @@ func proxyAnswers(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write(b)
 
-	if success {
-		snowflake.answerChannel <- []byte(answer)
+	if snowflake != nil {
+		ctx.passAnswer(r.Context(), snowflake, answer)
+	}
+
+}
+
+// Returns an error unless data is a serialized SessionDescription of type t,
+// whose SDP at least begins like SDP, so that junk isn't relayed between
+// clients and proxies.
+func validateSessionDescription(data []byte, t webrtc.SDPType) error {
+	desc, err := util.DeserializeSessionDescription(string(data))
+	if err != nil {
+		return err
+	}
+	if desc.Type != t {
+		return fmt.Errorf("expected %s, got %s", t, desc.Type)
+	}
+	if !strings.HasPrefix(desc.SDP, "v=") {
+		return errors.New("malformed SDP")
+	}
+	return nil
+}
+
+// Returns the snowflake that an answer from the proxy with the given id is
+// for, or nil if it is no longer recognized.
+func (ctx *BrokerContext) answeredSnowflake(id string) *Snowflake {
+	ctx.snowflakeLock.Lock()
+	defer ctx.snowflakeLock.Unlock()
+	// If the snowflake took too long to respond with an answer, its client
+	// disappeared / the snowflake is no longer recognized by the Broker.
+	return ctx.idToSnowflake[id]
+}
+
+// Passes a proxy's answer back to the client waiting in clientOffers. An empty
+// answer tells the client that the proxy couldn't answer. The answer is dropped
+// if the client has stopped waiting, having timed out or already received an
+// answer for the same snowflake, or if reqCtx, the proxy's request, is done.
+func (ctx *BrokerContext) passAnswer(reqCtx context.Context, snowflake *Snowflake, answer string) {
+	ctx.metrics.lock.Lock()
+	if answer == "" {
+		ctx.metrics.totals.proxyAnswerErrors++
+	} else {
+		ctx.metrics.totals.proxyAnswers++
+	}
+	ctx.metrics.lock.Unlock()
+	if ctx.candidateCounts != nil && answer != "" {
+		ctx.candidateCounts.AddAnswer([]byte(answer))
+	}
+	select {
+	case snowflake.answerChannel <- []byte(answer):
+	case <-snowflake.clientDone:
+		log.Println("Proxy answered after the client stopped waiting.")
+	case <-reqCtx.Done():
+		log.Println("Proxy went away before its answer was passed on.")
+	}
+}
+
+/*
+Lets a snowflake proxy poll for clients and send answers over a single
+long-lived WebSocket connection, instead of an HTTP request for each. Every
+message carries the same JSON as the body of a /proxy or /answer request, and
+is replied to with the same JSON as the HTTP response. Messages are handled in
+order, so a poll occupies the connection until it is matched or times out.
+*/
+func proxyWebSocket(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("proxyWebSocket unable to upgrade connection: %v", err)
+		return
 	}
+	defer conn.Close()
+	conn.SetReadLimit(readLimit)
+
+	for {
+		// A proxy polls again soon after each response, so a
+		// connection that stays idle is gone.
+		conn.SetReadDeadline(time.Now().Add(httpIdleTimeout))
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var b []byte
+		var snowflake *Snowflake
+		// An answer request is told apart from a poll request by its
+		// non-empty Answer or Error field.
+		answer, answerError, id, decodeErr := messages.DecodeAnswerRequestWithError(body)
+		if decodeErr == nil {
+			if answerError != "" {
+				log.Printf("Proxy could not answer: %s", answerError)
+			} else if err := validateSessionDescription([]byte(answer), webrtc.SDPTypeAnswer); err != nil {
+				log.Printf("proxyWebSocket received invalid answer: %v", err)
+				return
+			}
+			snowflake = ctx.answeredSnowflake(id)
+			b, err = messages.EncodeAnswerResponse(snowflake != nil)
+		} else {
+			var sid, proxyType, natType string
+			var version messages.Version
+			sid, proxyType, natType, version, err = messages.DecodePollRequest(body)
+			if err != nil {
+				log.Println("proxyWebSocket received invalid message.")
+				return
+			}
+			b, err = ctx.handleProxyPoll(r.Context(), sid, proxyType, natType, version, ctx.remoteIP(r))
+			if err == errProxyPollsFull {
+				// Answer as if no client came, and the proxy will
+				// poll again later.
+				b, err = messages.EncodePollResponse("", false, "",
+					messages.NegotiateVersion(version))
+			}
+		}
+		if err != nil {
+			log.Printf("proxyWebSocket unable to encode response: %v", err)
+			return
+		}
 
+		if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+			log.Printf("proxyWebSocket unable to write response: %v", err)
+			return
+		}
+		if snowflake != nil {
+			ctx.passAnswer(r.Context(), snowflake, answer)
+		}
+	}
 }
 
 func debugHandler(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
@@ -402,6 +998,73 @@ func debugHandler(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// The state of the broker, as served at /debug.json.
+type debugState struct {
+	SnowflakesAvailable int `json:"snowflakes_available"`
+	// Average time taken to answer matched client offers.
+	RoundtripAvgMs int64            `json:"roundtrip_avg_ms"`
+	Snowflakes     []debugSnowflake `json:"snowflakes"`
+}
+
+// A snowflake waiting for a client. Its session ID would let anyone answer in
+// its place, so it is identified by a hash of the session ID instead.
+type debugSnowflake struct {
+	ID        string `json:"id"`
+	Index     int    `json:"index"`
+	Clients   int    `json:"clients"`
+	ProxyType string `json:"proxy_type"`
+	NATType   string `json:"nat_type"`
+}
+
+// Returns an ID for a snowflake that stays the same while it waits, but can't
+// be used to answer for it.
+func debugSnowflakeID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Serves the information of debugHandler, and more, as JSON for monitoring.
+func debugJSONHandler(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	var state debugState
+	ctx.snowflakeLock.Lock()
+	state.SnowflakesAvailable = len(ctx.idToSnowflake)
+	state.Snowflakes = make([]debugSnowflake, 0, len(ctx.idToSnowflake))
+	for _, snowflake := range ctx.idToSnowflake {
+		state.Snowflakes = append(state.Snowflakes, debugSnowflake{
+			ID:        debugSnowflakeID(snowflake.id),
+			Index:     snowflake.index,
+			Clients:   snowflake.clients,
+			ProxyType: snowflake.proxyType,
+			NATType:   snowflake.natType,
+		})
+	}
+	ctx.snowflakeLock.Unlock()
+	// Each heap has its own indexes.
+	sort.Slice(state.Snowflakes, func(i, j int) bool {
+		a, b := state.Snowflakes[i], state.Snowflakes[j]
+		if a.NATType != b.NATType {
+			return a.NATType < b.NATType
+		}
+		return a.Index < b.Index
+	})
+
+	ctx.metrics.lock.Lock()
+	latency := ctx.metrics.totals.matchLatency
+	ctx.metrics.lock.Unlock()
+	var count uint64
+	for _, n := range latency.counts {
+		count += n
+	}
+	if count > 0 {
+		state.RoundtripAvgMs = int64(latency.sum * 1000 / float64(count))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		log.Printf("writing proxy information returned error: %v ", err)
+	}
+}
+
 func robotsTxtHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	if _, err := w.Write([]byte("User-agent: *\nDisallow: /\n")); err != nil {
@@ -428,6 +1091,53 @@ func metricsHandler(metricsFilename string, w http.ResponseWriter, r *http.Reque
 	}
 }
 
+// Opens a TCP listener at each of a comma-separated list of addresses. An IPv4
+// address listens on IPv4 only, and an IPv6 address, such as "[::]:443", on
+// IPv6 only, so that the two may share a port. An address with no host, such as
+// ":443", listens on both.
+func listenAll(addrs string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			closeAll(listeners)
+			return nil, err
+		}
+		network := "tcp"
+		if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+			network = "tcp4"
+		} else if ip != nil {
+			network = "tcp6"
+		}
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			closeAll(listeners)
+			return nil, err
+		}
+		log.Printf("Listening on %s", ln.Addr())
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, ln := range listeners {
+		ln.Close()
+	}
+}
+
+// Runs serve on each listener, and returns the first error that one returns.
+func serveAll(listeners []net.Listener, serve func(net.Listener) error) error {
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			errs <- serve(ln)
+		}(ln)
+	}
+	return <-errs
+}
+
 func main() {
 	var acmeEmail string
 	var acmeHostnamesCommas string
@@ -440,19 +1150,51 @@ func main() {
 	var disableGeoip bool
 	var metricsFilename string
 	var unsafeLogging bool
+	var scrubSessionIDs bool
+	var candidateStats bool
+	var metricsAddr string
+	var metricsExemplars bool
+	var metricsInterval time.Duration
+	var maxCountryCodes int
+	var trustForwardedFor bool
+	var rateLimit float64
+	var rateLimitBurst int
+	var rateLimitExemptLoopback bool
+	var allowGetOffers bool
+	var proxyPollQueueSize int
+	var shutdownTimeout time.Duration
+	var clientTimeout time.Duration
+	var proxyTimeout time.Duration
+	var clientOfferQueueSize int
 
 	flag.StringVar(&acmeEmail, "acme-email", "", "optional contact email for Let's Encrypt notifications")
 	flag.StringVar(&acmeHostnamesCommas, "acme-hostnames", "", "comma-separated hostnames for TLS certificate")
 	flag.StringVar(&certFilename, "cert", "", "TLS certificate file")
 	flag.StringVar(&keyFilename, "key", "", "TLS private key file")
 	flag.StringVar(&acmeCertCacheDir, "acme-cert-cache", "acme-cert-cache", "directory in which certificates should be cached")
-	flag.StringVar(&addr, "addr", ":443", "address to listen on")
-	flag.StringVar(&geoipDatabase, "geoipdb", "/usr/share/tor/geoip", "path to correctly formatted geoip database mapping IPv4 address ranges to country codes")
-	flag.StringVar(&geoip6Database, "geoip6db", "/usr/share/tor/geoip6", "path to correctly formatted geoip database mapping IPv6 address ranges to country codes")
+	flag.StringVar(&addr, "addr", ":443", "comma-separated addresses to listen on")
+	flag.StringVar(&geoipDatabase, "geoipdb", "/usr/share/tor/geoip", "path to correctly formatted geoip database mapping IPv4 address ranges to country codes, or to a MaxMind DB (.mmdb) file")
+	flag.StringVar(&geoip6Database, "geoip6db", "/usr/share/tor/geoip6", "path to correctly formatted geoip database mapping IPv6 address ranges to country codes, or to a MaxMind DB (.mmdb) file")
 	flag.BoolVar(&disableTLS, "disable-tls", false, "don't use HTTPS")
 	flag.BoolVar(&disableGeoip, "disable-geoip", false, "don't use geoip for stats collection")
 	flag.StringVar(&metricsFilename, "metrics-log", "", "path to metrics logging output")
 	flag.BoolVar(&unsafeLogging, "unsafe-logging", false, "prevent logs from being scrubbed")
+	flag.BoolVar(&scrubSessionIDs, "scrub-session-ids", false, "also scrub proxy session IDs from logs")
+	flag.DurationVar(&metricsInterval, "metrics-interval", metricsResolution, "interval at which metrics are written to the metrics log and reset")
+	flag.IntVar(&maxCountryCodes, "max-country-codes", defaultMaxCountryCodes, "maximum number of distinct country codes counted per metrics interval; more are counted as \"??\"")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "address on which to serve Prometheus metrics at /metrics (disabled if empty)")
+	flag.BoolVar(&metricsExemplars, "metrics-exemplars", false, "serve metrics at --metrics-addr as OpenMetrics, with exemplars tying match latencies to logged proxy IDs")
+	flag.BoolVar(&trustForwardedFor, "trust-x-forwarded-for", false, "take proxy addresses for metrics from the X-Forwarded-For header (only behind a reverse proxy)")
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "requests per second allowed from each IP address (0 for no limit)")
+	flag.IntVar(&rateLimitBurst, "rate-limit-burst", 10, "requests allowed in a burst from each IP address, with --rate-limit")
+	flag.BoolVar(&rateLimitExemptLoopback, "rate-limit-exempt-loopback", false, "don't rate limit requests from loopback addresses")
+	flag.BoolVar(&allowGetOffers, "allow-get-offers", false, "also accept client offers encoded in the query string of a GET request to /client")
+	flag.IntVar(&proxyPollQueueSize, "proxy-poll-queue", defaultProxyPollQueueSize, "number of proxy polls that may wait to be matched; more are rejected with 503")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "how long to let pending requests finish after SIGTERM or SIGINT")
+	flag.DurationVar(&clientTimeout, "client-timeout", time.Second*ClientTimeout, "how long a client offer waits for a proxy's answer")
+	flag.IntVar(&clientOfferQueueSize, "client-offer-queue", defaultClientOfferQueueSize, "number of client offers that may wait for a proxy when none is available; more are rejected with 503")
+	flag.DurationVar(&proxyTimeout, "proxy-timeout", time.Second*ProxyTimeout, "how long a proxy poll waits for a client offer")
+	flag.BoolVar(&candidateStats, "candidate-stats", false, "periodically log the distribution of ICE candidate counts in offers and answers")
 	flag.Parse()
 
 	var err error
@@ -462,7 +1204,11 @@ func main() {
 		log.SetOutput(logOutput)
 	} else {
 		// We want to send the log output through our scrubber first
-		log.SetOutput(&safelog.LogScrubber{Output: logOutput})
+		scrubber := &safelog.LogScrubber{Output: logOutput}
+		if scrubSessionIDs {
+			scrubber.AddPattern(sessionIDPattern, "${1}[scrubbed]${2}")
+		}
+		log.SetOutput(scrubber)
 	}
 
 	log.SetFlags(log.LstdFlags | log.LUTC)
@@ -480,6 +1226,27 @@ func main() {
 	metricsLogger := log.New(metricsFile, "", 0)
 
 	ctx := NewBrokerContext(metricsLogger)
+	ctx.trustForwardedFor = trustForwardedFor
+	ctx.allowGetOffers = allowGetOffers
+	ctx.metricsExemplars = metricsExemplars
+	if proxyPollQueueSize < 1 {
+		log.Fatal("-proxy-poll-queue must be at least 1")
+	}
+	ctx.proxyPolls = make(chan *ProxyPoll, proxyPollQueueSize)
+	if clientTimeout <= 0 || proxyTimeout <= 0 {
+		log.Fatal("-client-timeout and -proxy-timeout must be positive")
+	}
+	ctx.clientTimeout = clientTimeout
+	ctx.proxyTimeout = proxyTimeout
+	if clientOfferQueueSize < 0 {
+		log.Fatal("-client-offer-queue must not be negative")
+	}
+	ctx.clientOfferQueueSize = clientOfferQueueSize
+	if rateLimit > 0 {
+		ctx.rateLimiter = NewRateLimiter(rateLimit, rateLimitBurst, rateLimitExemptLoopback)
+	}
+	ctx.metrics.maxCountryCodes = maxCountryCodes
+	ctx.metrics.Start(metricsInterval)
 
 	if !disableGeoip {
 		err = ctx.metrics.LoadGeoipDatabases(geoipDatabase, geoip6Database)
@@ -488,20 +1255,60 @@ func main() {
 		}
 	}
 
+	if candidateStats {
+		ctx.candidateCounts = NewCandidateCounts()
+		go ctx.candidateCounts.logCounts()
+	}
+
+	var prometheusServer *http.Server
+	if metricsAddr != "" {
+		prometheusServer = servePrometheus(ctx, metricsAddr)
+	}
+
 	go ctx.Broker()
 
 	http.HandleFunc("/robots.txt", robotsTxtHandler)
 
 	http.Handle("/proxy", SnowflakeHandler{ctx, proxyPolls})
 	http.Handle("/client", SnowflakeHandler{ctx, clientOffers})
+	http.Handle("/amp/client/", SnowflakeHandler{ctx, ampClientOffers})
+	http.Handle("/status", SnowflakeHandler{ctx, clientStatus})
 	http.Handle("/answer", SnowflakeHandler{ctx, proxyAnswers})
+	http.Handle("/ws", SnowflakeHandler{ctx, proxyWebSocket})
 	http.Handle("/debug", SnowflakeHandler{ctx, debugHandler})
+	http.Handle("/debug.json", SnowflakeHandler{ctx, debugJSONHandler})
 	http.Handle("/metrics", MetricsHandler{metricsFilename, metricsHandler})
 
 	server := http.Server{
-		Addr: addr,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      clientTimeout + proxyTimeout + httpWriteTimeoutExtra,
+		IdleTimeout:       httpIdleTimeout,
 	}
 
+	// On SIGTERM or SIGINT, stop accepting connections and let pending
+	// polls, offers, and answers finish, before the final metrics are
+	// written. Prometheus is served until then, so that it can scrape the
+	// last of the counts.
+	termChan := make(chan os.Signal, 1)
+	signal.Notify(termChan, syscall.SIGTERM, syscall.SIGINT)
+	shutdownDone := make(chan struct{})
+	go func() {
+		signal := <-termChan
+		log.Printf("Received signal: %s. Shutting down.", signal)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("error shutting down: %v", err)
+		}
+		if prometheusServer != nil {
+			if err := prometheusServer.Shutdown(shutdownCtx); err != nil {
+				log.Printf("error shutting down Prometheus metrics: %v", err)
+			}
+		}
+		close(shutdownDone)
+	}()
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP)
 
@@ -511,13 +1318,22 @@ func main() {
 	go func() {
 		for {
 			signal := <-sigChan
+			if disableGeoip {
+				log.Printf("Received signal: %s. Ignoring it, because geoip is disabled.", signal)
+				continue
+			}
 			log.Printf("Received signal: %s. Reloading geoip databases.", signal)
-			if err = ctx.metrics.LoadGeoipDatabases(geoipDatabase, geoip6Database); err != nil {
-				log.Fatalf("reload of Geo IP databases on signal %s returned error: %v", signal, err)
+			if err := ctx.metrics.LoadGeoipDatabases(geoipDatabase, geoip6Database); err != nil {
+				log.Printf("reload of Geo IP databases on signal %s returned error: %v; keeping the previous databases", signal, err)
 			}
 		}
 	}()
 
+	listeners, err := listenAll(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Handle the various ways of setting up TLS. The legal configurations
 	// are:
 	//   --acme-hostnames (with optional --acme-email and/or --acme-cert-cache)
@@ -548,19 +1364,26 @@ func main() {
 		}()
 
 		server.TLSConfig = &tls.Config{GetCertificate: certManager.GetCertificate}
-		err = server.ListenAndServeTLS("", "")
+		err = serveAll(listeners, func(ln net.Listener) error {
+			return server.ServeTLS(ln, "", "")
+		})
 	} else if certFilename != "" && keyFilename != "" {
 		if acmeEmail != "" || acmeHostnamesCommas != "" {
 			log.Fatalf("The --cert and --key options are not allowed with --acme-email or --acme-hostnames.")
 		}
-		err = server.ListenAndServeTLS(certFilename, keyFilename)
+		err = serveAll(listeners, func(ln net.Listener) error {
+			return server.ServeTLS(ln, certFilename, keyFilename)
+		})
 	} else if disableTLS {
-		err = server.ListenAndServe()
+		err = serveAll(listeners, server.Serve)
 	} else {
 		log.Fatal("the --acme-hostnames, --cert and --key, or --disable-tls option is required")
 	}
 
-	if err != nil {
+	if err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-shutdownDone
+	ctx.metrics.Stop()
+	log.Println("Broker stopped.")
 }
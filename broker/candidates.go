@@ -0,0 +1,99 @@
+/*
+Optional aggregation of the number of ICE candidates in the offers and answers
+that pass through the broker. Only the distribution of counts is kept, never
+the SDP contents, and it is written to the regular log at a fixed interval.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/common/util"
+)
+
+const candidateCountsInterval = time.Hour
+
+type CandidateCounts struct {
+	// Maps a number of candidates to how many descriptions had that many.
+	offers  map[int]uint
+	answers map[int]uint
+
+	lock sync.Mutex
+}
+
+func NewCandidateCounts() *CandidateCounts {
+	return &CandidateCounts{
+		offers:  make(map[int]uint),
+		answers: make(map[int]uint),
+	}
+}
+
+// Returns the number of ICE candidates in a serialized SessionDescription
+func candidateCount(msg []byte) (int, error) {
+	desc, err := util.DeserializeSessionDescription(string(msg))
+	if err != nil {
+		return 0, err
+	}
+	return util.CountICECandidates(desc.SDP)
+}
+
+func (c *CandidateCounts) add(counts map[int]uint, msg []byte) {
+	n, err := candidateCount(msg)
+	if err != nil {
+		return
+	}
+	c.lock.Lock()
+	counts[n]++
+	c.lock.Unlock()
+}
+
+func (c *CandidateCounts) AddOffer(offer []byte)   { c.add(c.offers, offer) }
+func (c *CandidateCounts) AddAnswer(answer []byte) { c.add(c.answers, answer) }
+
+// Formats a distribution as NUM=COUNT pairs, ordered by number of candidates.
+func displayCounts(counts map[int]uint) string {
+	keys := make([]int, 0, len(counts))
+	for n := range counts {
+		keys = append(keys, n)
+	}
+	sort.Ints(keys)
+	output := ""
+	for _, n := range keys {
+		output += fmt.Sprintf("%d=%d,", n, counts[n])
+	}
+	// cut off trailing ","
+	if len(output) > 0 {
+		return output[:len(output)-1]
+	}
+	return output
+}
+
+// Returns the offer and answer distributions, and resets them.
+func (c *CandidateCounts) Flush() (string, string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	offers, answers := displayCounts(c.offers), displayCounts(c.answers)
+	// The maps themselves are never replaced, so that add may select one
+	// without holding the lock.
+	for n := range c.offers {
+		delete(c.offers, n)
+	}
+	for n := range c.answers {
+		delete(c.answers, n)
+	}
+	return offers, answers
+}
+
+func (c *CandidateCounts) logCounts() {
+	heartbeat := time.Tick(candidateCountsInterval)
+	for range heartbeat {
+		offers, answers := c.Flush()
+		log.Printf("ICE candidates per offer: %s", offers)
+		log.Printf("ICE candidates per answer: %s", answers)
+	}
+}
@@ -48,6 +48,8 @@ type GeoIPTable interface {
 	Len() int
 	Append(GeoIPEntry)
 	ElementAt(int) GeoIPEntry
+	Less(i, j int) bool
+	Swap(i, j int)
 	Lock()
 	Unlock()
 }
@@ -83,6 +85,21 @@ func (table *GeoIPv6Table) Append(entry GeoIPEntry) {
 func (table *GeoIPv4Table) ElementAt(i int) GeoIPEntry { return table.table[i] }
 func (table *GeoIPv6Table) ElementAt(i int) GeoIPEntry { return table.table[i] }
 
+// Tables are sorted by the low address of each range.
+func (table *GeoIPv4Table) Less(i, j int) bool { return entryLess(table.table[i], table.table[j]) }
+func (table *GeoIPv6Table) Less(i, j int) bool { return entryLess(table.table[i], table.table[j]) }
+
+func (table *GeoIPv4Table) Swap(i, j int) {
+	table.table[i], table.table[j] = table.table[j], table.table[i]
+}
+func (table *GeoIPv6Table) Swap(i, j int) {
+	table.table[i], table.table[j] = table.table[j], table.table[i]
+}
+
+func entryLess(a, b GeoIPEntry) bool {
+	return bytes.Compare(a.ipLow.To16(), b.ipLow.To16()) < 0
+}
+
 func (table *GeoIPv4Table) Lock() { (*table).lock.Lock() }
 func (table *GeoIPv6Table) Lock() { (*table).lock.Lock() }
 
@@ -108,14 +125,16 @@ func geoipStringToIP(ipStr string) (net.IP, error) {
 //to an address range and a two character country code
 func (table *GeoIPv4Table) parseEntry(candidate string) (*GeoIPEntry, error) {
 
-	if candidate[0] == '#' {
+	// Trailing whitespace includes the \r of CRLF line endings.
+	candidate = strings.TrimSpace(candidate)
+	if candidate == "" || candidate[0] == '#' {
 		return nil, nil
 	}
 
 	parsedCandidate := strings.Split(candidate, ",")
 
 	if len(parsedCandidate) != 3 {
-		return nil, fmt.Errorf("provided geoip file is incorrectly formatted. Could not parse line:\n%s", parsedCandidate)
+		return nil, fmt.Errorf("expected 3 comma-separated fields, got %d", len(parsedCandidate))
 	}
 
 	low, err := geoipStringToIP(parsedCandidate[0])
@@ -140,23 +159,25 @@ func (table *GeoIPv4Table) parseEntry(candidate string) (*GeoIPEntry, error) {
 //to an address range and a two character country code
 func (table *GeoIPv6Table) parseEntry(candidate string) (*GeoIPEntry, error) {
 
-	if candidate[0] == '#' {
+	// Trailing whitespace includes the \r of CRLF line endings.
+	candidate = strings.TrimSpace(candidate)
+	if candidate == "" || candidate[0] == '#' {
 		return nil, nil
 	}
 
 	parsedCandidate := strings.Split(candidate, ",")
 
 	if len(parsedCandidate) != 3 {
-		return nil, fmt.Errorf("")
+		return nil, fmt.Errorf("expected 3 comma-separated fields, got %d", len(parsedCandidate))
 	}
 
 	low := net.ParseIP(parsedCandidate[0])
 	if low == nil {
-		return nil, fmt.Errorf("")
+		return nil, fmt.Errorf("error parsing IP %s", parsedCandidate[0])
 	}
 	high := net.ParseIP(parsedCandidate[1])
 	if high == nil {
-		return nil, fmt.Errorf("")
+		return nil, fmt.Errorf("error parsing IP %s", parsedCandidate[1])
 	}
 
 	geoipEntry := &GeoIPEntry{
@@ -187,10 +208,13 @@ func GeoIPLoadFile(table GeoIPTable, pathname string) error {
 
 	//read in strings and call parse function
 	scanner := bufio.NewScanner(hashedFile)
+	lineNumber := 0
 	for scanner.Scan() {
+		lineNumber++
 		entry, err := table.parseEntry(scanner.Text())
 		if err != nil {
-			return fmt.Errorf("provided geoip file is incorrectly formatted. Line is: %+q", scanner.Text())
+			return fmt.Errorf("provided geoip file is incorrectly formatted. %s:%d: %v. Line is: %+q",
+				pathname, lineNumber, err, scanner.Text())
 		}
 
 		if entry != nil {
@@ -202,6 +226,10 @@ func GeoIPLoadFile(table GeoIPTable, pathname string) error {
 		return err
 	}
 
+	// GetCountryByAddr needs the table in order, which the file may not be.
+	sort.Sort(table)
+	checkGeoIPTable(table, pathname)
+
 	sha1Hash := hex.EncodeToString(hash.Sum(nil))
 	log.Println("Using geoip file ", pathname, " with checksum", sha1Hash)
 	log.Println("Loaded ", table.Len(), " entries into table")
@@ -209,10 +237,56 @@ func GeoIPLoadFile(table GeoIPTable, pathname string) error {
 	return nil
 }
 
+//Logs a warning for each range in a sorted table that is backwards or that
+//overlaps the range before it. Lookups of addresses in such ranges may return
+//either country.
+func checkGeoIPTable(table GeoIPTable, pathname string) {
+	for i := 0; i < table.Len(); i++ {
+		entry := table.ElementAt(i)
+		if bytes.Compare(entry.ipLow.To16(), entry.ipHigh.To16()) > 0 {
+			log.Printf("Warning: geoip file %s has a backwards range %v-%v (%s)",
+				pathname, entry.ipLow, entry.ipHigh, entry.country)
+			continue
+		}
+		if i == 0 {
+			continue
+		}
+		prev := table.ElementAt(i - 1)
+		if bytes.Compare(entry.ipLow.To16(), prev.ipHigh.To16()) <= 0 {
+			log.Printf("Warning: geoip file %s has overlapping ranges %v-%v (%s) and %v-%v (%s)",
+				pathname, prev.ipLow, prev.ipHigh, prev.country,
+				entry.ipLow, entry.ipHigh, entry.country)
+		}
+	}
+}
+
+//Loads a geoip file in the format above, or a MaxMind DB file if its name
+//ends in .mmdb
+func GeoIPLoad(table GeoIPTable, pathname string) error {
+	if strings.HasSuffix(strings.ToLower(pathname), ".mmdb") {
+		return GeoIPLoadMMDB(table, pathname)
+	}
+	return GeoIPLoadFile(table, pathname)
+}
+
 //Returns the country location of an IPv4 or IPv6 address, and a boolean value
 //that indicates whether the IP address was present in the geoip database
 func GetCountryByAddr(table GeoIPTable, ip net.IP) (string, bool) {
 
+	// a missing table contains no countries
+	switch t := table.(type) {
+	case nil:
+		return "", false
+	case *GeoIPv4Table:
+		if t == nil {
+			return "", false
+		}
+	case *GeoIPv6Table:
+		if t == nil {
+			return "", false
+		}
+	}
+
 	table.Lock()
 	defer table.Unlock()
 
@@ -15,12 +15,12 @@ import (
 	"time"
 )
 
-var (
-	once sync.Once
-)
-
 const metricsResolution = 60 * 60 * 24 * time.Second //86400 seconds
 
+// The default limit on distinct country codes counted in an interval. There
+// are about 250 real ones; more can only come from a bad geoip database.
+const defaultMaxCountryCodes = 300
+
 type CountryStats struct {
 	standalone map[string]bool
 	badge      map[string]bool
@@ -47,6 +47,20 @@ type Metrics struct {
 	clientRestrictedDeniedCount   uint
 	clientUnrestrictedDeniedCount uint
 	clientProxyMatchCount         uint
+	clientNATMismatchCount        uint
+
+	totals PromCounters
+
+	// Country codes beyond this many in an interval are counted as "??".
+	maxCountryCodes int
+
+	// Interval at which metrics are logged and reset
+	resolution time.Duration
+	stop       chan struct{}
+	stopOnce   sync.Once
+	// Closed when logMetrics has written its last report, if Start was
+	// called.
+	stopped chan struct{}
 
 	//synchronization for access to snowflake metrics
 	lock sync.Mutex
@@ -128,6 +142,9 @@ func (m *Metrics) UpdateCountryStats(addr string, proxyType string, natType stri
 	if !ok {
 		country = "??"
 	}
+	if _, seen := m.countryStats.counts[country]; !seen && len(m.countryStats.counts) >= m.maxCountryCodes {
+		country = "??"
+	}
 
 	//update map of unique ips and counts
 	m.countryStats.counts[country]++
@@ -152,25 +169,31 @@ func (m *Metrics) UpdateCountryStats(addr string, proxyType string, natType stri
 
 }
 
+// Loads the geoip databases and replaces the tables used for country stats.
+// Both tables are loaded before either is replaced, so if there is an error
+// the tables already in use, if any, are kept. It is safe to call this while
+// the broker is running.
 func (m *Metrics) LoadGeoipDatabases(geoipDB string, geoip6DB string) error {
 
 	// Load geoip databases
 	log.Println("Loading geoip databases")
 	tablev4 := new(GeoIPv4Table)
-	err := GeoIPLoadFile(tablev4, geoipDB)
+	err := GeoIPLoad(tablev4, geoipDB)
 	if err != nil {
-		m.tablev4 = nil
 		return err
 	}
-	m.tablev4 = tablev4
 
 	tablev6 := new(GeoIPv6Table)
-	err = GeoIPLoadFile(tablev6, geoip6DB)
+	err = GeoIPLoad(tablev6, geoip6DB)
 	if err != nil {
-		m.tablev6 = nil
 		return err
 	}
+	log.Printf("Loaded %d IPv4 and %d IPv6 geoip entries", tablev4.Len(), tablev6.Len())
+
+	m.lock.Lock()
+	m.tablev4 = tablev4
 	m.tablev6 = tablev6
+	m.lock.Unlock()
 	return nil
 }
 
@@ -189,25 +212,68 @@ func NewMetrics(metricsLogger *log.Logger) (*Metrics, error) {
 	}
 
 	m.logger = metricsLogger
-
-	// Write to log file every hour with updated metrics
-	go once.Do(m.logMetrics)
+	m.resolution = metricsResolution
+	m.maxCountryCodes = defaultMaxCountryCodes
+	m.stop = make(chan struct{})
 
 	return m, nil
 }
 
-// Logs metrics in intervals specified by metricsResolution
-func (m *Metrics) logMetrics() {
-	heartbeat := time.Tick(metricsResolution)
-	for range heartbeat {
-		m.printMetrics()
-		m.zeroMetrics()
+// Starts writing metrics to the log file every resolution, after which they
+// are reset. It should be called at most once.
+func (m *Metrics) Start(resolution time.Duration) {
+	m.lock.Lock()
+	m.resolution = resolution
+	m.stopped = make(chan struct{})
+	m.lock.Unlock()
+	go m.logMetrics(resolution)
+}
+
+// Stops the periodic logging of metrics started by Start. The metrics counted
+// since the last report are logged one final time, as a report of the shorter
+// interval, before Stop returns.
+func (m *Metrics) Stop() {
+	m.stopOnce.Do(func() { close(m.stop) })
+	m.lock.Lock()
+	stopped := m.stopped
+	m.lock.Unlock()
+	if stopped != nil {
+		<-stopped
+	}
+}
+
+func (m *Metrics) logMetrics(resolution time.Duration) {
+	defer close(m.stopped)
+	heartbeat := time.NewTicker(resolution)
+	defer heartbeat.Stop()
+	intervalStart := time.Now()
+	for {
+		select {
+		case <-heartbeat.C:
+			m.printMetrics()
+			m.lock.Lock()
+			m.zeroMetrics()
+			m.lock.Unlock()
+			intervalStart = time.Now()
+		case <-m.stop:
+			m.lock.Lock()
+			m.printMetricsLocked(time.Since(intervalStart))
+			m.lock.Unlock()
+			return
+		}
 	}
 }
 
 func (m *Metrics) printMetrics() {
 	m.lock.Lock()
-	m.logger.Println("snowflake-stats-end", time.Now().UTC().Format("2006-01-02 15:04:05"), fmt.Sprintf("(%d s)", int(metricsResolution.Seconds())))
+	m.printMetricsLocked(m.resolution)
+	m.lock.Unlock()
+}
+
+// Writes the metrics as a report of an interval of the given length. m.lock
+// must be held.
+func (m *Metrics) printMetricsLocked(interval time.Duration) {
+	m.logger.Println("snowflake-stats-end", time.Now().UTC().Format("2006-01-02 15:04:05"), fmt.Sprintf("(%d s)", int(interval.Seconds())))
 	m.logger.Println("snowflake-ips", m.countryStats.Display())
 	m.logger.Println("snowflake-ips-total", len(m.countryStats.standalone)+
 		len(m.countryStats.badge)+len(m.countryStats.webext)+len(m.countryStats.unknown))
@@ -222,7 +288,7 @@ func (m *Metrics) printMetrics() {
 	m.logger.Println("snowflake-ips-nat-restricted", len(m.countryStats.natRestricted))
 	m.logger.Println("snowflake-ips-nat-unrestricted", len(m.countryStats.natUnrestricted))
 	m.logger.Println("snowflake-ips-nat-unknown", len(m.countryStats.natUnknown))
-	m.lock.Unlock()
+	m.logger.Println("client-nat-mismatch-count", binCount(m.clientNATMismatchCount))
 }
 
 // Restores all metrics to original values
@@ -232,6 +298,7 @@ func (m *Metrics) zeroMetrics() {
 	m.clientRestrictedDeniedCount = 0
 	m.clientUnrestrictedDeniedCount = 0
 	m.clientProxyMatchCount = 0
+	m.clientNATMismatchCount = 0
 	m.countryStats.counts = make(map[string]int)
 	m.countryStats.standalone = make(map[string]bool)
 	m.countryStats.badge = make(map[string]bool)
@@ -0,0 +1,137 @@
+/*
+This code loads MaxMind DB (.mmdb) files, such as the GeoLite2 Country
+database, into the same tables as the tor geoip format, so that lookups don't
+depend on which format was loaded.
+
+Every network in the database is converted, at load time, into an address
+range with the country code of its record.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// The fields of a GeoIP2 or GeoLite2 record that are used.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// Returns the country code of a record, preferring the country where the
+// address is located over the one where it is registered.
+func (record *mmdbRecord) country() string {
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+	return record.RegisteredCountry.ISOCode
+}
+
+// Loads the IPv4 or IPv6 networks of a MaxMind DB file into a table, depending
+// on the kind of table.
+func GeoIPLoadMMDB(table GeoIPTable, pathname string) error {
+	buf, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		return err
+	}
+	r, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return fmt.Errorf("%s: %v", pathname, err)
+	}
+
+	// IPv4 networks are returned as 4-byte addresses, and are looked up in
+	// the IPv4 table.
+	var ipLen int
+	switch table.(type) {
+	case *GeoIPv4Table:
+		ipLen = net.IPv4len
+	case *GeoIPv6Table:
+		if r.Metadata.IPVersion == 4 {
+			return fmt.Errorf("%s: no IPv6 networks in database", pathname)
+		}
+		ipLen = net.IPv6len
+	default:
+		return fmt.Errorf("unknown geoip table type")
+	}
+
+	table.Lock()
+	defer table.Unlock()
+
+	var last *GeoIPEntry
+	found := false
+	networks := r.Networks(maxminddb.SkipAliasedNetworks)
+	for networks.Next() {
+		var record mmdbRecord
+		network, err := networks.Network(&record)
+		if err != nil {
+			return fmt.Errorf("%s: %v", pathname, err)
+		}
+		if len(network.IP) != ipLen {
+			continue
+		}
+		found = true
+		country := record.country()
+		if country == "" {
+			continue
+		}
+		low := network.IP.To16()
+		high := make(net.IP, len(network.IP))
+		for i := range high {
+			high[i] = network.IP[i] | ^network.Mask[i]
+		}
+		high = high.To16()
+		// Merge adjacent networks in the same country.
+		if last != nil && last.country == country && bytes.Equal(nextIP(last.ipHigh), low) {
+			last.ipHigh = high
+			continue
+		}
+		if last != nil {
+			table.Append(*last)
+		}
+		last = &GeoIPEntry{
+			ipLow:   low,
+			ipHigh:  high,
+			country: country,
+		}
+	}
+	if err := networks.Err(); err != nil {
+		return fmt.Errorf("%s: %v", pathname, err)
+	}
+	if !found && ipLen == net.IPv4len {
+		return fmt.Errorf("%s: no IPv4 networks in database", pathname)
+	}
+	if last != nil {
+		table.Append(*last)
+	}
+
+	sha1Hash := sha1.Sum(buf)
+	log.Println("Using geoip file ", pathname, " with checksum", hex.EncodeToString(sha1Hash[:]))
+	log.Println("Loaded ", table.Len(), " entries into table")
+
+	return nil
+}
+
+// Returns the address after ip, in 16-byte form.
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP(nil), ip.To16()...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
@@ -0,0 +1,180 @@
+/*
+Broker health metrics in the Prometheus text exposition format:
+https://prometheus.io/docs/instrumenting/exposition_formats/
+
+These are served on a separate listener, enabled with the -metrics-addr
+option, and are independent of the daily metrics described in
+doc/broker-spec.txt.
+
+With the -metrics-exemplars option, metrics are instead served in the
+OpenMetrics format, with exemplars that tie samples of client match latency to
+the ID of the matched proxy (a hash of its session ID), which the broker then
+also logs:
+https://github.com/OpenObservability/OpenMetrics/blob/main/specification/OpenMetrics.md
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Upper bounds, in seconds, of the buckets of the client match latency
+// histogram.
+var matchLatencyBuckets = [...]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// A sample that is an example of the observations in a histogram bucket.
+type exemplar struct {
+	traceID string
+	value   float64
+	time    time.Time
+}
+
+// A Prometheus histogram of client match latency. It is made of arrays, not
+// slices, so that copying it makes a snapshot.
+type latencyHistogram struct {
+	// Observations in each bucket, and above the last one. Not cumulative.
+	counts [len(matchLatencyBuckets) + 1]uint64
+	sum    float64
+	// The most recent observation in each bucket.
+	exemplars [len(matchLatencyBuckets) + 1]exemplar
+}
+
+func (h *latencyHistogram) observe(latency time.Duration, traceID string, now time.Time) {
+	value := latency.Seconds()
+	i := 0
+	for i < len(matchLatencyBuckets) && value > matchLatencyBuckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += value
+	h.exemplars[i] = exemplar{traceID: traceID, value: value, time: now}
+}
+
+// Running totals for Prometheus. Unlike the rest of Metrics, these are never
+// zeroed. Accesses are synchronized by Metrics.lock.
+type PromCounters struct {
+	clientOffers   uint64
+	clientMatches  uint64
+	clientDenied   uint64
+	clientTimeouts uint64
+	// Clients given a snowflake that may not be compatible with their NAT
+	clientNATMismatches uint64
+	proxyPolls          uint64
+	proxyPollsRejected  uint64
+	proxyAnswers        uint64
+	proxyAnswerErrors   uint64
+
+	matchLatency latencyHistogram
+}
+
+// Writes metrics in either the Prometheus text format or OpenMetrics.
+type metricsWriter struct {
+	w           io.Writer
+	openMetrics bool
+}
+
+func (m metricsWriter) header(name string, metricType string, help string) {
+	// OpenMetrics names a counter without its _total suffix.
+	if m.openMetrics && metricType == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(m.w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(m.w, "# TYPE %s %s\n", name, metricType)
+}
+
+func (m metricsWriter) metric(name string, metricType string, help string, value interface{}) {
+	m.header(name, metricType, help)
+	fmt.Fprintf(m.w, "%s %v\n", name, value)
+}
+
+func (m metricsWriter) histogram(name string, help string, h *latencyHistogram) {
+	m.header(name, "histogram", help)
+	var count uint64
+	for i, n := range h.counts {
+		count += n
+		le := "+Inf"
+		if i < len(matchLatencyBuckets) {
+			le = fmt.Sprint(matchLatencyBuckets[i])
+		}
+		fmt.Fprintf(m.w, "%s_bucket{le=\"%s\"} %d", name, le, count)
+		if e := h.exemplars[i]; m.openMetrics && e.traceID != "" {
+			fmt.Fprintf(m.w, " # {trace_id=\"%s\"} %v %.3f", e.traceID, e.value,
+				float64(e.time.UnixNano())/float64(time.Second))
+		}
+		fmt.Fprintf(m.w, "\n")
+	}
+	fmt.Fprintf(m.w, "%s_sum %v\n", name, h.sum)
+	fmt.Fprintf(m.w, "%s_count %d\n", name, count)
+}
+
+func prometheusHandler(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {
+	ctx.snowflakeLock.Lock()
+	unrestricted := ctx.snowflakes.Len()
+	restricted := ctx.restrictedSnowflakes.Len()
+	ctx.snowflakeLock.Unlock()
+
+	ctx.metrics.lock.Lock()
+	totals := ctx.metrics.totals
+	roundtrip := int64(ctx.metrics.clientRoundtripEstimate)
+	ctx.metrics.lock.Unlock()
+
+	m := metricsWriter{w: w, openMetrics: ctx.metricsExemplars}
+	if m.openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	m.metric("snowflake_broker_client_offers_total", "counter",
+		"Client offers received.", totals.clientOffers)
+	m.metric("snowflake_broker_client_matches_total", "counter",
+		"Client offers answered by a proxy.", totals.clientMatches)
+	m.metric("snowflake_broker_client_denied_total", "counter",
+		"Client offers rejected because no proxy was available.", totals.clientDenied)
+	m.metric("snowflake_broker_client_timeouts_total", "counter",
+		"Client offers whose proxy did not answer in time.", totals.clientTimeouts)
+	m.metric("snowflake_broker_client_nat_mismatches_total", "counter",
+		"Client offers passed to a restricted proxy for lack of an unrestricted one.", totals.clientNATMismatches)
+	m.metric("snowflake_broker_proxy_polls_total", "counter",
+		"Polls received from proxies.", totals.proxyPolls)
+	m.metric("snowflake_broker_proxy_polls_rejected_total", "counter",
+		"Proxy polls rejected because too many were waiting to be matched.", totals.proxyPollsRejected)
+	m.metric("snowflake_broker_proxy_answers_total", "counter",
+		"Proxy answers relayed to clients.", totals.proxyAnswers)
+	m.metric("snowflake_broker_proxy_answer_errors_total", "counter",
+		"Proxies that told their client they could not answer.", totals.proxyAnswerErrors)
+
+	m.header("snowflake_broker_snowflakes_available", "gauge",
+		"Proxies currently waiting for a client.")
+	fmt.Fprintf(w, "snowflake_broker_snowflakes_available{nat=\"%s\"} %d\n", NATUnrestricted, unrestricted)
+	fmt.Fprintf(w, "snowflake_broker_snowflakes_available{nat=\"%s\"} %d\n", NATRestricted, restricted)
+
+	m.metric("snowflake_broker_client_roundtrip_estimate_milliseconds", "gauge",
+		"Time taken to answer the most recently matched client offer.", roundtrip)
+	m.histogram("snowflake_broker_client_match_latency_seconds",
+		"Time taken to answer matched client offers.", &totals.matchLatency)
+
+	if m.openMetrics {
+		fmt.Fprintf(w, "# EOF\n")
+	}
+}
+
+// Serves Prometheus metrics at /metrics on a listener separate from the
+// broker's public one. The returned server is for shutting it down.
+func servePrometheus(ctx *BrokerContext, addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", SnowflakeHandler{ctx, prometheusHandler})
+	server := &http.Server{Addr: addr, Handler: mux}
+	log.Printf("Serving Prometheus metrics on %s", addr)
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return server
+}
@@ -0,0 +1,101 @@
+/*
+Per-IP rate limiting of requests to the broker, so that a single host can't
+flood it with proxy polls or client offers. Each IP address has a token bucket
+that refills at a constant rate up to a maximum burst, and every request takes
+one token.
+*/
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// How often to forget IP addresses whose buckets have refilled.
+const rateLimitPruneInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type RateLimiter struct {
+	rate           float64 // tokens per second
+	burst          float64
+	exemptLoopback bool
+
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	lock      sync.Mutex
+}
+
+// Allows rate requests per second from each IP address, with bursts of up to
+// burst requests. If exemptLoopback is set, requests from loopback addresses
+// are never limited.
+func NewRateLimiter(rate float64, burst int, exemptLoopback bool) *RateLimiter {
+	return &RateLimiter{
+		rate:           rate,
+		burst:          float64(burst),
+		exemptLoopback: exemptLoopback,
+		buckets:        make(map[string]*tokenBucket),
+		lastPrune:      time.Now(),
+	}
+}
+
+// Reports whether a request from ip may go ahead, taking a token if so.
+func (l *RateLimiter) Allow(ip string) bool {
+	return l.allowAt(ip, time.Now())
+}
+
+func (l *RateLimiter) allowAt(ip string, now time.Time) bool {
+	// Requests whose address is unknown can't be told apart.
+	if ip == "" {
+		return true
+	}
+	if l.exemptLoopback {
+		if parsed := net.ParseIP(ip); parsed != nil && parsed.IsLoopback() {
+			return true
+		}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastPrune) > rateLimitPruneInterval {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Returns the number of tokens in a bucket at time now.
+func (l *RateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+// Forgets full buckets, which are the same as new ones.
+func (l *RateLimiter) prune(now time.Time) {
+	for ip, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+	l.lastPrune = now
+}
@@ -3,15 +3,27 @@ package main
 import (
 	"bytes"
 	"container/heap"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"git.torproject.org/pluggable-transports/snowflake.git/common/amp"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/messages"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/safelog"
+	"github.com/gorilla/websocket"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -21,10 +33,28 @@ func NullLogger() *log.Logger {
 	return logger
 }
 
+// A minimal offer and answer that pass the broker's validation.
+const (
+	sampleOffer  = `{"type":"offer","sdp":"v=0\r\n"}`
+	sampleAnswer = `{"type":"answer","sdp":"v=0\r\n"}`
+)
+
+// Returns the body of a proxy's answer request with sampleAnswer.
+func answerRequest(sid string) []byte {
+	b, err := messages.EncodeAnswerRequest(sampleAnswer, sid)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
 func TestBroker(t *testing.T) {
 
 	Convey("Context", t, func() {
 		ctx := NewBrokerContext(NullLogger())
+		// Reject offers at once when no proxy is available, unless a
+		// test is about the queue.
+		ctx.clientOfferQueueSize = 0
 
 		Convey("Adds Snowflake", func() {
 			So(ctx.snowflakes.Len(), ShouldEqual, 0)
@@ -36,6 +66,7 @@ func TestBroker(t *testing.T) {
 
 		Convey("Broker goroutine matches clients with proxies", func() {
 			p := new(ProxyPoll)
+			p.ctx = context.Background()
 			p.id = "test"
 			p.natType = "unrestricted"
 			p.offerChannel = make(chan *ClientOffer)
@@ -53,21 +84,110 @@ func TestBroker(t *testing.T) {
 			So(ctx.snowflakes.Len(), ShouldEqual, 0)
 		})
 
+		Convey("Broker goroutine keeps a proxy matched just before its timeout", func() {
+			ctx.proxyTimeout = 100 * time.Millisecond
+			p := new(ProxyPoll)
+			p.ctx = context.Background()
+			p.id = "test"
+			p.natType = NATUnrestricted
+			p.offerChannel = make(chan *ClientOffer)
+			go func(ctx *BrokerContext) {
+				ctx.proxyPolls <- p
+				close(ctx.proxyPolls)
+			}(ctx)
+			ctx.Broker()
+			// Pop the snowflake as clientOffers would, but only pass
+			// the offer along after the proxy's poll has timed out.
+			ctx.snowflakeLock.Lock()
+			snowflake := heap.Pop(ctx.snowflakes).(*Snowflake)
+			ctx.snowflakeLock.Unlock()
+			<-time.After(2 * ctx.proxyTimeout)
+			sent := false
+			select {
+			case snowflake.offerChannel <- &ClientOffer{sdp: []byte("test offer")}:
+				sent = true
+			case <-time.After(time.Second):
+			}
+			So(sent, ShouldBeTrue)
+			offer := <-p.offerChannel
+			So(offer, ShouldNotBeNil)
+			So(offer.sdp, ShouldResemble, []byte("test offer"))
+			So(ctx.idToSnowflake["test"], ShouldNotBeNil)
+		})
+
+		Convey("Broker goroutine times out proxy polls after the configured timeout", func() {
+			ctx.proxyTimeout = 100 * time.Millisecond
+			p := new(ProxyPoll)
+			p.ctx = context.Background()
+			p.id = "test"
+			p.natType = NATUnrestricted
+			p.offerChannel = make(chan *ClientOffer)
+			go func(ctx *BrokerContext) {
+				ctx.proxyPolls <- p
+				close(ctx.proxyPolls)
+			}(ctx)
+			ctx.Broker()
+			var offer *ClientOffer
+			timedOut := false
+			select {
+			case offer = <-p.offerChannel:
+			case <-time.After(time.Second * ProxyTimeout / 2):
+				timedOut = true
+			}
+			So(timedOut, ShouldBeFalse)
+			So(offer, ShouldBeNil)
+			So(ctx.snowflakes.Len(), ShouldEqual, 0)
+		})
+
+		Convey("Broker goroutine drops proxy polls when the proxy goes away", func() {
+			reqCtx, cancel := context.WithCancel(context.Background())
+			p := new(ProxyPoll)
+			p.ctx = reqCtx
+			p.id = "test"
+			p.natType = NATUnrestricted
+			p.offerChannel = make(chan *ClientOffer)
+			go func(ctx *BrokerContext) {
+				ctx.proxyPolls <- p
+				close(ctx.proxyPolls)
+			}(ctx)
+			ctx.Broker()
+			ctx.snowflakeLock.Lock()
+			So(ctx.snowflakes.Len(), ShouldEqual, 1)
+			ctx.snowflakeLock.Unlock()
+			cancel()
+			var offer *ClientOffer
+			timedOut := false
+			select {
+			case offer = <-p.offerChannel:
+			case <-time.After(time.Second * ProxyTimeout / 2):
+				timedOut = true
+			}
+			So(timedOut, ShouldBeFalse)
+			So(offer, ShouldBeNil)
+			ctx.snowflakeLock.Lock()
+			So(ctx.snowflakes.Len(), ShouldEqual, 0)
+			So(ctx.idToSnowflake["test"], ShouldBeNil)
+			ctx.snowflakeLock.Unlock()
+		})
+
 		Convey("Request an offer from the Snowflake Heap", func() {
 			done := make(chan *ClientOffer)
+			errs := make(chan error, 1)
 			go func() {
-				offer := ctx.RequestOffer("test", "", NATUnrestricted)
+				offer, err := ctx.RequestOffer(context.Background(), "test", "", NATUnrestricted)
+				errs <- err
 				done <- offer
 			}()
 			request := <-ctx.proxyPolls
 			request.offerChannel <- &ClientOffer{sdp: []byte("test offer")}
 			offer := <-done
+			So(<-errs, ShouldBeNil)
 			So(offer.sdp, ShouldResemble, []byte("test offer"))
 		})
 
 		Convey("Responds to client offers...", func() {
 			w := httptest.NewRecorder()
-			data := bytes.NewReader([]byte("test"))
+			data := bytes.NewReader([]byte(sampleOffer))
 			r, err := http.NewRequest("POST", "snowflake.broker/client", data)
 			So(err, ShouldBeNil)
 
@@ -75,6 +195,26 @@ func TestBroker(t *testing.T) {
 				clientOffers(ctx, w, r)
 				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
 				So(w.Body.String(), ShouldEqual, "")
+				So(w.Header().Get("Retry-After"), ShouldEqual, strconv.Itoa(clientRetryAfterMax))
+			})
+
+			Convey("with a Retry-After that depends on the proxies waiting.", func() {
+				So(ctx.clientRetryAfter(), ShouldEqual, clientRetryAfterMax)
+				ctx.AddSnowflake("fake", "", NATUnrestricted)
+				So(ctx.clientRetryAfter(), ShouldEqual, clientRetryAfterMin)
+			})
+
+			Convey("with 400 if the offer is not an SDP offer.", func() {
+				ctx.AddSnowflake("fake", "", NATUnrestricted)
+				for _, offer := range []string{"test", sampleAnswer, `{"type":"offer","sdp":"junk"}`} {
+					w := httptest.NewRecorder()
+					r, err := http.NewRequest("POST", "snowflake.broker/client", bytes.NewReader([]byte(offer)))
+					So(err, ShouldBeNil)
+					clientOffers(ctx, w, r)
+					So(w.Code, ShouldEqual, http.StatusBadRequest)
+				}
+				// The proxy was not given any of them.
+				So(ctx.snowflakes.Len(), ShouldEqual, 1)
 			})
 
 			Convey("with a proxy answer if available.", func() {
@@ -86,11 +226,94 @@ func TestBroker(t *testing.T) {
 					done <- true
 				}()
 				offer := <-snowflake.offerChannel
-				So(offer.sdp, ShouldResemble, []byte("test"))
+				So(offer.sdp, ShouldResemble, []byte(sampleOffer))
 				snowflake.answerChannel <- []byte("fake answer")
 				<-done
 				So(w.Body.String(), ShouldEqual, "fake answer")
 				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Header().Get("Snowflake-NAT-Type"), ShouldEqual, NATUnrestricted)
+			})
+
+			Convey("with 503 at once if the proxy could not answer.", func() {
+				done := make(chan bool)
+				snowflake := ctx.AddSnowflake("fake", "", NATUnrestricted)
+				go func() {
+					clientOffers(ctx, w, r)
+					done <- true
+				}()
+				<-snowflake.offerChannel
+				snowflake.answerChannel <- []byte{}
+				<-done
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(w.Header().Get("Retry-After"), ShouldNotEqual, "")
+			})
+
+			Convey("with the NAT type of the proxy that answers.", func() {
+				done := make(chan bool)
+				snowflake := ctx.AddSnowflake("fake", "", NATRestricted)
+				go func() {
+					clientOffers(ctx, w, r)
+					done <- true
+				}()
+				<-snowflake.offerChannel
+				snowflake.answerChannel <- []byte("fake answer")
+				<-done
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Header().Get("Snowflake-NAT-Type"), ShouldEqual, NATRestricted)
+			})
+
+			Convey("with the client's nonce echoed.", func() {
+				r.Header.Set(messages.NonceHeader, "0123abcd")
+				done := make(chan bool)
+				snowflake := ctx.AddSnowflake("fake", "", NATUnrestricted)
+				go func() {
+					clientOffers(ctx, w, r)
+					done <- true
+				}()
+				<-snowflake.offerChannel
+				snowflake.answerChannel <- []byte("fake answer")
+				<-done
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Header().Get(messages.NonceHeader), ShouldEqual, "0123abcd")
+			})
+
+			Convey("with a proxy answer to an offer in a GET query, if allowed.", func() {
+				get, err := http.NewRequest("GET", "snowflake.broker/client?offer="+base64.RawURLEncoding.EncodeToString([]byte(sampleOffer)), nil)
+				So(err, ShouldBeNil)
+
+				clientOffers(ctx, w, get)
+				So(w.Code, ShouldEqual, http.StatusMethodNotAllowed)
+
+				ctx.allowGetOffers = true
+				w = httptest.NewRecorder()
+				done := make(chan bool)
+				snowflake := ctx.AddSnowflake("fake", "", NATUnrestricted)
+				go func() {
+					clientOffers(ctx, w, get)
+					done <- true
+				}()
+				offer := <-snowflake.offerChannel
+				So(offer.sdp, ShouldResemble, []byte(sampleOffer))
+				snowflake.answerChannel <- []byte("fake answer")
+				<-done
+				So(w.Body.String(), ShouldEqual, "fake answer")
+				So(w.Code, ShouldEqual, http.StatusOK)
+			})
+
+			Convey("with 400 for an invalid offer in a GET query.", func() {
+				ctx.allowGetOffers = true
+				for _, query := range []string{
+					"",
+					"?offer=",
+					"?offer=not+base64",
+					"?offer=" + strings.Repeat("A", base64.RawURLEncoding.EncodedLen(readLimit)+1),
+				} {
+					w := httptest.NewRecorder()
+					get, err := http.NewRequest("GET", "snowflake.broker/client"+query, nil)
+					So(err, ShouldBeNil)
+					clientOffers(ctx, w, get)
+					So(w.Code, ShouldEqual, http.StatusBadRequest)
+				}
 			})
 
 			Convey("Times out when no proxy responds.", func() {
@@ -105,9 +328,270 @@ func TestBroker(t *testing.T) {
 					done <- true
 				}()
 				offer := <-snowflake.offerChannel
-				So(offer.sdp, ShouldResemble, []byte("test"))
+				So(offer.sdp, ShouldResemble, []byte(sampleOffer))
 				<-done
 				So(w.Code, ShouldEqual, http.StatusGatewayTimeout)
+				So(w.Header().Get("Retry-After"), ShouldEqual, strconv.Itoa(clientRetryAfterMax))
+			})
+
+			Convey("waiting in a queue for a proxy to poll.", func() {
+				ctx.clientOfferQueueSize = 1
+				done := make(chan bool)
+				go func() {
+					clientOffers(ctx, w, r)
+					done <- true
+				}()
+				waiting := func() int {
+					ctx.snowflakeLock.Lock()
+					defer ctx.snowflakeLock.Unlock()
+					return len(ctx.waitingOffers)
+				}
+				for waiting() == 0 {
+					time.Sleep(10 * time.Millisecond)
+				}
+				snowflake := ctx.AddSnowflake("fake", "", NATUnrestricted)
+				So(snowflake.index, ShouldEqual, -1)
+				So(ctx.snowflakes.Len(), ShouldEqual, 0)
+				offer := <-snowflake.offerChannel
+				So(offer.sdp, ShouldResemble, []byte(sampleOffer))
+				snowflake.answerChannel <- []byte(sampleAnswer)
+				<-done
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Body.String(), ShouldEqual, sampleAnswer)
+				So(waiting(), ShouldEqual, 0)
+			})
+
+			Convey("with 503 when the offer queue is full.", func() {
+				ctx.clientOfferQueueSize = 1
+				ctx.waitingOffers = []*offerWaiter{{natType: NATUnknown, snowflake: make(chan *Snowflake, 1)}}
+				clientOffers(ctx, w, r)
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(len(ctx.waitingOffers), ShouldEqual, 1)
+			})
+
+			Convey("with 503 when no proxy polls in time.", func() {
+				ctx.clientOfferQueueSize = 1
+				ctx.clientTimeout = 100 * time.Millisecond
+				clientOffers(ctx, w, r)
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(len(ctx.waitingOffers), ShouldEqual, 0)
+			})
+
+			Convey("preferring a queued offer that is compatible with the proxy.", func() {
+				restricted := &offerWaiter{natType: NATRestricted, snowflake: make(chan *Snowflake, 1)}
+				unrestricted := &offerWaiter{natType: NATUnrestricted, snowflake: make(chan *Snowflake, 1)}
+				ctx.waitingOffers = []*offerWaiter{restricted, unrestricted}
+				snowflake := ctx.AddSnowflake("restricted", "", NATRestricted)
+				So(snowflake.index, ShouldEqual, -1)
+				So(<-unrestricted.snowflake, ShouldEqual, snowflake)
+				So(ctx.waitingOffers, ShouldResemble, []*offerWaiter{restricted})
+			})
+
+			Convey("giving an incompatible proxy to a queued offer rather than none.", func() {
+				ctx.clientOfferQueueSize = 1
+				done := make(chan bool)
+				go func() {
+					clientOffers(ctx, w, r)
+					done <- true
+				}()
+				waiting := func() int {
+					ctx.snowflakeLock.Lock()
+					defer ctx.snowflakeLock.Unlock()
+					return len(ctx.waitingOffers)
+				}
+				for waiting() == 0 {
+					time.Sleep(10 * time.Millisecond)
+				}
+				snowflake := ctx.AddSnowflake("restricted", "", NATRestricted)
+				So(snowflake.index, ShouldEqual, -1)
+				So(ctx.restrictedSnowflakes.Len(), ShouldEqual, 0)
+				<-snowflake.offerChannel
+				snowflake.answerChannel <- []byte(sampleAnswer)
+				<-done
+				So(w.Code, ShouldEqual, http.StatusOK)
+				ctx.metrics.lock.Lock()
+				So(ctx.metrics.clientNATMismatchCount, ShouldEqual, 1)
+				ctx.metrics.lock.Unlock()
+			})
+
+			Convey("giving back a proxy matched just as the offer's time ran out.", func() {
+				matchCtx, cancel := context.WithCancel(context.Background())
+				cancel()
+				waiter := &offerWaiter{natType: NATUnknown, snowflake: make(chan *Snowflake, 1)}
+				ctx.waitingOffers = []*offerWaiter{waiter}
+				snowflake := ctx.AddSnowflake("late", "", NATUnrestricted)
+				So(snowflake.index, ShouldEqual, -1)
+				So(ctx.waitForSnowflake(matchCtx, waiter), ShouldBeNil)
+				So(ctx.snowflakes.Len(), ShouldEqual, 1)
+				So(snowflake.index, ShouldEqual, 0)
+
+				// Unless its poll has ended too, which then gets no offer.
+				waiter = &offerWaiter{natType: NATUnknown, snowflake: make(chan *Snowflake, 1)}
+				ctx.waitingOffers = []*offerWaiter{waiter}
+				snowflake = ctx.AddSnowflake("later", "", NATRestricted)
+				snowflake.pollEnded = true
+				offers := make(chan *ClientOffer)
+				go func() {
+					offers <- <-snowflake.offerChannel
+				}()
+				So(ctx.waitForSnowflake(matchCtx, waiter), ShouldBeNil)
+				So(<-offers, ShouldBeNil)
+				So(ctx.restrictedSnowflakes.Len(), ShouldEqual, 0)
+				So(ctx.idToSnowflake["later"], ShouldBeNil)
+			})
+
+			Convey("Times out after the configured timeout.", func() {
+				ctx.clientTimeout = 100 * time.Millisecond
+				done := make(chan bool)
+				snowflake := ctx.AddSnowflake("fake", "", NATUnrestricted)
+				go func() {
+					clientOffers(ctx, w, r)
+					done <- true
+				}()
+				<-snowflake.offerChannel
+				select {
+				case <-done:
+				case <-time.After(time.Second * ClientTimeout / 2):
+				}
+				So(w.Code, ShouldEqual, http.StatusGatewayTimeout)
+			})
+
+			Convey("Stops waiting when the client goes away.", func() {
+				reqCtx, cancel := context.WithCancel(r.Context())
+				r = r.WithContext(reqCtx)
+				done := make(chan bool)
+				snowflake := ctx.AddSnowflake("fake", "", NATUnrestricted)
+				go func() {
+					clientOffers(ctx, w, r)
+					done <- true
+				}()
+				<-snowflake.offerChannel
+				cancel()
+				select {
+				case <-done:
+				case <-time.After(time.Second * ClientTimeout / 2):
+				}
+				So(w.Code, ShouldEqual, http.StatusGatewayTimeout)
+				So(ctx.answeredSnowflake("fake"), ShouldBeNil)
+			})
+		})
+
+		Convey("Responds to status requests...", func() {
+			status := func() (int, int) {
+				w := httptest.NewRecorder()
+				r, err := http.NewRequest("GET", "snowflake.broker/status", nil)
+				So(err, ShouldBeNil)
+				clientStatus(ctx, w, r)
+				So(w.Code, ShouldEqual, http.StatusOK)
+				proxies, wait, err := messages.DecodeClientStatusResponse(w.Body.Bytes())
+				So(err, ShouldBeNil)
+				return proxies, wait
+			}
+
+			Convey("with the proxies available and the wait.", func() {
+				proxies, wait := status()
+				So(proxies, ShouldEqual, 0)
+				So(wait, ShouldEqual, clientRetryAfterMax)
+
+				// The response is reused for a while.
+				ctx.AddSnowflake("fake", "", NATUnrestricted)
+				ctx.AddSnowflake("fake2", "", NATRestricted)
+				proxies, _ = status()
+				So(proxies, ShouldEqual, 0)
+
+				ctx.statusTime = ctx.statusTime.Add(-statusCacheDuration)
+				proxies, wait = status()
+				So(proxies, ShouldEqual, 2)
+				So(wait, ShouldEqual, 0)
+			})
+
+			Convey("only to GET.", func() {
+				w := httptest.NewRecorder()
+				r, err := http.NewRequest("POST", "snowflake.broker/status", bytes.NewReader([]byte("test")))
+				So(err, ShouldBeNil)
+				clientStatus(ctx, w, r)
+				So(w.Code, ShouldEqual, http.StatusMethodNotAllowed)
+			})
+		})
+
+		Convey("Responds to client offers through an AMP cache...", func() {
+			offerPath := "/amp/client/" + NATRestricted + "/" +
+				base64.RawURLEncoding.EncodeToString([]byte(sampleOffer))
+			decode := func(w *httptest.ResponseRecorder) (string, string, string) {
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Header().Get("Content-Type"), ShouldEqual, "text/html")
+				body, err := amp.Dearmor(w.Body, readLimit)
+				So(err, ShouldBeNil)
+				answer, natType, _, errorMessage, err := messages.DecodeAMPClientResponse(body)
+				So(err, ShouldBeNil)
+				return answer, natType, errorMessage
+			}
+
+			Convey("with a proxy answer if available.", func() {
+				w := httptest.NewRecorder()
+				r, err := http.NewRequest("GET", offerPath, nil)
+				So(err, ShouldBeNil)
+				done := make(chan bool)
+				snowflake := ctx.AddSnowflake("fake", "", NATUnrestricted)
+				go func() {
+					ampClientOffers(ctx, w, r)
+					done <- true
+				}()
+				offer := <-snowflake.offerChannel
+				So(offer.sdp, ShouldResemble, []byte(sampleOffer))
+				So(offer.natType, ShouldEqual, NATRestricted)
+				snowflake.answerChannel <- []byte("fake answer")
+				<-done
+				answer, natType, errorMessage := decode(w)
+				So(errorMessage, ShouldEqual, "")
+				So(answer, ShouldEqual, "fake answer")
+				So(natType, ShouldEqual, NATUnrestricted)
+			})
+
+			Convey("with the client's nonce echoed.", func() {
+				w := httptest.NewRecorder()
+				r, err := http.NewRequest("GET", offerPath+"?nonce=0123abcd", nil)
+				So(err, ShouldBeNil)
+				done := make(chan bool)
+				snowflake := ctx.AddSnowflake("fake", "", NATUnrestricted)
+				go func() {
+					ampClientOffers(ctx, w, r)
+					done <- true
+				}()
+				<-snowflake.offerChannel
+				snowflake.answerChannel <- []byte("fake answer")
+				<-done
+				body, err := amp.Dearmor(w.Body, readLimit)
+				So(err, ShouldBeNil)
+				answer, _, nonce, errorMessage, err := messages.DecodeAMPClientResponse(body)
+				So(err, ShouldBeNil)
+				So(errorMessage, ShouldEqual, "")
+				So(answer, ShouldEqual, "fake answer")
+				So(nonce, ShouldEqual, "0123abcd")
+			})
+
+			Convey("with an error in a 200 response when no snowflakes are available.", func() {
+				w := httptest.NewRecorder()
+				r, err := http.NewRequest("GET", offerPath, nil)
+				So(err, ShouldBeNil)
+				ampClientOffers(ctx, w, r)
+				_, _, errorMessage := decode(w)
+				So(errorMessage, ShouldEqual, messages.AMPErrorNoProxies)
+			})
+
+			Convey("with an error in a 200 response for an invalid offer.", func() {
+				for _, path := range []string{
+					"/amp/client/",
+					"/amp/client/unknown",
+					"/amp/client/unknown/not+base64",
+				} {
+					w := httptest.NewRecorder()
+					r, err := http.NewRequest("GET", path, nil)
+					So(err, ShouldBeNil)
+					ampClientOffers(ctx, w, r)
+					_, _, errorMessage := decode(w)
+					So(errorMessage, ShouldEqual, messages.AMPErrorBadOffer)
+				}
 			})
 		})
 
@@ -129,7 +613,7 @@ func TestBroker(t *testing.T) {
 				p.offerChannel <- &ClientOffer{sdp: []byte("fake offer")}
 				<-done
 				So(w.Code, ShouldEqual, http.StatusOK)
-				So(w.Body.String(), ShouldEqual, `{"Status":"client match","Offer":"fake offer","NAT":""}`)
+				So(w.Body.String(), ShouldEqual, `{"Status":"client match","Offer":"fake offer","NAT":"","Version":"1.0"}`)
 			})
 
 			Convey("return empty 200 OK when no client offer is available.", func() {
@@ -142,15 +626,135 @@ func TestBroker(t *testing.T) {
 				// nil means timeout
 				p.offerChannel <- nil
 				<-done
-				So(w.Body.String(), ShouldEqual, `{"Status":"no match","Offer":"","NAT":""}`)
+				So(w.Body.String(), ShouldEqual, `{"Status":"no match","Offer":"","NAT":"","Version":"1.0"}`)
 				So(w.Code, ShouldEqual, http.StatusOK)
 			})
 		})
 
+		Convey("Sheds a flood of proxy polls", func() {
+			// Nothing takes polls off the queue, as if the matcher
+			// couldn't keep up.
+			const queueSize = 4
+			const flood = 200
+			ctx.proxyPolls = make(chan *ProxyPoll, queueSize)
+			before := runtime.NumGoroutine()
+
+			codes := make(chan int, flood)
+			for i := 0; i < flood; i++ {
+				go func() {
+					w := httptest.NewRecorder()
+					r, err := http.NewRequest("POST", "snowflake.broker/proxy",
+						bytes.NewReader([]byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.0"}`)))
+					if err != nil {
+						panic(err)
+					}
+					proxyPolls(ctx, w, r)
+					if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+						panic("no Retry-After")
+					}
+					codes <- w.Code
+				}()
+			}
+			// Every poll beyond the queue is rejected at once, so its
+			// handler doesn't linger.
+			for i := 0; i < flood-queueSize; i++ {
+				select {
+				case code := <-codes:
+					So(code, ShouldEqual, http.StatusServiceUnavailable)
+				case <-time.After(5 * time.Second):
+					So("poll was not rejected", ShouldBeEmpty)
+				}
+			}
+			So(runtime.NumGoroutine()-before, ShouldBeLessThanOrEqualTo, queueSize+1)
+			So(len(ctx.proxyPolls), ShouldEqual, queueSize)
+
+			ctx.metrics.lock.Lock()
+			So(ctx.metrics.totals.proxyPollsRejected, ShouldEqual, flood-queueSize)
+			ctx.metrics.lock.Unlock()
+
+			// The queued polls are answered normally.
+			for i := 0; i < queueSize; i++ {
+				p := <-ctx.proxyPolls
+				p.offerChannel <- nil
+				So(<-codes, ShouldEqual, http.StatusOK)
+			}
+		})
+
+		Convey("Serves its state as JSON", func() {
+			ctx.AddSnowflake("secret1", "standalone", NATRestricted)
+			ctx.AddSnowflake("secret2", "webext", NATUnrestricted)
+			ctx.metrics.lock.Lock()
+			ctx.metrics.totals.matchLatency.observe(100*time.Millisecond, "x", time.Now())
+			ctx.metrics.totals.matchLatency.observe(300*time.Millisecond, "y", time.Now())
+			ctx.metrics.lock.Unlock()
+
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("GET", "snowflake.broker/debug.json", nil)
+			So(err, ShouldBeNil)
+			debugJSONHandler(ctx, w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+			So(w.Body.String(), ShouldNotContainSubstring, "secret")
+
+			var state debugState
+			So(json.Unmarshal(w.Body.Bytes(), &state), ShouldBeNil)
+			So(state.SnowflakesAvailable, ShouldEqual, 2)
+			So(state.RoundtripAvgMs, ShouldEqual, 200)
+			So(state.Snowflakes, ShouldResemble, []debugSnowflake{
+				{ID: debugSnowflakeID("secret1"), Index: 0, Clients: 0, ProxyType: "standalone", NATType: NATRestricted},
+				{ID: debugSnowflakeID("secret2"), Index: 0, Clients: 0, ProxyType: "webext", NATType: NATUnrestricted},
+			})
+			So(state.Snowflakes[0].ID, ShouldNotEqual, state.Snowflakes[1].ID)
+		})
+
+		Convey("Serves proxy polls and answers over WebSocket", func() {
+			server := httptest.NewServer(SnowflakeHandler{ctx, proxyWebSocket})
+			defer server.Close()
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			So(err, ShouldBeNil)
+			defer conn.Close()
+
+			// Poll and receive a client offer.
+			err = conn.WriteMessage(websocket.TextMessage, []byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.0"}`))
+			So(err, ShouldBeNil)
+			p := <-ctx.proxyPolls
+			So(p.id, ShouldEqual, "ymbcCMto7KHNGYlp")
+			p.offerChannel <- &ClientOffer{sdp: []byte("fake offer")}
+			_, b, err := conn.ReadMessage()
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"Status":"client match","Offer":"fake offer","NAT":"","Version":"1.0"}`)
+
+			// Answer over the same connection.
+			s := ctx.AddSnowflake("ymbcCMto7KHNGYlp", "", NATUnrestricted)
+			err = conn.WriteMessage(websocket.TextMessage, answerRequest("ymbcCMto7KHNGYlp"))
+			So(err, ShouldBeNil)
+			_, b, err = conn.ReadMessage()
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"Status":"success"}`)
+			answer := <-s.answerChannel
+			So(answer, ShouldResemble, []byte(sampleAnswer))
+
+			// A second answer, after the client has stopped waiting,
+			// doesn't hold up the connection.
+			close(s.clientDone)
+			err = conn.WriteMessage(websocket.TextMessage, answerRequest("ymbcCMto7KHNGYlp"))
+			So(err, ShouldBeNil)
+			_, b, err = conn.ReadMessage()
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"Status":"success"}`)
+
+			// An unrecognized proxy gets a client gone status.
+			err = conn.WriteMessage(websocket.TextMessage, answerRequest("invalid"))
+			So(err, ShouldBeNil)
+			_, b, err = conn.ReadMessage()
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"Status":"client gone"}`)
+		})
+
 		Convey("Responds to proxy answers...", func() {
 			s := ctx.AddSnowflake("test", "", NATUnrestricted)
 			w := httptest.NewRecorder()
-			data := bytes.NewReader([]byte(`{"Version":"1.0","Sid":"test","Answer":"test"}`))
+			data := bytes.NewReader(answerRequest("test"))
 
 			Convey("by passing to the client if valid.", func() {
 				r, err := http.NewRequest("POST", "snowflake.broker/answer", data)
@@ -160,11 +764,32 @@ func TestBroker(t *testing.T) {
 				}(ctx)
 				answer := <-s.answerChannel
 				So(w.Code, ShouldEqual, http.StatusOK)
-				So(answer, ShouldResemble, []byte("test"))
+				So(answer, ShouldResemble, []byte(sampleAnswer))
+			})
+
+			Convey("by telling the client if the proxy could not answer.", func() {
+				b, err := messages.EncodeAnswerErrorRequest("no candidates", "test")
+				So(err, ShouldBeNil)
+				r, err := http.NewRequest("POST", "snowflake.broker/answer", bytes.NewReader(b))
+				So(err, ShouldBeNil)
+				go func(ctx *BrokerContext) {
+					proxyAnswers(ctx, w, r)
+				}(ctx)
+				answer := <-s.answerChannel
+				So(answer, ShouldBeEmpty)
+				So(w.Code, ShouldEqual, http.StatusOK)
+			})
+
+			Convey("without waiting if the client has stopped waiting.", func() {
+				close(s.clientDone)
+				r, err := http.NewRequest("POST", "snowflake.broker/answer", data)
+				So(err, ShouldBeNil)
+				proxyAnswers(ctx, w, r)
+				So(w.Code, ShouldEqual, http.StatusOK)
 			})
 
 			Convey("with client gone status if the proxy is not recognized", func() {
-				data = bytes.NewReader([]byte(`{"Version":"1.0","Sid":"invalid","Answer":"test"}`))
+				data = bytes.NewReader(answerRequest("invalid"))
 				r, err := http.NewRequest("POST", "snowflake.broker/answer", data)
 				So(err, ShouldBeNil)
 				proxyAnswers(ctx, w, r)
@@ -183,6 +808,24 @@ func TestBroker(t *testing.T) {
 				So(w.Code, ShouldEqual, http.StatusBadRequest)
 			})
 
+			Convey("with error if the answer is not an SDP answer", func() {
+				for _, answer := range []string{
+					"test",
+					sampleOffer,
+					`{"type":"answer","sdp":"junk"}`,
+					`{"type":1,"sdp":"v=0"}`,
+				} {
+					b, err := messages.EncodeAnswerRequest(answer, "test")
+					So(err, ShouldBeNil)
+					w := httptest.NewRecorder()
+					r, err := http.NewRequest("POST", "snowflake.broker/answer", bytes.NewReader(b))
+					So(err, ShouldBeNil)
+					proxyAnswers(ctx, w, r)
+					So(w.Code, ShouldEqual, http.StatusBadRequest)
+				}
+				So(len(s.answerChannel), ShouldEqual, 0)
+			})
+
 			Convey("with error if the proxy writes too much data", func() {
 				data := bytes.NewReader(make([]byte, 100001))
 				r, err := http.NewRequest("POST", "snowflake.broker/answer", data)
@@ -217,7 +860,7 @@ func TestBroker(t *testing.T) {
 
 			// Client offer
 			wc := httptest.NewRecorder()
-			datac := bytes.NewReader([]byte("test"))
+			datac := bytes.NewReader([]byte(sampleOffer))
 			rc, err := http.NewRequest("POST", "snowflake.broker/client", datac)
 			So(err, ShouldBeNil)
 
@@ -231,7 +874,7 @@ func TestBroker(t *testing.T) {
 
 			// Proxy answers
 			wp = httptest.NewRecorder()
-			datap = bytes.NewReader([]byte(`{"Version":"1.0","Sid":"ymbcCMto7KHNGYlp","Answer":"test"}`))
+			datap = bytes.NewReader(answerRequest("ymbcCMto7KHNGYlp"))
 			rp, err = http.NewRequest("POST", "snowflake.broker/answer", datap)
 			So(err, ShouldBeNil)
 			go func(ctx *BrokerContext) {
@@ -269,7 +912,7 @@ func TestBroker(t *testing.T) {
 			So(ctx.idToSnowflake["ymbcCMto7KHNGYlp"], ShouldNotBeNil)
 
 			// Client request blocks until proxy answer arrives.
-			dataC := bytes.NewReader([]byte("fake offer"))
+			dataC := bytes.NewReader([]byte(sampleOffer))
 			wC := httptest.NewRecorder()
 			rC, err := http.NewRequest("POST", "snowflake.broker/client", dataC)
 			So(err, ShouldBeNil)
@@ -280,11 +923,11 @@ func TestBroker(t *testing.T) {
 
 			<-polled
 			So(wP.Code, ShouldEqual, http.StatusOK)
-			So(wP.Body.String(), ShouldResemble, `{"Status":"client match","Offer":"fake offer","NAT":"unknown"}`)
+			So(wP.Body.String(), ShouldResemble, `{"Status":"client match","Offer":"{\"type\":\"offer\",\"sdp\":\"v=0\\r\\n\"}","NAT":"unknown","Version":"1.0"}`)
 			So(ctx.idToSnowflake["ymbcCMto7KHNGYlp"], ShouldNotBeNil)
 			// Follow up with the answer request afterwards
 			wA := httptest.NewRecorder()
-			dataA := bytes.NewReader([]byte(`{"Version":"1.0","Sid":"ymbcCMto7KHNGYlp","Answer":"test"}`))
+			dataA := bytes.NewReader(answerRequest("ymbcCMto7KHNGYlp"))
 			rA, err := http.NewRequest("POST", "snowflake.broker/answer", dataA)
 			So(err, ShouldBeNil)
 			proxyAnswers(ctx, wA, rA)
@@ -292,11 +935,29 @@ func TestBroker(t *testing.T) {
 
 			<-done
 			So(wC.Code, ShouldEqual, http.StatusOK)
-			So(wC.Body.String(), ShouldEqual, "test")
+			So(wC.Body.String(), ShouldEqual, sampleAnswer)
 		})
 	})
 }
 
+func TestSessionIDPattern(t *testing.T) {
+	Convey("Proxy session IDs are scrubbed when asked", t, func() {
+		var buf bytes.Buffer
+		scrubber := &safelog.LogScrubber{Output: &buf}
+		scrubber.AddPattern(sessionIDPattern, "${1}[scrubbed]${2}")
+		logger := log.New(scrubber, "", 0)
+
+		logger.Printf("Client: matched with snowflake %s in %v", "ymbcCMto7KHNGYlp+/AbCd", time.Second)
+		So(buf.String(), ShouldEqual, "Client: matched with snowflake [scrubbed] in 1s\n")
+
+		// Longer and shorter tokens are left alone.
+		buf.Reset()
+		line := "a=fingerprint:sha-256 33:B6:FA:F6 ymbcCMto7KHNGYlp ymbcCMto7KHNGYlpymbcCMto7KHNGYlp\n"
+		logger.Print(line)
+		So(buf.String(), ShouldEqual, line)
+	})
+}
+
 func TestSnowflakeHeap(t *testing.T) {
 	Convey("SnowflakeHeap", t, func() {
 		h := new(SnowflakeHeap)
@@ -433,6 +1094,108 @@ func TestGeoip(t *testing.T) {
 			}
 		})
 
+		Convey("Lookups in nil tables", func() {
+			var nilv4 *GeoIPv4Table
+			var nilv6 *GeoIPv6Table
+			for _, table := range []GeoIPTable{nil, nilv4, nilv6} {
+				country, ok := GetCountryByAddr(table, net.ParseIP("129.97.208.23"))
+				So(country, ShouldEqual, "")
+				So(ok, ShouldBeFalse)
+			}
+		})
+
+		Convey("Unsorted geoip files", func() {
+			dir, err := ioutil.TempDir("", "snowflake-broker-test")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+
+			// Writes the lines of a geoip file in reverse order.
+			reversed := func(pathname string) string {
+				contents, err := ioutil.ReadFile(pathname)
+				So(err, ShouldBeNil)
+				lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+				for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+					lines[i], lines[j] = lines[j], lines[i]
+				}
+				out := filepath.Join(dir, filepath.Base(pathname))
+				So(ioutil.WriteFile(out, []byte(strings.Join(lines, "\n")+"\n"), 0644), ShouldBeNil)
+				return out
+			}
+
+			rv4 := new(GeoIPv4Table)
+			So(GeoIPLoadFile(rv4, reversed("test_geoip")), ShouldBeNil)
+			rv6 := new(GeoIPv6Table)
+			So(GeoIPLoadFile(rv6, reversed("test_geoip6")), ShouldBeNil)
+			So(rv4.table, ShouldResemble, tv4.table)
+			So(rv6.table, ShouldResemble, tv6.table)
+
+			for _, addr := range []string{"129.97.208.23", "127.0.0.1", "255.255.255.255", "0.0.0.0", "223.252.127.255"} {
+				expected, expectedOK := GetCountryByAddr(tv4, net.ParseIP(addr))
+				country, ok := GetCountryByAddr(rv4, net.ParseIP(addr))
+				So(country, ShouldEqual, expected)
+				So(ok, ShouldEqual, expectedOK)
+			}
+			for _, addr := range []string{"2620:101:f000:0:250:56ff:fe80:168e", "fd00:0:0:0:0:0:0:1", "2a07:2e47:ffff:ffff:ffff:ffff:ffff:ffff"} {
+				expected, expectedOK := GetCountryByAddr(tv6, net.ParseIP(addr))
+				country, ok := GetCountryByAddr(rv6, net.ParseIP(addr))
+				So(country, ShouldEqual, expected)
+				So(ok, ShouldEqual, expectedOK)
+			}
+
+			Convey("warn about overlapping ranges", func() {
+				pathname := filepath.Join(dir, "overlapping")
+				So(ioutil.WriteFile(pathname, []byte("300,400,BB\n100,200,AA\n150,250,CC\n"), 0644), ShouldBeNil)
+
+				var buf bytes.Buffer
+				log.SetOutput(&buf)
+				defer log.SetOutput(os.Stderr)
+				table := new(GeoIPv4Table)
+				So(GeoIPLoadFile(table, pathname), ShouldBeNil)
+				So(buf.String(), ShouldContainSubstring, "overlapping ranges 0.0.0.100-0.0.0.200 (AA) and 0.0.0.150-0.0.0.250 (CC)")
+				So(buf.String(), ShouldNotContainSubstring, "(BB)")
+
+				country, ok := GetCountryByAddr(table, net.ParseIP("0.0.1.44"))
+				So(country, ShouldEqual, "BB")
+				So(ok, ShouldBeTrue)
+			})
+		})
+
+		Convey("Blank lines and CRLF line endings", func() {
+			dir, err := ioutil.TempDir("", "snowflake-broker-test")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+
+			pathname := filepath.Join(dir, "geoip")
+			So(ioutil.WriteFile(pathname, []byte("# comment\r\n\r\n100,200,AA\r\n   \r\n300,400,BB\r\n\r\n"), 0644), ShouldBeNil)
+			table := new(GeoIPv4Table)
+			So(GeoIPLoadFile(table, pathname), ShouldBeNil)
+			So(table.Len(), ShouldEqual, 2)
+			country, ok := GetCountryByAddr(table, net.ParseIP("0.0.1.44"))
+			So(country, ShouldEqual, "BB")
+			So(ok, ShouldBeTrue)
+
+			pathname = filepath.Join(dir, "geoip6")
+			So(ioutil.WriteFile(pathname, []byte("\r\n2001:db8::,2001:db8::ffff,AA\r\n\r\n"), 0644), ShouldBeNil)
+			table6 := new(GeoIPv6Table)
+			So(GeoIPLoadFile(table6, pathname), ShouldBeNil)
+			country, ok = GetCountryByAddr(table6, net.ParseIP("2001:db8::1"))
+			So(country, ShouldEqual, "AA")
+			So(ok, ShouldBeTrue)
+
+			Convey("malformed lines are reported with their line number", func() {
+				pathname := filepath.Join(dir, "malformed")
+				So(ioutil.WriteFile(pathname, []byte("100,200,AA\r\n\r\n300,BB\r\n"), 0644), ShouldBeNil)
+				err := GeoIPLoadFile(new(GeoIPv4Table), pathname)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, pathname+":3:")
+
+				So(ioutil.WriteFile(pathname, []byte("2001:db8::,nonsense,AA\n"), 0644), ShouldBeNil)
+				err = GeoIPLoadFile(new(GeoIPv6Table), pathname)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, pathname+":1: error parsing IP nonsense")
+			})
+		})
+
 		// Make sure things behave properly if geoip file fails to load
 		ctx := NewBrokerContext(NullLogger())
 		if err := ctx.metrics.LoadGeoipDatabases("invalid_filename", "invalid_filename6"); err != nil {
@@ -441,6 +1204,91 @@ func TestGeoip(t *testing.T) {
 		ctx.metrics.UpdateCountryStats("127.0.0.1", "", NATUnrestricted)
 		So(ctx.metrics.tablev4, ShouldEqual, nil)
 
+		Convey("reloading databases", func() {
+			ctx := NewBrokerContext(NullLogger())
+			So(ctx.metrics.LoadGeoipDatabases("test_geoip", "test_geoip6"), ShouldBeNil)
+			tablev4, tablev6 := ctx.metrics.tablev4, ctx.metrics.tablev6
+			So(tablev4.Len(), ShouldBeGreaterThan, 0)
+			So(tablev6.Len(), ShouldBeGreaterThan, 0)
+
+			// A failed reload keeps the old tables.
+			So(ctx.metrics.LoadGeoipDatabases("test_geoip", "invalid_filename6"), ShouldNotBeNil)
+			So(ctx.metrics.tablev4, ShouldEqual, tablev4)
+			So(ctx.metrics.tablev6, ShouldEqual, tablev6)
+
+			// A successful reload replaces them, while lookups go on.
+			done := make(chan struct{})
+			go func() {
+				for i := 0; i < 100; i++ {
+					ctx.metrics.lock.Lock()
+					ctx.metrics.UpdateCountryStats(fmt.Sprintf("129.97.208.%d", i), "", NATUnrestricted)
+					ctx.metrics.lock.Unlock()
+				}
+				close(done)
+			}()
+			So(ctx.metrics.LoadGeoipDatabases("test_geoip", "test_geoip6"), ShouldBeNil)
+			<-done
+			So(ctx.metrics.tablev4, ShouldNotEqual, tablev4)
+			So(ctx.metrics.tablev4.Len(), ShouldEqual, tablev4.Len())
+			So(ctx.metrics.tablev6, ShouldNotEqual, tablev6)
+			So(ctx.metrics.countryStats.counts["CA"], ShouldEqual, 100)
+		})
+	})
+}
+
+func TestGeoipMMDB(t *testing.T) {
+	Convey("Geoip from MaxMind DB files", t, func() {
+		// test_geoip.mmdb is an IPv6 database of 129.97.0.0/16 (CA),
+		// 1.0.0.0/24 and 1.0.1.0/24 (AU), 2620:101:f000::/36 (CA) and
+		// 2a07:2e40::/29 (FR), with the IPv4 networks aliased.
+		tv4 := new(GeoIPv4Table)
+		So(GeoIPLoad(tv4, "test_geoip.mmdb"), ShouldBeNil)
+		// Adjacent networks in the same country are merged.
+		So(tv4.Len(), ShouldEqual, 2)
+		tv6 := new(GeoIPv6Table)
+		So(GeoIPLoad(tv6, "test_geoip.mmdb"), ShouldBeNil)
+		// IPv4 networks and their aliases are left out.
+		So(tv6.Len(), ShouldEqual, 2)
+
+		for _, test := range []struct {
+			table GeoIPTable
+			addr  string
+			cc    string
+		}{
+			{tv4, "129.97.208.23", "CA"},
+			{tv4, "1.0.0.0", "AU"},
+			{tv4, "1.0.1.255", "AU"},
+			{tv4, "1.0.2.0", ""},
+			{tv4, "127.0.0.1", ""},
+			{tv6, "2620:101:f000:0:250:56ff:fe80:168e", "CA"},
+			{tv6, "2a07:2e40::", "FR"},
+			{tv6, "2a07:2e47:ffff:ffff:ffff:ffff:ffff:ffff", "FR"},
+			{tv6, "fd00::1", ""},
+		} {
+			country, ok := GetCountryByAddr(test.table, net.ParseIP(test.addr))
+			So(country, ShouldEqual, test.cc)
+			So(ok, ShouldEqual, test.cc != "")
+		}
+
+		Convey("IPv4 databases have no IPv6 networks", func() {
+			// test_geoip4.mmdb is an IPv4 database of 129.97.0.0/16 (CA).
+			tv4 := new(GeoIPv4Table)
+			So(GeoIPLoad(tv4, "test_geoip4.mmdb"), ShouldBeNil)
+			country, _ := GetCountryByAddr(tv4, net.ParseIP("129.97.208.23"))
+			So(country, ShouldEqual, "CA")
+			So(GeoIPLoad(new(GeoIPv6Table), "test_geoip4.mmdb"), ShouldNotBeNil)
+		})
+
+		Convey("Invalid files are rejected", func() {
+			dir, err := ioutil.TempDir("", "snowflake-broker-test")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			pathname := filepath.Join(dir, "invalid.mmdb")
+			err = ioutil.WriteFile(pathname, []byte("not a database"), 0644)
+			So(err, ShouldBeNil)
+			So(GeoIPLoad(new(GeoIPv4Table), pathname), ShouldNotBeNil)
+			So(GeoIPLoad(new(GeoIPv4Table), filepath.Join(dir, "missing.mmdb")), ShouldNotBeNil)
+		})
 	})
 }
 
@@ -450,6 +1298,7 @@ func TestMetrics(t *testing.T) {
 		done := make(chan bool)
 		buf := new(bytes.Buffer)
 		ctx := NewBrokerContext(log.New(buf, "", 0))
+		ctx.clientOfferQueueSize = 0
 
 		err := ctx.metrics.LoadGeoipDatabases("test_geoip", "test_geoip6")
 		So(err, ShouldEqual, nil)
@@ -508,14 +1357,14 @@ func TestMetrics(t *testing.T) {
 			p.offerChannel <- nil
 			<-done
 			ctx.metrics.printMetrics()
-			So(buf.String(), ShouldResemble, "snowflake-stats-end "+time.Now().UTC().Format("2006-01-02 15:04:05")+" (86400 s)\nsnowflake-ips CA=4\nsnowflake-ips-total 4\nsnowflake-ips-standalone 1\nsnowflake-ips-badge 1\nsnowflake-ips-webext 1\nsnowflake-idle-count 8\nclient-denied-count 0\nclient-restricted-denied-count 0\nclient-unrestricted-denied-count 0\nclient-snowflake-match-count 0\nsnowflake-ips-nat-restricted 0\nsnowflake-ips-nat-unrestricted 0\nsnowflake-ips-nat-unknown 1\n")
+			So(buf.String(), ShouldResemble, "snowflake-stats-end "+time.Now().UTC().Format("2006-01-02 15:04:05")+" (86400 s)\nsnowflake-ips CA=4\nsnowflake-ips-total 4\nsnowflake-ips-standalone 1\nsnowflake-ips-badge 1\nsnowflake-ips-webext 1\nsnowflake-idle-count 8\nclient-denied-count 0\nclient-restricted-denied-count 0\nclient-unrestricted-denied-count 0\nclient-snowflake-match-count 0\nsnowflake-ips-nat-restricted 0\nsnowflake-ips-nat-unrestricted 0\nsnowflake-ips-nat-unknown 1\nclient-nat-mismatch-count 0\n")
 
 		})
 
 		//Test addition of client failures
 		Convey("for no proxies available", func() {
 			w := httptest.NewRecorder()
-			data := bytes.NewReader([]byte("test"))
+			data := bytes.NewReader([]byte(sampleOffer))
 			r, err := http.NewRequest("POST", "snowflake.broker/client", data)
 			So(err, ShouldBeNil)
 
@@ -533,7 +1382,7 @@ func TestMetrics(t *testing.T) {
 		//Test addition of client matches
 		Convey("for client-proxy match", func() {
 			w := httptest.NewRecorder()
-			data := bytes.NewReader([]byte("test"))
+			data := bytes.NewReader([]byte(sampleOffer))
 			r, err := http.NewRequest("POST", "snowflake.broker/client", data)
 			So(err, ShouldBeNil)
 
@@ -544,7 +1393,7 @@ func TestMetrics(t *testing.T) {
 				done <- true
 			}()
 			offer := <-snowflake.offerChannel
-			So(offer.sdp, ShouldResemble, []byte("test"))
+			So(offer.sdp, ShouldResemble, []byte(sampleOffer))
 			snowflake.answerChannel <- []byte("fake answer")
 			<-done
 
@@ -553,24 +1402,20 @@ func TestMetrics(t *testing.T) {
 		})
 		//Test rounding boundary
 		Convey("binning boundary", func() {
-			w := httptest.NewRecorder()
-			data := bytes.NewReader([]byte("test"))
-			r, err := http.NewRequest("POST", "snowflake.broker/client", data)
-			So(err, ShouldBeNil)
-
-			clientOffers(ctx, w, r)
-			clientOffers(ctx, w, r)
-			clientOffers(ctx, w, r)
-			clientOffers(ctx, w, r)
-			clientOffers(ctx, w, r)
-			clientOffers(ctx, w, r)
-			clientOffers(ctx, w, r)
-			clientOffers(ctx, w, r)
+			// Each offer needs its own request, whose body is read.
+			offer := func() {
+				r, err := http.NewRequest("POST", "snowflake.broker/client", bytes.NewReader([]byte(sampleOffer)))
+				So(err, ShouldBeNil)
+				clientOffers(ctx, httptest.NewRecorder(), r)
+			}
+			for i := 0; i < 8; i++ {
+				offer()
+			}
 
 			ctx.metrics.printMetrics()
 			So(buf.String(), ShouldContainSubstring, "client-denied-count 8\nclient-restricted-denied-count 8\nclient-unrestricted-denied-count 0\n")
 
-			clientOffers(ctx, w, r)
+			offer()
 			buf.Reset()
 			ctx.metrics.printMetrics()
 			So(buf.String(), ShouldContainSubstring, "client-denied-count 16\nclient-restricted-denied-count 16\nclient-unrestricted-denied-count 0\n")
@@ -608,6 +1453,37 @@ func TestMetrics(t *testing.T) {
 			ctx.metrics.printMetrics()
 			So(buf.String(), ShouldContainSubstring, "snowflake-ips CA=1\nsnowflake-ips-total 1")
 		})
+		//Test addresses behind a reverse proxy
+		Convey("proxy counts by forwarded address", func() {
+			poll := func(remoteAddr, forwardedFor string) {
+				w := httptest.NewRecorder()
+				data := bytes.NewReader([]byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.0"}`))
+				r, err := http.NewRequest("POST", "snowflake.broker/proxy", data)
+				So(err, ShouldBeNil)
+				r.RemoteAddr = remoteAddr
+				r.Header.Set("X-Forwarded-For", forwardedFor)
+				go func(ctx *BrokerContext) {
+					proxyPolls(ctx, w, r)
+					done <- true
+				}(ctx)
+				p := <-ctx.proxyPolls //manually unblock poll
+				p.offerChannel <- nil
+				<-done
+			}
+
+			// The header is ignored unless the broker trusts it.
+			poll("127.0.0.1:8888", "129.97.208.23")
+			ctx.metrics.printMetrics()
+			So(buf.String(), ShouldContainSubstring, "snowflake-ips ??=1\nsnowflake-ips-total 1")
+
+			buf.Reset()
+			ctx.metrics.zeroMetrics()
+			ctx.trustForwardedFor = true
+			// Only the address added by the reverse proxy counts.
+			poll("127.0.0.1:8888", "1.2.3.4, 129.97.208.23")
+			ctx.metrics.printMetrics()
+			So(buf.String(), ShouldContainSubstring, "snowflake-ips CA=1\nsnowflake-ips-total 1")
+		})
 		//Test NAT types
 		Convey("proxy counts by NAT type", func() {
 			w := httptest.NewRecorder()
@@ -646,7 +1522,7 @@ func TestMetrics(t *testing.T) {
 		//Test client failures by NAT type
 		Convey("client failures by NAT type", func() {
 			w := httptest.NewRecorder()
-			data := bytes.NewReader([]byte("test"))
+			data := bytes.NewReader([]byte(sampleOffer))
 			r, err := http.NewRequest("POST", "snowflake.broker/client", data)
 			r.Header.Set("Snowflake-NAT-TYPE", "restricted")
 			So(err, ShouldBeNil)
@@ -659,7 +1535,7 @@ func TestMetrics(t *testing.T) {
 			buf.Reset()
 			ctx.metrics.zeroMetrics()
 
-			r, err = http.NewRequest("POST", "snowflake.broker/client", data)
+			r, err = http.NewRequest("POST", "snowflake.broker/client", bytes.NewReader([]byte(sampleOffer)))
 			r.Header.Set("Snowflake-NAT-TYPE", "unrestricted")
 			So(err, ShouldBeNil)
 
@@ -671,7 +1547,7 @@ func TestMetrics(t *testing.T) {
 			buf.Reset()
 			ctx.metrics.zeroMetrics()
 
-			r, err = http.NewRequest("POST", "snowflake.broker/client", data)
+			r, err = http.NewRequest("POST", "snowflake.broker/client", bytes.NewReader([]byte(sampleOffer)))
 			r.Header.Set("Snowflake-NAT-TYPE", "unknown")
 			So(err, ShouldBeNil)
 
@@ -680,6 +1556,145 @@ func TestMetrics(t *testing.T) {
 			ctx.metrics.printMetrics()
 			So(buf.String(), ShouldContainSubstring, "client-denied-count 8\nclient-restricted-denied-count 8\nclient-unrestricted-denied-count 0\nclient-snowflake-match-count 0")
 		})
+		//Test Prometheus exposition
+		Convey("with a bounded number of country codes", func() {
+			// A broken geoip database with a different country for
+			// every address.
+			table := new(GeoIPv4Table)
+			for i := 0; i < 1000; i++ {
+				ip := net.IPv4(10, 0, byte(i/256), byte(i%256))
+				table.Append(GeoIPEntry{ipLow: ip, ipHigh: ip, country: fmt.Sprintf("X%03d", i)})
+			}
+			ctx.metrics.tablev4 = table
+
+			ctx.metrics.lock.Lock()
+			for i := 0; i < 1000; i++ {
+				ctx.metrics.UpdateCountryStats(fmt.Sprintf("10.0.%d.%d", i/256, i%256), "", NATUnknown)
+			}
+			counts := ctx.metrics.countryStats.counts
+			So(len(counts), ShouldEqual, defaultMaxCountryCodes+1)
+			So(counts["??"], ShouldEqual, 1000-defaultMaxCountryCodes)
+			So(counts["X000"], ShouldEqual, 1)
+
+			// Countries already seen are still counted.
+			ctx.metrics.UpdateCountryStats("10.0.0.0", "standalone", NATUnknown)
+			So(counts["X000"], ShouldEqual, 2)
+			ctx.metrics.lock.Unlock()
+		})
+		Convey("in Prometheus format", func() {
+			w := httptest.NewRecorder()
+			data := bytes.NewReader([]byte(sampleOffer))
+			r, err := http.NewRequest("POST", "snowflake.broker/client", data)
+			So(err, ShouldBeNil)
+			clientOffers(ctx, w, r)
+
+			ctx.AddSnowflake("fake", "", NATRestricted)
+
+			// Running totals survive the daily reset.
+			ctx.metrics.zeroMetrics()
+
+			w = httptest.NewRecorder()
+			r, err = http.NewRequest("GET", "/metrics", nil)
+			So(err, ShouldBeNil)
+			prometheusHandler(ctx, w, r)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, "# TYPE snowflake_broker_client_offers_total counter\nsnowflake_broker_client_offers_total 1\n")
+			So(w.Body.String(), ShouldContainSubstring, "snowflake_broker_client_denied_total 1\n")
+			So(w.Body.String(), ShouldContainSubstring, "snowflake_broker_snowflakes_available{nat=\"restricted\"} 1\n")
+			So(w.Body.String(), ShouldContainSubstring, "snowflake_broker_snowflakes_available{nat=\"unrestricted\"} 0\n")
+			So(w.Body.String(), ShouldContainSubstring, "snowflake_broker_client_match_latency_seconds_bucket{le=\"+Inf\"} 0\n")
+			So(w.Body.String(), ShouldNotContainSubstring, "# EOF")
+		})
+		Convey("in OpenMetrics format with exemplars", func() {
+			ctx.metricsExemplars = true
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "snowflake.broker/client", bytes.NewReader([]byte(sampleOffer)))
+			So(err, ShouldBeNil)
+			snowflake := ctx.AddSnowflake("ymbcCMto7KHNGYlp", "", NATUnrestricted)
+			go func() {
+				clientOffers(ctx, w, r)
+				done <- true
+			}()
+			<-snowflake.offerChannel
+			snowflake.answerChannel <- []byte("fake answer")
+			<-done
+
+			w = httptest.NewRecorder()
+			r, err = http.NewRequest("GET", "/metrics", nil)
+			So(err, ShouldBeNil)
+			prometheusHandler(ctx, w, r)
+			So(w.Header().Get("Content-Type"), ShouldStartWith, "application/openmetrics-text")
+			body := w.Body.String()
+			So(body, ShouldEndWith, "# EOF\n")
+			So(body, ShouldContainSubstring, "# TYPE snowflake_broker_client_offers counter\nsnowflake_broker_client_offers_total 1\n")
+			So(body, ShouldContainSubstring, "# TYPE snowflake_broker_client_match_latency_seconds histogram\n")
+			So(body, ShouldContainSubstring, "snowflake_broker_client_match_latency_seconds_count 1\n")
+
+			// Exactly one bucket has an exemplar, of the form
+			// name{labels} value # {trace_id="id"} value timestamp
+			var exemplars []string
+			for _, line := range strings.Split(body, "\n") {
+				if strings.Contains(line, " # ") {
+					exemplars = append(exemplars, line)
+				}
+			}
+			So(len(exemplars), ShouldEqual, 1)
+			parts := strings.Split(exemplars[0], " # ")
+			So(parts[0], ShouldStartWith, "snowflake_broker_client_match_latency_seconds_bucket{le=")
+			So(parts[0], ShouldEndWith, "} 1")
+			fields := strings.Fields(parts[1])
+			So(len(fields), ShouldEqual, 3)
+			So(fields[0], ShouldEqual, "{trace_id=\""+debugSnowflakeID("ymbcCMto7KHNGYlp")+"\"}")
+			for _, field := range fields[1:] {
+				_, err := strconv.ParseFloat(field, 64)
+				So(err, ShouldBeNil)
+			}
+		})
+		//Test fallback to incompatible NAT types
+		Convey("client NAT mismatch fallbacks", func() {
+			w := httptest.NewRecorder()
+			data := bytes.NewReader([]byte(sampleOffer))
+			r, err := http.NewRequest("POST", "snowflake.broker/client", data)
+			r.Header.Set("Snowflake-NAT-TYPE", NATRestricted)
+			So(err, ShouldBeNil)
+
+			// Only a restricted proxy is available.
+			snowflake := ctx.AddSnowflake("fake", "", NATRestricted)
+			go func() {
+				clientOffers(ctx, w, r)
+				done <- true
+			}()
+			offer := <-snowflake.offerChannel
+			So(offer.sdp, ShouldResemble, []byte(sampleOffer))
+			snowflake.answerChannel <- []byte("fake answer")
+			<-done
+			So(w.Code, ShouldEqual, http.StatusOK)
+
+			ctx.metrics.printMetrics()
+			So(buf.String(), ShouldContainSubstring, "client-denied-count 0\n")
+			So(buf.String(), ShouldContainSubstring, "client-nat-mismatch-count 8\n")
+
+			// An unrestricted client falling back to an unrestricted proxy
+			// is not a mismatch.
+			buf.Reset()
+			ctx.metrics.zeroMetrics()
+			w = httptest.NewRecorder()
+			r, err = http.NewRequest("POST", "snowflake.broker/client", bytes.NewReader([]byte(sampleOffer)))
+			r.Header.Set("Snowflake-NAT-TYPE", NATUnrestricted)
+			So(err, ShouldBeNil)
+			snowflake = ctx.AddSnowflake("fake", "", NATUnrestricted)
+			go func() {
+				clientOffers(ctx, w, r)
+				done <- true
+			}()
+			<-snowflake.offerChannel
+			snowflake.answerChannel <- []byte("fake answer")
+			<-done
+
+			ctx.metrics.printMetrics()
+			So(buf.String(), ShouldContainSubstring, "client-snowflake-match-count 8\n")
+			So(buf.String(), ShouldContainSubstring, "client-nat-mismatch-count 0\n")
+		})
 		Convey("for country stats order", func() {
 
 			stats := map[string]int{
@@ -697,3 +1712,200 @@ func TestMetrics(t *testing.T) {
 		})
 	})
 }
+
+// Passes each line written to a metrics logger over a channel.
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestMetricsInterval(t *testing.T) {
+	Convey("Metrics are logged and reset at the configured interval", t, func() {
+		lines := make(lineWriter, 100)
+		ctx := NewBrokerContext(log.New(lines, "", 0))
+		ctx.metrics.lock.Lock()
+		ctx.metrics.clientDeniedCount = 1
+		ctx.metrics.lock.Unlock()
+
+		ctx.metrics.Start(100 * time.Millisecond)
+		defer ctx.metrics.Stop()
+
+		nextReport := func() []string {
+			var report []string
+			for {
+				select {
+				case line := <-lines:
+					report = append(report, line)
+					if strings.HasPrefix(line, "client-nat-mismatch-count") {
+						return report
+					}
+				case <-time.After(time.Second):
+					return report
+				}
+			}
+		}
+
+		report := nextReport()
+		So(len(report), ShouldBeGreaterThan, 0)
+		So(report[0], ShouldStartWith, "snowflake-stats-end")
+		So(report, ShouldContain, "client-denied-count 8\n")
+
+		// The counts were reset after the first report.
+		report = nextReport()
+		So(report, ShouldContain, "client-denied-count 0\n")
+
+		// No more reports after stopping.
+		ctx.metrics.Stop()
+		for len(lines) > 0 {
+			<-lines
+		}
+		select {
+		case line := <-lines:
+			So(line, ShouldBeEmpty)
+		case <-time.After(300 * time.Millisecond):
+		}
+	})
+}
+
+func TestMetricsStop(t *testing.T) {
+	Convey("Stopping metrics logs what was counted since the last report", t, func() {
+		lines := make(lineWriter, 100)
+		ctx := NewBrokerContext(log.New(lines, "", 0))
+		ctx.metrics.Start(time.Hour)
+		ctx.metrics.lock.Lock()
+		ctx.metrics.clientDeniedCount = 1
+		ctx.metrics.lock.Unlock()
+
+		ctx.metrics.Stop()
+		So(len(lines), ShouldBeGreaterThan, 0)
+		first := <-lines
+		So(first, ShouldStartWith, "snowflake-stats-end")
+		So(first, ShouldEndWith, "(0 s)\n")
+		var report []string
+		for len(lines) > 0 {
+			report = append(report, <-lines)
+		}
+		So(report, ShouldContain, "client-denied-count 8\n")
+
+		// Stopping again does nothing.
+		ctx.metrics.Stop()
+		So(len(lines), ShouldEqual, 0)
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	Convey("Rate limiting", t, func() {
+		ctx := NewBrokerContext(NullLogger())
+		ctx.rateLimiter = NewRateLimiter(0.001, 3, true)
+		handler := SnowflakeHandler{ctx, func(ctx *BrokerContext, w http.ResponseWriter, r *http.Request) {}}
+		request := func(remoteAddr string) int {
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "snowflake.broker/proxy", nil)
+			So(err, ShouldBeNil)
+			r.RemoteAddr = remoteAddr
+			handler.ServeHTTP(w, r)
+			return w.Code
+		}
+
+		Convey("rejects an IP once its burst is used up", func() {
+			for i := 0; i < 3; i++ {
+				So(request("129.97.208.23:8888"), ShouldEqual, http.StatusOK)
+			}
+			for i := 0; i < 10; i++ {
+				So(request("129.97.208.23:8888"), ShouldEqual, http.StatusTooManyRequests)
+			}
+			// Other IPs are unaffected.
+			So(request("129.97.208.24:8888"), ShouldEqual, http.StatusOK)
+		})
+
+		Convey("exempts loopback addresses", func() {
+			for i := 0; i < 10; i++ {
+				So(request("127.0.0.1:8888"), ShouldEqual, http.StatusOK)
+				So(request("[::1]:8888"), ShouldEqual, http.StatusOK)
+			}
+		})
+
+		Convey("refills buckets over time", func() {
+			l := NewRateLimiter(1, 2, false)
+			now := time.Now()
+			So(l.allowAt("129.97.208.23", now), ShouldBeTrue)
+			So(l.allowAt("129.97.208.23", now), ShouldBeTrue)
+			So(l.allowAt("129.97.208.23", now), ShouldBeFalse)
+			So(l.allowAt("129.97.208.23", now.Add(time.Second)), ShouldBeTrue)
+			So(l.allowAt("129.97.208.23", now.Add(time.Second)), ShouldBeFalse)
+
+			// Full buckets are forgotten.
+			So(l.allowAt("127.0.0.1", now.Add(2*rateLimitPruneInterval)), ShouldBeTrue)
+			So(l.buckets, ShouldNotContainKey, "129.97.208.23")
+		})
+	})
+}
+
+func TestCandidateCounts(t *testing.T) {
+	Convey("Candidate counts", t, func() {
+		const sdpStart = `v=0\r\no=- 4358805017720277108 2 IN IP4 8.8.8.8\r\ns=-\r\nt=0 0\r\na=group:BUNDLE data\r\na=msid-semantic: WMS\r\nm=application 56688 DTLS/SCTP 5000\r\nc=IN IP4 8.8.8.8\r\n`
+		const candidate = `a=candidate:3769337065 1 udp 2122260223 8.8.8.8 56688 typ host generation 0 network-id 1 network-cost 50\r\n`
+		const sdpEnd = `a=ice-ufrag:aMAZ\r\na=ice-pwd:jcHb08Jjgrazp2dzjdrvPPvV\r\na=setup:actpass\r\na=mid:data\r\na=sctpmap:5000 webrtc-datachannel 1024\r\n`
+		description := func(sdpType string, n int) []byte {
+			sdp := sdpStart
+			for i := 0; i < n; i++ {
+				sdp += candidate
+			}
+			sdp += sdpEnd
+			return []byte(`{"type":"` + sdpType + `","sdp":"` + sdp + `"}`)
+		}
+
+		c := NewCandidateCounts()
+		c.AddOffer(description("offer", 2))
+		c.AddOffer(description("offer", 0))
+		c.AddOffer(description("offer", 2))
+		c.AddOffer([]byte("not a session description"))
+		c.AddAnswer(description("answer", 3))
+
+		offers, answers := c.Flush()
+		So(offers, ShouldEqual, "0=1,2=2")
+		So(answers, ShouldEqual, "3=1")
+
+		// Flushing resets the counts.
+		offers, answers = c.Flush()
+		So(offers, ShouldEqual, "")
+		So(answers, ShouldEqual, "")
+	})
+}
+
+func TestListenAll(t *testing.T) {
+	Convey("Listening on several addresses", t, func() {
+		listeners, err := listenAll("127.0.0.1:0, 127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer closeAll(listeners)
+		So(len(listeners), ShouldEqual, 2)
+		So(listeners[0].Addr().String(), ShouldNotEqual, listeners[1].Addr().String())
+
+		// Every listener is served.
+		server := &http.Server{Handler: http.HandlerFunc(robotsTxtHandler)}
+		served := make(chan error, 1)
+		go func() { served <- serveAll(listeners, server.Serve) }()
+		for _, ln := range listeners {
+			resp, err := http.Get("http://" + ln.Addr().String() + "/robots.txt")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		}
+		server.Close()
+		So(<-served, ShouldEqual, http.ErrServerClosed)
+
+		// An IPv6 address listens on IPv6 only.
+		if ln, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+			ln.Close()
+			listeners, err := listenAll("[::1]:0")
+			So(err, ShouldBeNil)
+			defer closeAll(listeners)
+			So(listeners[0].Addr().(*net.TCPAddr).IP.To4(), ShouldBeNil)
+		}
+
+		_, err = listenAll("127.0.0.1:0,not an address")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -14,8 +14,14 @@ type Snowflake struct {
 	natType       string
 	offerChannel  chan *ClientOffer
 	answerChannel chan []byte
-	clients       int
-	index         int
+	// Closed when the client matched with the snowflake stops waiting
+	// for its answer.
+	clientDone chan struct{}
+	// Set when the proxy's poll ended while the snowflake was off the
+	// heap, so that the poll is waiting for an offer or a nil.
+	pollEnded bool
+	clients   int
+	index     int
 }
 
 // Implements heap.Interface, and holds Snowflakes.
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
 	"testing"
 
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+	sf "git.torproject.org/pluggable-transports/snowflake.git/client/lib"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
+	"github.com/pion/webrtc/v3"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -57,3 +66,269 @@ func TestICEServerParser(t *testing.T) {
 
 	})
 }
+
+func TestICEServerCredentials(t *testing.T) {
+	Convey("Test parsing of ICE server credentials", t, func() {
+		for _, test := range []struct {
+			input    string
+			expected webrtc.ICEServer
+		}{
+			{
+				"stun:stun.l.google.com:19302",
+				webrtc.ICEServer{URLs: []string{"stun:stun.l.google.com:19302"}},
+			},
+			{
+				"turn:turn.example.com:3478",
+				webrtc.ICEServer{URLs: []string{"turn:turn.example.com:3478"}},
+			},
+			{
+				"turn:user:pass@turn.example.com:3478?transport=udp",
+				webrtc.ICEServer{
+					URLs:           []string{"turn:turn.example.com:3478?transport=udp"},
+					Username:       "user",
+					Credential:     "pass",
+					CredentialType: webrtc.ICECredentialTypePassword,
+				},
+			},
+			{
+				"turns:user%40example.com:p%3Ass@turn.example.com:5349",
+				webrtc.ICEServer{
+					URLs:           []string{"turns:turn.example.com:5349"},
+					Username:       "user@example.com",
+					Credential:     "p:ss",
+					CredentialType: webrtc.ICECredentialTypePassword,
+				},
+			},
+			{
+				"turn:user@turn.example.com",
+				webrtc.ICEServer{
+					URLs:           []string{"turn:turn.example.com"},
+					Username:       "user",
+					Credential:     "",
+					CredentialType: webrtc.ICECredentialTypePassword,
+				},
+			},
+		} {
+			So(parseIceServer(test.input), ShouldResemble, test.expected)
+		}
+
+		servers := parseIceServers("stun:stun.l.google.com:19302, turn:user:pass@turn.example.com")
+		So(len(servers), ShouldEqual, 2)
+		So(servers[1].Username, ShouldEqual, "user")
+		So(servers[1].URLs, ShouldResemble, []string{"turn:turn.example.com"})
+	})
+}
+
+func TestICEServersFromSOCKSArgs(t *testing.T) {
+	Convey("ICE servers in SOCKS args", t, func() {
+		broker, err := sf.NewBrokerChannel("https://broker.example/", "", nil, false)
+		So(err, ShouldBeNil)
+		global := parseIceServers("stun:stun.l.google.com:19302")
+		dialer := sf.NewWebRTCDialer(broker, global, 1)
+
+		Convey("configure the connection's dialer", func() {
+			args := pt.Args{}
+			args.Add("ice", "stun:stun.example.com:3478,bogus,turn:user:pass@turn.example.com")
+			tongue := tongueForArgs(args, dialer)
+			d, ok := tongue.(*sf.WebRTCDialer)
+			So(ok, ShouldBeTrue)
+			So(d, ShouldNotEqual, dialer)
+			So(d.Rendezvous, ShouldEqual, broker)
+			So(d.GetMax(), ShouldEqual, 1)
+			servers := d.ICEServers()
+			So(len(servers), ShouldEqual, 2)
+			So(servers[0].URLs, ShouldResemble, []string{"stun:stun.example.com:3478"})
+			So(servers[1].URLs, ShouldResemble, []string{"turn:turn.example.com"})
+			So(servers[1].Username, ShouldEqual, "user")
+
+			// The global list is unchanged.
+			So(dialer.ICEServers(), ShouldResemble, global)
+		})
+
+		Convey("fall back to -ice when missing or invalid", func() {
+			So(tongueForArgs(pt.Args{}, dialer), ShouldEqual, dialer)
+			args := pt.Args{}
+			args.Add("ice", "bogus")
+			So(tongueForArgs(args, dialer), ShouldEqual, dialer)
+		})
+	})
+}
+
+type FakeTongue struct{}
+
+func (t FakeTongue) Catch() (*sf.WebRTCPeer, error) { return nil, errors.New("no snowflakes") }
+func (t FakeTongue) GetMax() int                    { return 1 }
+
+func TestDataChannelConfig(t *testing.T) {
+	Convey("DataChannel options from flags", t, func() {
+		config, err := dataChannelConfig(false, -1, -1)
+		So(err, ShouldBeNil)
+		So(config, ShouldResemble, sf.DataChannelConfig{})
+
+		config, err = dataChannelConfig(true, 0, -1)
+		So(err, ShouldBeNil)
+		So(config.Unordered, ShouldBeTrue)
+		So(*config.MaxRetransmits, ShouldEqual, 0)
+		So(config.MaxPacketLifeTime, ShouldBeNil)
+
+		config, err = dataChannelConfig(true, -1, 500)
+		So(err, ShouldBeNil)
+		So(config.MaxRetransmits, ShouldBeNil)
+		So(*config.MaxPacketLifeTime, ShouldEqual, 500)
+
+		_, err = dataChannelConfig(true, 3, 500)
+		So(err, ShouldNotBeNil)
+		_, err = dataChannelConfig(false, 70000, -1)
+		So(err, ShouldNotBeNil)
+		_, err = dataChannelConfig(false, -1, -2)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestStandalone(t *testing.T) {
+	Convey("Standalone mode", t, func() {
+		saved, wasSet := os.LookupEnv("TOR_PT_MANAGED_TRANSPORT_VER")
+		So(os.Unsetenv("TOR_PT_MANAGED_TRANSPORT_VER"), ShouldBeNil)
+		defer func() {
+			if wasSet {
+				os.Setenv("TOR_PT_MANAGED_TRANSPORT_VER", saved)
+			}
+		}()
+		So(ptManaged(), ShouldBeFalse)
+
+		shutdown := make(chan struct{})
+		defer close(shutdown)
+		var wg sync.WaitGroup
+
+		// Does a SOCKS5 handshake up to the reply to a CONNECT request,
+		// and returns everything the server sent.
+		handshake := func(ln net.Listener, request []byte, replyLen int) []byte {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			_, err = conn.Write(request)
+			So(err, ShouldBeNil)
+			reply := make([]byte, replyLen)
+			n, _ := io.ReadFull(conn, reply)
+			return reply[:n]
+		}
+		connect := []byte{0x05, 0x01, 0x00, 0x03, 0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x01, 0xbb}
+		granted := []byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+
+		Convey("speaks SOCKS5 without authentication", func() {
+			ln, err := startStandaloneListener("127.0.0.1:0", "", "", FakeTongue{}, shutdown, &wg)
+			So(err, ShouldBeNil)
+			defer ln.Close()
+
+			request := append([]byte{0x05, 0x01, 0x00}, connect...)
+			reply := handshake(ln, request, 12)
+			So(reply, ShouldResemble, append([]byte{0x05, 0x00}, granted...))
+		})
+
+		Convey("accepts any username and password when none is configured", func() {
+			ln, err := startStandaloneListener("127.0.0.1:0", "", "", FakeTongue{}, shutdown, &wg)
+			So(err, ShouldBeNil)
+			defer ln.Close()
+
+			request := []byte{0x05, 0x01, 0x02, 0x01, 0x01, 'a', 0x01, 'b'}
+			reply := handshake(ln, append(request, connect...), 14)
+			So(reply, ShouldResemble, append([]byte{0x05, 0x02, 0x01, 0x00}, granted...))
+		})
+
+		Convey("checks the configured username and password", func() {
+			ln, err := startStandaloneListener("127.0.0.1:0", "alice", "secret", FakeTongue{}, shutdown, &wg)
+			So(err, ShouldBeNil)
+			defer ln.Close()
+
+			// No authentication is refused.
+			reply := handshake(ln, []byte{0x05, 0x01, 0x00}, 2)
+			So(reply, ShouldResemble, []byte{0x05, 0xff})
+
+			// So is the wrong password.
+			request := []byte{0x05, 0x01, 0x02, 0x01, 0x05, 'a', 'l', 'i', 'c', 'e', 0x05, 'w', 'r', 'o', 'n', 'g'}
+			reply = handshake(ln, request, 14)
+			So(reply, ShouldResemble, []byte{0x05, 0x02, 0x01, 0x01})
+
+			request = []byte{0x05, 0x01, 0x02, 0x01, 0x05, 'a', 'l', 'i', 'c', 'e', 0x06, 's', 'e', 'c', 'r', 'e', 't'}
+			reply = handshake(ln, append(request, connect...), 14)
+			So(reply, ShouldResemble, append([]byte{0x05, 0x02, 0x01, 0x00}, granted...))
+		})
+
+		Convey("refuses commands other than CONNECT", func() {
+			ln, err := startStandaloneListener("127.0.0.1:0", "", "", FakeTongue{}, shutdown, &wg)
+			So(err, ShouldBeNil)
+			defer ln.Close()
+
+			request := []byte{0x05, 0x01, 0x00, 0x05, 0x02, 0x00, 0x01, 127, 0, 0, 1, 0x01, 0xbb}
+			reply := handshake(ln, request, 12)
+			So(reply, ShouldResemble, []byte{0x05, 0x00, 0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		})
+	})
+
+	Convey("Managed mode", t, func() {
+		shutdown := make(chan struct{})
+		defer close(shutdown)
+		var wg sync.WaitGroup
+		listeners := startListeners([]string{"snowflake"}, "127.0.0.1:0", FakeTongue{}, shutdown, &wg)
+		So(len(listeners), ShouldEqual, 1)
+		defer listeners[0].Close()
+
+		// The listener speaks SOCKS5.
+		conn, err := net.Dial("tcp", listeners[0].Addr().String())
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		_, err = conn.Write([]byte{0x05, 0x01, 0x00})
+		So(err, ShouldBeNil)
+		reply := make([]byte, 2)
+		_, err = io.ReadFull(conn, reply)
+		So(err, ShouldBeNil)
+		So(reply, ShouldResemble, []byte{0x05, 0x00})
+
+		// Unknown methods get no listener.
+		So(startListeners([]string{"other"}, "127.0.0.1:0", FakeTongue{}, shutdown, &wg), ShouldBeEmpty)
+	})
+}
+
+func TestProbeICEServers(t *testing.T) {
+	Convey("Probing ICE servers", t, func() {
+		servers := parseIceServers("stun:blocked.example:3478,stun:ok.example:3478,turn:user:pass@turn.example.com")
+		health := sf.NewICEServerHealth(servers)
+		var probed []string
+		probe := func(addr string) error {
+			probed = append(probed, addr)
+			if addr == "blocked.example:3478" {
+				return errors.New("timed out")
+			}
+			return nil
+		}
+		for i := 0; i < 3; i++ {
+			probeICEServers(servers, health, probe)
+		}
+		// The TURN server isn't probed.
+		So(len(probed), ShouldEqual, 6)
+		So(health.String(), ShouldEqual, "stun:blocked.example:3478 0/3, stun:ok.example:3478 3/3")
+		// The blocked server is skipped.
+		var urls []string
+		for _, server := range health.Servers() {
+			urls = append(urls, server.URLs[0])
+		}
+		So(urls, ShouldResemble, []string{"stun:ok.example:3478", "turn:turn.example.com"})
+	})
+}
+
+func TestUpdateNATType(t *testing.T) {
+	Convey("NAT type without usable STUN servers", t, func() {
+		broker, err := sf.NewBrokerChannel("https://broker.example/", "", nil, false)
+		So(err, ShouldBeNil)
+		broker.SetNATType(nat.NATRestricted)
+
+		// Only STUN servers can be used to test the NAT; without one,
+		// the type is unknown, whatever it was before.
+		updateNATType(parseIceServers("turn:user:pass@turn.example.com"), broker)
+		So(broker.NATType, ShouldEqual, nat.NATUnknown)
+
+		broker.SetNATType(nat.NATRestricted)
+		updateNATType(nil, broker)
+		So(broker.NATType, ShouldEqual, nat.NATUnknown)
+	})
+}
@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// How many probes in a row an ICE server may fail before it is skipped.
+const iceServerMaxFailures = 3
+
+// The results of probing one ICE server.
+type iceServerStats struct {
+	probes              int
+	successes           int
+	consecutiveFailures int
+}
+
+// Tracks how often each of a list of ICE servers has answered probes, so that
+// snowflakes are caught using the servers that work, and not ones that are
+// blocked. Servers that have not been probed are assumed to work.
+type ICEServerHealth struct {
+	servers []webrtc.ICEServer
+	stats   map[string]*iceServerStats
+	lock    sync.Mutex
+}
+
+func NewICEServerHealth(servers []webrtc.ICEServer) *ICEServerHealth {
+	h := &ICEServerHealth{
+		servers: servers,
+		stats:   make(map[string]*iceServerStats),
+	}
+	for _, server := range servers {
+		h.stats[server.URLs[0]] = &iceServerStats{}
+	}
+	return h
+}
+
+// Records the result of probing the ICE server with the given URL.
+func (h *ICEServerHealth) Record(url string, ok bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	stats, found := h.stats[url]
+	if !found {
+		return
+	}
+	stats.probes++
+	if ok {
+		stats.successes++
+		stats.consecutiveFailures = 0
+	} else {
+		stats.consecutiveFailures++
+	}
+}
+
+// Returns the servers to use: those that have not failed too many probes in a
+// row, the most successful first. If every server has, returns all of them,
+// rather than none.
+func (h *ICEServerHealth) Servers() []webrtc.ICEServer {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var servers []webrtc.ICEServer
+	for _, server := range h.servers {
+		if h.stats[server.URLs[0]].consecutiveFailures < iceServerMaxFailures {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return h.servers
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return h.rate(servers[i]) > h.rate(servers[j])
+	})
+	return servers
+}
+
+// Returns the fraction of probes of server that succeeded, or 1 if it hasn't
+// been probed.
+func (h *ICEServerHealth) rate(server webrtc.ICEServer) float64 {
+	stats := h.stats[server.URLs[0]]
+	if stats.probes == 0 {
+		return 1
+	}
+	return float64(stats.successes) / float64(stats.probes)
+}
+
+// Returns the success rate of each server that has been probed, for logging.
+func (h *ICEServerHealth) String() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var parts []string
+	for _, server := range h.servers {
+		stats := h.stats[server.URLs[0]]
+		if stats.probes == 0 {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s %d/%d", server.URLs[0], stats.successes, stats.probes))
+	}
+	return strings.Join(parts, ", ")
+}
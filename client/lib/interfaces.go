@@ -1,7 +1,10 @@
 package lib
 
 import (
+	"context"
 	"net"
+
+	"github.com/pion/webrtc/v3"
 )
 
 // Interface for catching Snowflakes. (aka the remote dialer)
@@ -12,6 +15,29 @@ type Tongue interface {
 	GetMax() int
 }
 
+// A Tongue whose catching can be cancelled.
+type ContextTongue interface {
+	Tongue
+	// Like Catch, but gives up when ctx is done.
+	CatchContext(ctx context.Context) (*WebRTCPeer, error)
+}
+
+// A way of exchanging the client's offer for a proxy's answer.
+// BrokerChannel is one.
+type Rendezvous interface {
+	Negotiate(offer *webrtc.SessionDescription) (*webrtc.SessionDescription, error)
+}
+
+// A Rendezvous that can be cancelled, and that reports the NAT type of the
+// proxy that answered.
+type ContextRendezvous interface {
+	Rendezvous
+	// Like Negotiate, but gives up when ctx is done, and also returns
+	// the NAT type of the proxy.
+	NegotiateNATContext(ctx context.Context, offer *webrtc.SessionDescription) (
+		*webrtc.SessionDescription, string, error)
+}
+
 // Interface for collecting some number of Snowflakes, for passing along
 // ultimately to the SOCKS handler.
 type SnowflakeCollector interface {
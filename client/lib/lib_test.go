@@ -2,13 +2,27 @@ package lib
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"git.torproject.org/pluggable-transports/snowflake.git/common/amp"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/messages"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/util"
+	"github.com/pion/webrtc/v3"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -27,6 +41,183 @@ func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return r, nil
 }
 
+// A Rendezvous that isn't a broker, which gives the same answer to every offer.
+type FakeRendezvous struct {
+	answer *webrtc.SessionDescription
+	err    error
+	offer  *webrtc.SessionDescription
+}
+
+func (r *FakeRendezvous) Negotiate(offer *webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	r.offer = offer
+	return r.answer, r.err
+}
+
+// Like MockTransport, but also sets headers in its responses.
+type HeaderTransport struct {
+	MockTransport
+	header http.Header
+}
+
+func (m *HeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r, err := m.MockTransport.RoundTrip(req)
+	if err == nil {
+		r.Header = m.header
+	}
+	return r, err
+}
+
+// Fails every request with err, like an unreachable broker.
+type ErrorTransport struct {
+	err error
+}
+
+func (m ErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, m.err
+}
+
+// Delays the responses of another transport, like a slow broker.
+type DelayTransport struct {
+	http.RoundTripper
+	delay time.Duration
+}
+
+func (m *DelayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	time.Sleep(m.delay)
+	return m.RoundTripper.RoundTrip(req)
+}
+
+// Adds the NAT type of the proxy to the responses of another transport, as the
+// broker does.
+type NATTransport struct {
+	http.RoundTripper
+	natType string
+}
+
+func (m *NATTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r, err := m.RoundTripper.RoundTrip(req)
+	if err == nil {
+		r.Header = make(http.Header)
+		r.Header.Set("Snowflake-NAT-Type", m.natType)
+	}
+	return r, err
+}
+
+// Passes each write on to a channel, dropping it if the channel is full.
+type LineWriter chan string
+
+func (w LineWriter) Write(p []byte) (int, error) {
+	select {
+	case w <- string(p):
+	default:
+	}
+	return len(p), nil
+}
+
+// Echoes the nonce of each request in the responses of another transport, as
+// the broker does, or sends back nonce instead if it is set.
+type NonceTransport struct {
+	http.RoundTripper
+	nonce    string
+	requests []string
+}
+
+func (m *NonceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sent := req.Header.Get(messages.NonceHeader)
+	m.requests = append(m.requests, sent)
+	r, err := m.RoundTripper.RoundTrip(req)
+	if err == nil {
+		r.Header = make(http.Header)
+		if m.nonce != "" {
+			r.Header.Set(messages.NonceHeader, m.nonce)
+		} else {
+			r.Header.Set(messages.NonceHeader, sent)
+		}
+	}
+	return r, err
+}
+
+// Returns a fake SDP answer, or an error status, depending on the host the
+// request is sent to, and records the hosts requested.
+type HostTransport struct {
+	status   map[string]int
+	requests []string
+	hosts    []string
+}
+
+func (m *HostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.requests = append(m.requests, req.URL.Host)
+	m.hosts = append(m.hosts, req.Host)
+	r := &http.Response{
+		StatusCode: m.status[req.URL.Host],
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"type":"answer","sdp":"fake"}`))),
+	}
+	return r, nil
+}
+
+// Returns a response from the broker armored as by an AMP cache, and records
+// the requests made. The nonce of the request is echoed, unless nonce is set.
+type AMPTransport struct {
+	answer   string
+	natType  string
+	nonce    string
+	errorMsg string
+	requests []*http.Request
+}
+
+func (m *AMPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.requests = append(m.requests, req)
+	nonce := m.nonce
+	if nonce == "" {
+		nonce = req.URL.Query().Get("nonce")
+	}
+	body, err := messages.EncodeAMPClientResponse(m.answer, m.natType, nonce, m.errorMsg)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := amp.Armor(&buf, body); err != nil {
+		return nil, err
+	}
+	r := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(&buf),
+	}
+	return r, nil
+}
+
+// Records the messages sent on it.
+type FakeDataChannel struct {
+	lock   sync.Mutex
+	sends  [][]byte
+	closed bool
+}
+
+func (f *FakeDataChannel) Send(b []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.sends = append(f.sends, b)
+	return nil
+}
+
+func (f *FakeDataChannel) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *FakeDataChannel) Sends() [][]byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.sends
+}
+
+type FailingDialer struct{}
+
+func (w FailingDialer) Catch() (*WebRTCPeer, error) { return nil, errors.New("no snowflakes") }
+func (w FailingDialer) GetMax() int                 { return 1 }
+
 type FakeDialer struct {
 	max int
 }
@@ -40,6 +231,32 @@ func (w FakeDialer) GetMax() int {
 	return w.max
 }
 
+// Catches a snowflake only when its context is done, and then fails.
+type BlockingDialer struct {
+	started chan struct{}
+}
+
+func (w BlockingDialer) Catch() (*WebRTCPeer, error) {
+	return w.CatchContext(context.Background())
+}
+
+func (w BlockingDialer) CatchContext(ctx context.Context) (*WebRTCPeer, error) {
+	close(w.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (w BlockingDialer) GetMax() int { return 1 }
+
+// Answers requests only when they are cancelled, like a broker that never
+// answers.
+type BlockingTransport struct{}
+
+func (m BlockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
 type FakeSocksConn struct {
 	net.Conn
 	rejected bool
@@ -135,6 +352,51 @@ func TestSnowflakeClient(t *testing.T) {
 			So(p.Count(), ShouldEqual, 0)
 		})
 
+		Convey("End is atomic with respect to Collect.", func() {
+			p, _ := NewPeers(FakeDialer{max: 100})
+			collected := make(chan *WebRTCPeer, 100)
+			go func() {
+				defer close(collected)
+				for {
+					wc, err := p.Collect()
+					if err != nil {
+						return
+					}
+					collected <- wc
+				}
+			}()
+			p.End()
+			// Every peer that was collected must have been closed by End.
+			for wc := range collected {
+				So(wc.closed, ShouldBeTrue)
+			}
+			So(p.Count(), ShouldEqual, 0)
+			_, err := p.Collect()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("End cancels a snowflake being caught.", func() {
+			d := BlockingDialer{started: make(chan struct{})}
+			p, _ := NewPeers(d)
+			errs := make(chan error, 1)
+			go func() {
+				_, err := p.Collect()
+				errs <- err
+			}()
+			<-d.started
+			ended := make(chan struct{})
+			go func() {
+				p.End()
+				close(ended)
+			}()
+			select {
+			case <-ended:
+			case <-time.After(time.Second):
+				So("End waited for the catch", ShouldBeEmpty)
+			}
+			So(errors.Is(<-errs, context.Canceled), ShouldBeTrue)
+		})
+
 		Convey("Pop skips over closed peers.", func() {
 			p, _ := NewPeers(FakeDialer{max: 4})
 			wc1, _ := p.Collect()
@@ -160,7 +422,7 @@ func TestSnowflakeClient(t *testing.T) {
 
 		SkipConvey("Handler Grants correctly", func() {
 			socks := &FakeSocksConn{}
-			broker := &BrokerChannel{Host: "test"}
+			broker := &BrokerChannel{}
 			d := NewWebRTCDialer(broker, nil, 1)
 
 			So(socks.rejected, ShouldEqual, false)
@@ -169,16 +431,359 @@ func TestSnowflakeClient(t *testing.T) {
 		})
 	})
 
+	Convey("WebRTCPeer", t, func() {
+		c := &WebRTCPeer{
+			BytesLogger: &BytesNullLogger{},
+			recvQueue:   make(chan []byte, RecvQueueSize),
+			done:        make(chan struct{}),
+		}
+		c.recvPipe, c.writePipe = io.Pipe()
+		go c.recvLoop()
+
+		Convey("passes received messages to the reader", func() {
+			So(c.queueMessage([]byte("Hello")), ShouldBeTrue)
+			b := make([]byte, 5)
+			_, err := io.ReadFull(c, b)
+			So(err, ShouldBeNil)
+			So(b, ShouldResemble, []byte("Hello"))
+			c.Close()
+		})
+
+		Convey("closes on a DataChannel error", func() {
+			c.onDataChannelError(errors.New("SCTP association failed"))
+			select {
+			case <-c.done:
+			case <-time.After(time.Second):
+				So("peer was not closed", ShouldBeEmpty)
+			}
+			So(c.closed, ShouldBeTrue)
+			_, err := c.Read(make([]byte, 1))
+			So(err, ShouldEqual, io.EOF)
+		})
+
+		Convey("closes as soon as the ICE connection is lost", func() {
+			c.onICEConnectionStateChange(webrtc.ICEConnectionStateConnected)
+			c.onConnectionStateChange(webrtc.PeerConnectionStateConnected)
+			time.Sleep(10 * time.Millisecond)
+			So(c.closed, ShouldBeFalse)
+
+			c.onICEConnectionStateChange(webrtc.ICEConnectionStateFailed)
+			select {
+			case <-c.done:
+			case <-time.After(time.Second):
+				So("peer was not closed", ShouldBeEmpty)
+			}
+			So(c.closed, ShouldBeTrue)
+		})
+
+		Convey("closes as soon as the PeerConnection is lost", func() {
+			c.onConnectionStateChange(webrtc.PeerConnectionStateDisconnected)
+			select {
+			case <-c.done:
+			case <-time.After(time.Second):
+				So("peer was not closed", ShouldBeEmpty)
+			}
+			So(c.closed, ShouldBeTrue)
+		})
+
+		Convey("closes on an unexpected DataChannel from the proxy", func() {
+			dc := &FakeDataChannel{}
+			c.onUnexpectedDataChannel(dc)
+			select {
+			case <-c.done:
+			case <-time.After(time.Second):
+				So("peer was not closed", ShouldBeEmpty)
+			}
+			So(c.closed, ShouldBeTrue)
+			dc.lock.Lock()
+			So(dc.closed, ShouldBeTrue)
+			dc.lock.Unlock()
+			_, err := c.Read(make([]byte, 1))
+			So(err, ShouldEqual, io.EOF)
+		})
+
+		Convey("closes instead of blocking when the reader stops reading", func() {
+			overflowed := false
+			for i := 0; i < RecvQueueSize+2 && !overflowed; i++ {
+				overflowed = !c.queueMessage([]byte("x"))
+			}
+			So(overflowed, ShouldBeTrue)
+			select {
+			case <-c.done:
+			case <-time.After(time.Second):
+				So("peer was not closed", ShouldBeEmpty)
+			}
+		})
+	})
+
+	Convey("WebRTCPeer writes", t, func() {
+		transport := &FakeDataChannel{}
+		c := &WebRTCPeer{
+			BytesLogger: &BytesNullLogger{},
+			transport:   transport,
+		}
+
+		Convey("are each sent at once by default", func() {
+			for _, s := range []string{"a", "b", "c"} {
+				n, err := c.Write([]byte(s))
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 1)
+			}
+			So(transport.Sends(), ShouldResemble, [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+		})
+
+		Convey("coalesce when small and rapid", func() {
+			c.coalesce = CoalesceConfig{Delay: 50 * time.Millisecond, Size: 1024}
+			for i := 0; i < 10; i++ {
+				_, err := c.Write([]byte{byte('0' + i)})
+				So(err, ShouldBeNil)
+			}
+			So(transport.Sends(), ShouldBeEmpty)
+			time.Sleep(200 * time.Millisecond)
+			sends := transport.Sends()
+			So(len(sends), ShouldBeLessThan, 10)
+			So(bytes.Join(sends, nil), ShouldResemble, []byte("0123456789"))
+		})
+
+		Convey("are sent as soon as the size threshold is reached", func() {
+			c.coalesce = CoalesceConfig{Delay: time.Hour, Size: 4}
+			for _, s := range []string{"ab", "cd", "e"} {
+				_, err := c.Write([]byte(s))
+				So(err, ShouldBeNil)
+			}
+			So(transport.Sends(), ShouldResemble, [][]byte{[]byte("abcd")})
+			c.Close()
+			So(transport.Sends(), ShouldResemble, [][]byte{[]byte("abcd"), []byte("e")})
+			_, err := c.Write([]byte("f"))
+			So(err, ShouldEqual, io.ErrClosedPipe)
+		})
+
+		Convey("waiting to be coalesced are sent when a message is received", func() {
+			c.coalesce = CoalesceConfig{Delay: time.Hour, Size: 1024}
+			c.recvQueue = make(chan []byte, 1)
+			_, err := c.Write([]byte("request"))
+			So(err, ShouldBeNil)
+			So(transport.Sends(), ShouldBeEmpty)
+			So(c.queueMessage([]byte("reply")), ShouldBeTrue)
+			So(transport.Sends(), ShouldResemble, [][]byte{[]byte("request")})
+		})
+
+		Convey("waiting to be coalesced are sent by Close", func() {
+			c.coalesce = CoalesceConfig{Delay: time.Hour, Size: 1024}
+			_, err := c.Write([]byte("last"))
+			So(err, ShouldBeNil)
+			So(transport.Sends(), ShouldBeEmpty)
+			c.Close()
+			So(transport.Sends(), ShouldResemble, [][]byte{[]byte("last")})
+			// Closing again sends nothing more.
+			c.Close()
+			So(len(transport.Sends()), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Stats", t, func() {
+		Convey("are written as JSON lines", func() {
+			var buf bytes.Buffer
+			w := NewStatsWriter(&buf)
+			w.Write(Stats{
+				Time:        time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+				Inbound:     100,
+				Outbound:    20,
+				InEvents:    3,
+				OutEvents:   1,
+				ActivePeers: 1,
+			})
+			w.Write(Stats{Time: time.Date(2021, 1, 2, 3, 4, 10, 0, time.UTC), LastError: "no snowflakes"})
+			So(buf.String(), ShouldEqual,
+				`{"time":"2021-01-02T03:04:05Z","inbound_bytes":100,"outbound_bytes":20,"inbound_events":3,"outbound_events":1,"active_peers":1}`+"\n"+
+					`{"time":"2021-01-02T03:04:10Z","inbound_bytes":0,"outbound_bytes":0,"inbound_events":0,"outbound_events":0,"active_peers":0,"last_error":"no snowflakes"}`+"\n")
+		})
+
+		Convey("include the last error catching a snowflake", func() {
+			p, _ := NewPeers(FailingDialer{})
+			So(p.LastError(), ShouldBeNil)
+			_, err := p.Collect()
+			So(err, ShouldNotBeNil)
+			So(p.LastError(), ShouldEqual, err)
+		})
+	})
+
+	Convey("DataChannel options", t, func() {
+		options, err := DataChannelConfig{}.init()
+		So(err, ShouldBeNil)
+		So(*options.Ordered, ShouldBeTrue)
+		So(options.MaxRetransmits, ShouldBeNil)
+		So(options.MaxPacketLifeTime, ShouldBeNil)
+
+		var zero, lifetime uint16 = 0, 500
+		options, err = DataChannelConfig{Unordered: true, MaxRetransmits: &zero}.init()
+		So(err, ShouldBeNil)
+		So(*options.Ordered, ShouldBeFalse)
+		So(*options.MaxRetransmits, ShouldEqual, 0)
+
+		// A peer can't be made with both limits.
+		_, err = DataChannelConfig{MaxRetransmits: &zero, MaxPacketLifeTime: &lifetime}.init()
+		So(err, ShouldNotBeNil)
+		_, err = NewWebRTCPeerWithOptions(context.Background(), &webrtc.Configuration{}, nil,
+			DataChannelConfig{MaxRetransmits: &zero, MaxPacketLifeTime: &lifetime})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("ICE server health", t, func() {
+		a := webrtc.ICEServer{URLs: []string{"stun:a.example:3478"}}
+		b := webrtc.ICEServer{URLs: []string{"stun:b.example:3478"}}
+		c := webrtc.ICEServer{URLs: []string{"stun:c.example:3478"}}
+		h := NewICEServerHealth([]webrtc.ICEServer{a, b, c})
+		So(h.Servers(), ShouldResemble, []webrtc.ICEServer{a, b, c})
+
+		// The most successful servers come first, and unprobed ones are
+		// assumed to work.
+		h.Record("stun:a.example:3478", true)
+		h.Record("stun:a.example:3478", false)
+		h.Record("stun:b.example:3478", true)
+		So(h.Servers(), ShouldResemble, []webrtc.ICEServer{b, c, a})
+
+		// Servers that fail too often in a row are skipped, until they
+		// succeed again.
+		for i := 0; i < iceServerMaxFailures; i++ {
+			h.Record("stun:b.example:3478", false)
+		}
+		So(h.Servers(), ShouldResemble, []webrtc.ICEServer{c, a})
+		h.Record("stun:b.example:3478", true)
+		So(h.Servers(), ShouldContain, b)
+
+		// If every server is failing, all are used anyway.
+		for _, server := range []webrtc.ICEServer{a, b, c} {
+			for i := 0; i < iceServerMaxFailures; i++ {
+				h.Record(server.URLs[0], false)
+			}
+		}
+		So(h.Servers(), ShouldResemble, []webrtc.ICEServer{a, b, c})
+
+		// Unknown servers are ignored.
+		h.Record("stun:d.example:3478", true)
+		So(h.String(), ShouldNotContainSubstring, "d.example")
+	})
+
+	Convey("ICE gathering", t, func() {
+		done := make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Gathering that never completes is given up on.
+		start := time.Now()
+		So(waitForGathering(ctx, done, 50*time.Millisecond), ShouldBeNil)
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+
+		cancel()
+		So(waitForGathering(ctx, done, time.Hour), ShouldEqual, context.Canceled)
+
+		close(done)
+		So(waitForGathering(context.Background(), done, time.Hour), ShouldBeNil)
+	})
+
+	Convey("Reconnect backoff", t, func() {
+		b := &backoff{base: 10 * time.Second, max: 60 * time.Second}
+		So(b.success(), ShouldEqual, 10*time.Second)
+
+		// Delays double, with jitter, up to the maximum.
+		for _, expected := range []time.Duration{10, 20, 40, 60, 60} {
+			expected *= time.Second
+			delay := b.failure()
+			So(delay, ShouldBeBetweenOrEqual, expected/2, expected)
+		}
+
+		// A success resets the delay.
+		So(b.success(), ShouldEqual, 10*time.Second)
+		So(b.failure(), ShouldBeBetweenOrEqual, 5*time.Second, 10*time.Second)
+
+		// A Retry-After from the broker lengthens the delay, up to the
+		// maximum, but doesn't shorten it.
+		b.success()
+		So(b.failureAtLeast(30*time.Second), ShouldEqual, 30*time.Second)
+		So(b.failureAtLeast(time.Second), ShouldBeBetweenOrEqual, 10*time.Second, 20*time.Second)
+		So(b.failureAtLeast(time.Hour), ShouldEqual, 60*time.Second)
+
+		Convey("doesn't count being at capacity as a failure", func() {
+			p, _ := NewPeers(FakeDialer{max: 1})
+			_, err := p.Collect()
+			So(err, ShouldBeNil)
+			_, err = p.Collect()
+			So(errors.Is(err, errAtCapacity), ShouldBeTrue)
+			So(err.Error(), ShouldEqual, "At capacity [1/1]")
+		})
+	})
+
+	Convey("Run summary", t, func() {
+		s := NewRunSummary()
+		// A session that lost its first two snowflakes.
+		for i := 0; i < 3; i++ {
+			s.AddSnowflake()
+		}
+		s.AddReconnect()
+		s.AddReconnect()
+		logger := multiBytesLogger{BytesNullLogger{}, s}
+		logger.AddInbound(100)
+		logger.AddInbound(50)
+		logger.AddOutbound(20)
+
+		So(s.summary(s.start.Add(90*time.Second)), ShouldEqual,
+			"Run summary: 1m30s running, 3 snowflakes used, 2 reconnects, Traffic Bytes (in|out): 150 | 20")
+
+		s.AddBrokerRTT(100 * time.Millisecond)
+		s.AddBrokerRTT(300 * time.Millisecond)
+		So(s.LastBrokerRTT(), ShouldEqual, 300*time.Millisecond)
+		So(s.summary(s.start.Add(90*time.Second)), ShouldEndWith, ", Broker RTT avg: 200ms")
+	})
+
+	Convey("Traffic summary", t, func() {
+		lines := make(chan string, 10)
+		log.SetOutput(LineWriter(lines))
+		defer log.SetOutput(os.Stderr)
+		SummaryInterval = 10 * time.Millisecond
+		defer func() { SummaryInterval = LogTimeInterval }()
+
+		b := NewBytesSyncLogger()
+		b.AddInbound(100)
+		b.AddInbound(50)
+		b.AddOutbound(20)
+		var line string
+		timeout := time.After(5 * time.Second)
+		for !strings.Contains(line, "Traffic Bytes") {
+			select {
+			case line = <-lines:
+			case <-timeout:
+				So("no traffic summary logged", ShouldBeEmpty)
+				return
+			}
+		}
+		So(line, ShouldEndWith, "Traffic Bytes (in|out): 150 | 20 -- (2 OnMessages, 1 Sends)\n")
+	})
+
 	Convey("Dialers", t, func() {
 		Convey("Can construct WebRTCDialer.", func() {
-			broker := &BrokerChannel{Host: "test"}
+			broker := &BrokerChannel{}
 			d := NewWebRTCDialer(broker, nil, 1)
 			So(d, ShouldNotBeNil)
-			So(d.BrokerChannel, ShouldNotBeNil)
-			So(d.BrokerChannel.Host, ShouldEqual, "test")
+			So(d.Rendezvous, ShouldEqual, broker)
+		})
+		Convey("Can negotiate through any Rendezvous.", func() {
+			fakeOffer := &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "offer"}
+			answer := &webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "answer"}
+			r := &FakeRendezvous{answer: answer}
+			got, natType, err := negotiate(context.Background(), r, fakeOffer)
+			So(err, ShouldBeNil)
+			So(got, ShouldEqual, answer)
+			So(natType, ShouldEqual, nat.NATUnknown)
+			So(r.offer, ShouldEqual, fakeOffer)
+			So(localNATType(r), ShouldEqual, nat.NATUnknown)
+
+			r.err = errors.New("no answer")
+			_, _, err = negotiate(context.Background(), r, fakeOffer)
+			So(err, ShouldEqual, r.err)
 		})
 		SkipConvey("WebRTCDialer can Catch a snowflake.", func() {
-			broker := &BrokerChannel{Host: "test"}
+			broker := &BrokerChannel{}
 			d := NewWebRTCDialer(broker, nil, 1)
 			conn, err := d.Catch()
 			So(conn, ShouldBeNil)
@@ -198,18 +803,21 @@ func TestSnowflakeClient(t *testing.T) {
 
 		Convey("Construct BrokerChannel with no front domain", func() {
 			b, err := NewBrokerChannel("test.broker", "", transport, false)
-			So(b.url, ShouldNotBeNil)
 			So(err, ShouldBeNil)
-			So(b.url.Path, ShouldResemble, "test.broker")
+			So(len(b.brokers), ShouldEqual, 1)
+			So(b.brokers[0].url, ShouldNotBeNil)
+			So(b.brokers[0].url.Path, ShouldResemble, "test.broker")
+			So(b.brokers[0].host, ShouldEqual, "")
 			So(b.transport, ShouldNotBeNil)
 		})
 
 		Convey("Construct BrokerChannel *with* front domain", func() {
 			b, err := NewBrokerChannel("test.broker", "front", transport, false)
-			So(b.url, ShouldNotBeNil)
 			So(err, ShouldBeNil)
-			So(b.url.Path, ShouldResemble, "test.broker")
-			So(b.url.Host, ShouldResemble, "front")
+			So(len(b.brokers), ShouldEqual, 1)
+			So(b.brokers[0].url, ShouldNotBeNil)
+			So(b.brokers[0].url.Path, ShouldResemble, "test.broker")
+			So(b.brokers[0].url.Host, ShouldResemble, "front")
 			So(b.transport, ShouldNotBeNil)
 		})
 
@@ -222,6 +830,41 @@ func TestSnowflakeClient(t *testing.T) {
 			So(answer.SDP, ShouldResemble, "fake")
 		})
 
+		Convey("BrokerChannel.NegotiateNAT responds with the proxy's NAT type", func() {
+			b, err := NewBrokerChannel("test.broker", "", transport, false)
+			So(err, ShouldBeNil)
+			answer, natType, err := b.NegotiateNAT(fakeOffer)
+			So(err, ShouldBeNil)
+			So(answer.SDP, ShouldResemble, "fake")
+			So(natType, ShouldEqual, nat.NATUnknown)
+
+			b, err = NewBrokerChannel("test.broker", "",
+				&NATTransport{transport, nat.NATRestricted}, false)
+			So(err, ShouldBeNil)
+			answer, natType, err = b.NegotiateNAT(fakeOffer)
+			So(err, ShouldBeNil)
+			So(answer.SDP, ShouldResemble, "fake")
+			So(natType, ShouldEqual, nat.NATRestricted)
+		})
+
+		Convey("BrokerChannel.Negotiate measures the broker round-trip time", func() {
+			b, err := NewBrokerChannel("test.broker", "",
+				&DelayTransport{transport, 50 * time.Millisecond}, false)
+			So(err, ShouldBeNil)
+			So(b.RTT(), ShouldEqual, 0)
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(b.RTT(), ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+			So(Summary.LastBrokerRTT(), ShouldEqual, b.RTT())
+
+			// Failed negotiations don't count.
+			rtt := b.RTT()
+			b.transport = &DelayTransport{&MockTransport{http.StatusServiceUnavailable, []byte("\n")}, 0}
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldNotBeNil)
+			So(b.RTT(), ShouldEqual, rtt)
+		})
+
 		Convey("BrokerChannel.Negotiate fails with 503", func() {
 			b, err := NewBrokerChannel("test.broker", "",
 				&MockTransport{http.StatusServiceUnavailable, []byte("\n")},
@@ -231,6 +874,152 @@ func TestSnowflakeClient(t *testing.T) {
 			So(err, ShouldNotBeNil)
 			So(answer, ShouldBeNil)
 			So(err.Error(), ShouldResemble, BrokerError503)
+			So(errors.Is(err, ErrBrokerUnavailable), ShouldBeTrue)
+		})
+
+		Convey("BrokerChannel.Negotiate rejects answers to other offers", func() {
+			transport := &NonceTransport{RoundTripper: &MockTransport{
+				http.StatusOK,
+				[]byte(`{"type":"answer","sdp":"fake"}`),
+			}}
+			b, err := NewBrokerChannel("test.broker", "", transport, false)
+			So(err, ShouldBeNil)
+
+			// Each offer has a new nonce, which the broker echoes.
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(len(transport.requests), ShouldEqual, 2)
+			So(transport.requests[0], ShouldNotEqual, "")
+			So(transport.requests[1], ShouldNotEqual, transport.requests[0])
+
+			// An answer with the nonce of another offer is rejected.
+			transport.nonce = "0123abcd"
+			answer, err := b.Negotiate(fakeOffer)
+			So(answer, ShouldBeNil)
+			So(errors.Is(err, ErrBrokerStaleAnswer), ShouldBeTrue)
+		})
+
+		Convey("BrokerChannel.Negotiate rejects an answer it already had", func() {
+			answerSDP := "v=0\\r\\no=- 1 2 IN IP4 0.0.0.0\\r\\ns=-\\r\\nt=0 0\\r\\n" +
+				"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\\r\\na=ice-ufrag:bNBA\\r\\na=mid:0\\r\\n"
+			transport := &MockTransport{
+				http.StatusOK,
+				[]byte(`{"type":"answer","sdp":"` + answerSDP + `"}`),
+			}
+			b, err := NewBrokerChannel("test.broker", "", transport, false)
+			So(err, ShouldBeNil)
+			answer, err := b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(answer, ShouldNotBeNil)
+
+			answer, err = b.Negotiate(fakeOffer)
+			So(answer, ShouldBeNil)
+			So(errors.Is(err, ErrBrokerStaleAnswer), ShouldBeTrue)
+		})
+
+		Convey("BrokerChannel.Negotiate logs the full answer only if asked to", func() {
+			answerSDP := "v=0\\r\\no=- 4358805017720277108 2 IN IP4 0.0.0.0\\r\\ns=-\\r\\nt=0 0\\r\\n" +
+				"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\\r\\nc=IN IP4 0.0.0.0\\r\\n" +
+				"a=candidate:1 1 udp 2130706431 203.0.113.5 56688 typ host\\r\\n" +
+				"a=fingerprint:sha-256 C8:88:EE:B9:E7:02:2E:21:37:ED:7A:D1:EB:2B:A3:15:A2:3B:5B:1C:3D:D4:D5:1F:06:CF:52:40:03:F8:DD:66\\r\\n"
+			b, err := NewBrokerChannel("test.broker", "", &MockTransport{
+				http.StatusOK,
+				[]byte(`{"type":"answer","sdp":"` + answerSDP + `"}`),
+			}, false)
+			So(err, ShouldBeNil)
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			defer log.SetOutput(os.Stderr)
+
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldNotContainSubstring, "203.0.113.5")
+			So(buf.String(), ShouldContainSubstring, "1 candidates")
+
+			LogFullSDP = true
+			defer func() { LogFullSDP = false }()
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "203.0.113.5")
+			// Even then, the fingerprint is redacted.
+			So(buf.String(), ShouldNotContainSubstring, "C8:88:EE")
+		})
+
+		Convey("BrokerChannel.Negotiate returns the broker's Retry-After", func() {
+			transport := &HeaderTransport{
+				MockTransport{http.StatusServiceUnavailable, []byte("\n")},
+				http.Header{"Retry-After": []string{"7"}},
+			}
+			b, err := NewBrokerChannel("test.broker", "", transport, false)
+			So(err, ShouldBeNil)
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, BrokerError503)
+			So(errors.Is(err, ErrBrokerUnavailable), ShouldBeTrue)
+			So(brokerRetryAfter(err), ShouldEqual, 7*time.Second)
+
+			transport.statusOverride = http.StatusGatewayTimeout
+			_, err = b.Negotiate(fakeOffer)
+			So(brokerRetryAfter(err), ShouldEqual, 7*time.Second)
+
+			// Without a valid Retry-After, there is nothing to honor.
+			transport.header.Set("Retry-After", "soon")
+			_, err = b.Negotiate(fakeOffer)
+			So(err.Error(), ShouldEqual, BrokerErrorUnexpected)
+			So(errors.Is(err, ErrBrokerUnexpected), ShouldBeTrue)
+			So(brokerRetryAfter(err), ShouldEqual, 0)
+		})
+
+		Convey("BrokerChannel.Status asks the broker for its status", func() {
+			b, err := NewBrokerChannel("https://broker.example/", "front.example",
+				&MockTransport{http.StatusOK, []byte(`{"Proxies":3,"Wait":0}`)}, false)
+			So(err, ShouldBeNil)
+			proxies, wait, err := b.Status()
+			So(err, ShouldBeNil)
+			So(proxies, ShouldEqual, 3)
+			So(wait, ShouldEqual, 0)
+
+			// With no proxies, a dialer that checks the status doesn't
+			// make an offer, and waits as the broker says.
+			b.transport = &MockTransport{http.StatusOK, []byte(`{"Proxies":0,"Wait":5}`)}
+			d := NewWebRTCDialer(b, nil, 1)
+			d.CheckStatus = true
+			_, err = d.Catch()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, BrokerError503)
+			So(errors.Is(err, ErrBrokerUnavailable), ShouldBeTrue)
+			So(brokerRetryAfter(err), ShouldEqual, 5*time.Second)
+
+			b.transport = &MockTransport{http.StatusNotFound, []byte("\n")}
+			_, _, err = b.Status()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("BrokerChannel.NegotiateNATContext gives up when cancelled", func() {
+			b, err := NewBrokerChannel("test.broker", "", BlockingTransport{}, false)
+			So(err, ShouldBeNil)
+			So(b.AddBroker("test.broker2", ""), ShouldBeNil)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			_, _, err = b.NegotiateNATContext(ctx, fakeOffer)
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+			// Neither broker is waited for past the deadline.
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+		})
+
+		Convey("BrokerChannel.Negotiate gives up on a broker after its Timeout", func() {
+			b, err := NewBrokerChannel("test.broker", "", BlockingTransport{}, false)
+			So(err, ShouldBeNil)
+			So(b.Timeout, ShouldEqual, DefaultBrokerTimeout)
+			b.Timeout = 50 * time.Millisecond
+			start := time.Now()
+			answer, err := b.Negotiate(fakeOffer)
+			So(answer, ShouldBeNil)
+			So(errors.Is(err, ErrBrokerUnreachable), ShouldBeTrue)
+			So(time.Since(start), ShouldBeLessThan, time.Second)
 		})
 
 		Convey("BrokerChannel.Negotiate fails with 400", func() {
@@ -242,6 +1031,18 @@ func TestSnowflakeClient(t *testing.T) {
 			So(err, ShouldNotBeNil)
 			So(answer, ShouldBeNil)
 			So(err.Error(), ShouldResemble, BrokerError400)
+			So(errors.Is(err, ErrBrokerBadRequest), ShouldBeTrue)
+		})
+
+		Convey("BrokerChannel.Negotiate fails with an unreachable broker", func() {
+			b, err := NewBrokerChannel("test.broker", "",
+				ErrorTransport{errors.New("connection refused")}, false)
+			So(err, ShouldBeNil)
+			answer, err := b.Negotiate(fakeOffer)
+			So(answer, ShouldBeNil)
+			So(err.Error(), ShouldEqual, "connection refused")
+			So(errors.Is(err, ErrBrokerUnreachable), ShouldBeTrue)
+			So(errors.Is(err, ErrBrokerUnavailable), ShouldBeFalse)
 		})
 
 		Convey("BrokerChannel.Negotiate fails with large read", func() {
@@ -255,6 +1056,119 @@ func TestSnowflakeClient(t *testing.T) {
 			So(err.Error(), ShouldResemble, "unexpected EOF")
 		})
 
+		Convey("BrokerChannel.Negotiate domain-fronts with the Host header", func() {
+			transport := &HostTransport{status: map[string]int{
+				"front.example":  http.StatusOK,
+				"broker.example": http.StatusOK,
+			}}
+			// The connection, and so the TLS SNI, is to the front;
+			// the Host header names the real broker.
+			b, err := NewBrokerChannel("https://broker.example/", "front.example", transport, false)
+			So(err, ShouldBeNil)
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(transport.requests, ShouldResemble, []string{"front.example"})
+			So(transport.hosts, ShouldResemble, []string{"broker.example"})
+
+			// Without a front, the two are the same.
+			transport.requests, transport.hosts = nil, nil
+			b, err = NewBrokerChannel("https://broker.example/", "", transport, false)
+			So(err, ShouldBeNil)
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(transport.requests, ShouldResemble, []string{"broker.example"})
+			So(transport.hosts, ShouldResemble, []string{"broker.example"})
+		})
+
+		Convey("BrokerChannel.Negotiate falls back to other brokers", func() {
+			transport := &HostTransport{status: map[string]int{
+				"broker1.example": http.StatusServiceUnavailable,
+				"broker2.example": http.StatusOK,
+				// broker3 is reached through its front.
+				"front.example": http.StatusOK,
+			}}
+			b, err := NewBrokerChannel("https://broker1.example/", "", transport, false)
+			So(err, ShouldBeNil)
+			So(b.AddBroker("https://broker2.example/", ""), ShouldBeNil)
+			So(b.AddBroker("https://broker3.example/", "front.example"), ShouldBeNil)
+
+			answer, err := b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(answer.SDP, ShouldResemble, "fake")
+			So(transport.requests, ShouldResemble, []string{"broker1.example", "broker2.example"})
+
+			// The broker that answered is tried first next time.
+			transport.requests = nil
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(transport.requests, ShouldResemble, []string{"broker2.example"})
+
+			// Fronted brokers get their real name in the Host header.
+			transport.status["broker2.example"] = http.StatusServiceUnavailable
+			transport.requests = nil
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			So(transport.requests, ShouldResemble, []string{"broker2.example", "front.example"})
+			So(transport.hosts, ShouldContain, "broker3.example")
+
+			// Fails if every broker fails, with the last error.
+			transport.status["front.example"] = http.StatusBadRequest
+			transport.requests = nil
+			answer, err = b.Negotiate(fakeOffer)
+			So(answer, ShouldBeNil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldResemble, BrokerError503)
+			So(errors.Is(err, ErrBrokerUnavailable), ShouldBeTrue)
+			So(len(transport.requests), ShouldEqual, 3)
+		})
+
+		Convey("BrokerChannel.Negotiate rendezvouses through an AMP cache", func() {
+			transport := &AMPTransport{
+				answer:  `{"type":"answer","sdp":"fake"}`,
+				natType: nat.NATRestricted,
+			}
+			b, err := NewBrokerChannel("https://broker.example/", "", transport, false)
+			So(err, ShouldBeNil)
+			b.AMPCache, err = url.Parse("https://cdn.ampproject.org/")
+			So(err, ShouldBeNil)
+			answer, natType, err := b.NegotiateNAT(fakeOffer)
+			So(err, ShouldBeNil)
+			So(answer.SDP, ShouldResemble, "fake")
+			So(natType, ShouldEqual, nat.NATRestricted)
+			So(len(transport.requests), ShouldEqual, 1)
+			req := transport.requests[0]
+			So(req.Method, ShouldEqual, "GET")
+			So(req.URL.Host, ShouldEqual, "broker-example.cdn.ampproject.org")
+			So(strings.HasPrefix(req.URL.Path, "/c/s/broker.example/amp/client/unknown/"), ShouldBeTrue)
+			So(req.URL.Query().Get("nonce"), ShouldNotEqual, "")
+
+			// A front hides the cache, as it would the broker.
+			transport.requests = nil
+			b, err = NewBrokerChannel("https://broker.example/", "www.google.com", transport, false)
+			So(err, ShouldBeNil)
+			b.AMPCache, _ = url.Parse("https://cdn.ampproject.org/")
+			_, err = b.Negotiate(fakeOffer)
+			So(err, ShouldBeNil)
+			req = transport.requests[0]
+			So(req.URL.Host, ShouldEqual, "www.google.com")
+			So(req.Host, ShouldEqual, "broker-example.cdn.ampproject.org")
+			So(strings.HasPrefix(req.URL.Path, "/c/s/broker.example/"), ShouldBeTrue)
+
+			// An answer with the nonce of another offer is rejected.
+			transport.nonce = "0123abcd"
+			_, err = b.Negotiate(fakeOffer)
+			So(errors.Is(err, ErrBrokerStaleAnswer), ShouldBeTrue)
+			transport.nonce = ""
+
+			// Errors from the broker come in the body.
+			transport.errorMsg = messages.AMPErrorNoProxies
+			answer, err = b.Negotiate(fakeOffer)
+			So(answer, ShouldBeNil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldResemble, BrokerError503)
+			So(errors.Is(err, ErrBrokerUnavailable), ShouldBeTrue)
+		})
+
 		Convey("BrokerChannel.Negotiate fails with unexpected error", func() {
 			b, err := NewBrokerChannel("test.broker", "",
 				&MockTransport{123, []byte("")}, false)
@@ -263,7 +1177,54 @@ func TestSnowflakeClient(t *testing.T) {
 			So(err, ShouldNotBeNil)
 			So(answer, ShouldBeNil)
 			So(err.Error(), ShouldResemble, BrokerErrorUnexpected)
+			So(errors.Is(err, ErrBrokerUnexpected), ShouldBeTrue)
 		})
 	})
 
+	Convey("Broker transport", t, func() {
+		Convey("doesn't change http.DefaultTransport", func() {
+			CreateBrokerTransport()
+			So(http.DefaultTransport.(*http.Transport).Proxy, ShouldNotBeNil)
+			So(http.DefaultTransport.(*http.Transport).ResponseHeaderTimeout, ShouldEqual, 0)
+		})
+
+		Convey("reuses a connection over HTTP/2, with a fronted Host", func() {
+			var lock sync.Mutex
+			var conns int
+			var hosts []string
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				hosts = append(hosts, r.Host)
+				lock.Unlock()
+			}))
+			server.EnableHTTP2 = true
+			server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					lock.Lock()
+					conns++
+					lock.Unlock()
+				}
+			}
+			server.StartTLS()
+			defer server.Close()
+
+			transport := CreateBrokerTransport().(*http.Transport)
+			transport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+			defer transport.CloseIdleConnections()
+			for i := 0; i < 3; i++ {
+				req, err := http.NewRequest("GET", server.URL, nil)
+				So(err, ShouldBeNil)
+				req.Host = "broker.example"
+				resp, err := transport.RoundTrip(req)
+				So(err, ShouldBeNil)
+				So(resp.Proto, ShouldEqual, "HTTP/2.0")
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			So(conns, ShouldEqual, 1)
+			So(hosts, ShouldResemble, []string{"broker.example", "broker.example", "broker.example"})
+		})
+	})
 }
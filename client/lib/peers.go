@@ -2,12 +2,16 @@ package lib
 
 import (
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"sync"
 )
 
+// Returned by Collect when there are already as many peers as the Tongue allows.
+var errAtCapacity = errors.New("At capacity")
+
 // Container which keeps track of multiple WebRTC remote peers.
 // Implements |SnowflakeCollector|.
 //
@@ -28,7 +32,18 @@ type Peers struct {
 
 	melt   chan struct{}
 	melted bool
+	// Cancels snowflakes being caught when End is called, if the Tongue
+	// is a |ContextTongue|.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// The most recent error from catching a snowflake.
+	lastError error
 
+	// Synchronizes melted, activePeers, and lastError, so that once End has
+	// begun no new collection starts and no collected peer is added to
+	// activePeers.
+	lock       sync.Mutex
 	collection sync.WaitGroup
 }
 
@@ -42,6 +57,7 @@ func NewPeers(tongue Tongue) (*Peers, error) {
 	p.snowflakeChan = make(chan *WebRTCPeer, tongue.GetMax())
 	p.activePeers = list.New()
 	p.melt = make(chan struct{})
+	p.ctx, p.cancel = context.WithCancel(context.Background())
 	p.Tongue = tongue
 	return p, nil
 }
@@ -49,11 +65,14 @@ func NewPeers(tongue Tongue) (*Peers, error) {
 // As part of |SnowflakeCollector| interface.
 func (p *Peers) Collect() (*WebRTCPeer, error) {
 	// Engage the Snowflake Catching interface, which must be available.
-	p.collection.Add(1)
-	defer p.collection.Done()
+	p.lock.Lock()
 	if p.melted {
+		p.lock.Unlock()
 		return nil, fmt.Errorf("Snowflakes have melted")
 	}
+	p.collection.Add(1)
+	p.lock.Unlock()
+	defer p.collection.Done()
 	if nil == p.Tongue {
 		return nil, errors.New("missing Tongue to catch Snowflakes with")
 	}
@@ -61,15 +80,31 @@ func (p *Peers) Collect() (*WebRTCPeer, error) {
 	capacity := p.Tongue.GetMax()
 	s := fmt.Sprintf("Currently at [%d/%d]", cnt, capacity)
 	if cnt >= capacity {
-		return nil, fmt.Errorf("At capacity [%d/%d]", cnt, capacity)
+		return nil, fmt.Errorf("%w [%d/%d]", errAtCapacity, cnt, capacity)
 	}
 	log.Println("WebRTC: Collecting a new Snowflake.", s)
 	// BUG: some broker conflict here.
-	connection, err := p.Tongue.Catch()
+	var connection *WebRTCPeer
+	var err error
+	if t, ok := p.Tongue.(ContextTongue); ok {
+		connection, err = t.CatchContext(p.ctx)
+	} else {
+		connection, err = p.Tongue.Catch()
+	}
 	if nil != err {
+		p.lock.Lock()
+		p.lastError = err
+		p.lock.Unlock()
 		return nil, err
 	}
-	// Track new valid Snowflake in internal collection and pass along.
+	// Track new valid Snowflake in internal collection and pass along, unless
+	// End began while it was being caught.
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.melted {
+		connection.Close()
+		return nil, fmt.Errorf("Snowflakes have melted")
+	}
 	p.activePeers.PushBack(connection)
 	p.snowflakeChan <- connection
 	return connection, nil
@@ -101,10 +136,20 @@ func (p *Peers) Melted() <-chan struct{} {
 // The count only reduces when connections themselves close, rather than when
 // they are popped.
 func (p *Peers) Count() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	p.purgeClosedPeers()
 	return p.activePeers.Len()
 }
 
+// Returns the most recent error from catching a snowflake, or nil if there
+// hasn't been one.
+func (p *Peers) LastError() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.lastError
+}
+
 func (p *Peers) purgeClosedPeers() {
 	for e := p.activePeers.Front(); e != nil; {
 		next := e.Next()
@@ -119,11 +164,16 @@ func (p *Peers) purgeClosedPeers() {
 
 // Close all Peers contained here.
 func (p *Peers) End() {
+	p.lock.Lock()
 	close(p.melt)
 	p.melted = true
+	p.lock.Unlock()
+	// Stop any snowflake still being caught, rather than waiting for it.
+	p.cancel()
 	p.collection.Wait()
 	close(p.snowflakeChan)
 	cnt := p.Count()
+	p.lock.Lock()
 	for e := p.activePeers.Front(); e != nil; {
 		next := e.Next()
 		conn := e.Value.(*WebRTCPeer)
@@ -131,5 +181,6 @@ func (p *Peers) End() {
 		p.activePeers.Remove(e)
 		e = next
 	}
+	p.lock.Unlock()
 	log.Printf("WebRTC: melted all %d snowflakes.", cnt)
 }
@@ -1,24 +1,36 @@
 // WebRTC rendezvous requires the exchange of SessionDescriptions between
 // peers in order to establish a PeerConnection.
 //
-// This file contains the one method currently available to Snowflake:
+// This file contains the methods currently available to Snowflake:
 //
 // - Domain-fronted HTTP signaling. The Broker automatically exchange offers
-//   and answers between this client and some remote WebRTC proxy.
+//   and answers between this client and some remote WebRTC proxy. Several
+//   brokers may be given, to be tried in turn.
+//
+// - AMP cache rendezvous (rendezvous_amp.go), which reaches the Broker
+//   through an AMP cache instead of directly.
 
 package lib
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"git.torproject.org/pluggable-transports/snowflake.git/common/messages"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/util"
 	"github.com/pion/webrtc/v3"
@@ -31,25 +43,159 @@ const (
 	readLimit                    = 100000 //Maximum number of bytes to be read from an HTTP response
 )
 
-// Signalling Channel to the Broker.
-type BrokerChannel struct {
+// How long to wait for a TCP connection to the broker, and how long an idle
+// connection to it is kept for reuse.
+const (
+	brokerDialTimeout     = 30 * time.Second
+	brokerIdleConnTimeout = 90 * time.Second
+)
+
+// How long to wait for the broker to respond to an offer, unless the
+// BrokerChannel's Timeout says otherwise. The broker may take up to its client
+// timeout (-client-timeout, 10 seconds by default) to match the offer with a
+// proxy and get its answer, so this must be longer than that.
+const DefaultBrokerTimeout = 30 * time.Second
+
+// The errors that negotiation with a broker may end in, for use with
+// errors.Is. Their messages are the Broker* strings above.
+var (
+	// The broker has no proxies to match with.
+	ErrBrokerUnavailable = errors.New(BrokerError503)
+	// The broker rejected the offer.
+	ErrBrokerBadRequest = errors.New(BrokerError400)
+	// The broker answered, but not with an answer or a known error.
+	ErrBrokerUnexpected = errors.New(BrokerErrorUnexpected)
+	// The broker could not be reached, or the request to it failed.
+	ErrBrokerUnreachable = errors.New("could not reach the broker")
+	// The broker's answer was for another offer, or was one it had
+	// already given.
+	ErrBrokerStaleAnswer = errors.New("broker answer is not for this offer")
+)
+
+// Returned when the broker has no answer and asks, in a Retry-After header,
+// that the client wait before sending another offer. It wraps one of the
+// ErrBroker* errors.
+type BrokerRetryError struct {
+	err        error
+	RetryAfter time.Duration
+}
+
+func (e *BrokerRetryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *BrokerRetryError) Unwrap() error {
+	return e.err
+}
+
+// Returns err, wrapped in a *BrokerRetryError if resp has a Retry-After header
+// giving a number of seconds.
+func brokerError(err error, resp *http.Response) error {
+	seconds, atoiErr := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if atoiErr != nil || seconds < 0 {
+		return err
+	}
+	return &BrokerRetryError{err: err, RetryAfter: time.Duration(seconds) * time.Second}
+}
+
+// A failure to make a request to the broker. It keeps the message of the
+// underlying error, and satisfies errors.Is(err, ErrBrokerUnreachable).
+type brokerUnreachableError struct {
+	err error
+}
+
+func (e *brokerUnreachableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *brokerUnreachableError) Unwrap() error {
+	return e.err
+}
+
+func (e *brokerUnreachableError) Is(target error) bool {
+	return target == ErrBrokerUnreachable
+}
+
+// Returns how long the broker asked to wait before the next offer, if err
+// says, or else 0.
+func brokerRetryAfter(err error) time.Duration {
+	var retry *BrokerRetryError
+	if errors.As(err, &retry) {
+		return retry.RetryAfter
+	}
+	return 0
+}
+
+// Whether to log the full SDP of answers from the broker, which has the
+// candidate addresses of the proxy. Otherwise only a summary is logged. The
+// client sets it with -unsafe-logging.
+var LogFullSDP bool
+
+// The certificate fingerprint is of no use in a log, so it is left out even of
+// a full SDP.
+var logScrubPolicy = util.ScrubPolicy{RedactFingerprints: true}
+
+func logAnswer(answer *webrtc.SessionDescription) {
+	if LogFullSDP {
+		log.Printf("Received answer: %s", util.ScrubSDP(answer.SDP, logScrubPolicy))
+		return
+	}
+	log.Printf("Received answer: %d bytes, %d candidates",
+		len(answer.SDP), strings.Count(answer.SDP, "a=candidate:"))
+}
+
+// A broker to rendezvous through.
+type brokerEndpoint struct {
 	// The Host header to put in the HTTP request (optional and may be
 	// different from the host name in URL).
-	Host               string
-	url                *url.URL
+	host string
+	url  *url.URL
+}
+
+// Signalling Channel to the Broker. A BrokerChannel may have several brokers,
+// which it tries in turn until one answers.
+type BrokerChannel struct {
+	brokers []*brokerEndpoint
+	// Index in brokers of the broker that last answered, and the first to
+	// try next time.
+	current            int
 	transport          http.RoundTripper // Used to make all requests.
 	keepLocalAddresses bool
 	NATType            string
-	lock               sync.Mutex
+	// Whether to remove non-essential attributes from offers.
+	MinifySDP bool
+	// If not nil, the AMP cache to rendezvous through, instead of sending
+	// offers to the broker directly.
+	AMPCache *url.URL
+	// How long to wait for the broker to respond to an offer, or 0 to wait
+	// as long as the caller's context allows. It must be longer than the
+	// broker's client timeout.
+	Timeout time.Duration
+	// Round-trip time of the last successful negotiation.
+	rtt time.Duration
+	// The ice-ufrag of the last answer, so that the same answer given
+	// again can be rejected.
+	lastUfrag string
+	lock      sync.Mutex
 }
 
 // We make a copy of DefaultTransport because we want the default Dial
 // and TLSHandshakeTimeout settings. But we want to disable the default
-// ProxyFromEnvironment setting.
+// ProxyFromEnvironment setting. Connections to the broker (or its front) are
+// kept alive and reused between rendezvous, over HTTP/2 where the front
+// supports it; the Host of each request still names the broker, so reuse
+// doesn't get in the way of domain fronting.
 func CreateBrokerTransport() http.RoundTripper {
-	transport := http.DefaultTransport.(*http.Transport)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
 	transport.Proxy = nil
-	transport.ResponseHeaderTimeout = 15 * time.Second
+	transport.DialContext = (&net.Dialer{
+		Timeout:   brokerDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConnsPerHost = 2
+	transport.IdleConnTimeout = brokerIdleConnTimeout
+	transport.TLSHandshakeTimeout = 10 * time.Second
 	return transport
 }
 
@@ -57,25 +203,39 @@ func CreateBrokerTransport() http.RoundTripper {
 // |broker| is the full URL of the facilitating program which assigns proxies
 // to clients, and |front| is the option fronting domain.
 func NewBrokerChannel(broker string, front string, transport http.RoundTripper, keepLocalAddresses bool) (*BrokerChannel, error) {
-	targetURL, err := url.Parse(broker)
+	bc := new(BrokerChannel)
+	err := bc.AddBroker(broker, front)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("Rendezvous using Broker at:", broker)
-	bc := new(BrokerChannel)
-	bc.url = targetURL
-	if front != "" { // Optional front domain.
-		log.Println("Domain fronting using:", front)
-		bc.Host = bc.url.Host
-		bc.url.Host = front
-	}
 
 	bc.transport = transport
 	bc.keepLocalAddresses = keepLocalAddresses
 	bc.NATType = nat.NATUnknown
+	bc.Timeout = DefaultBrokerTimeout
 	return bc, nil
 }
 
+// Adds another broker, with an optional fronting domain, to be tried if the
+// ones before it fail.
+func (bc *BrokerChannel) AddBroker(broker string, front string) error {
+	targetURL, err := url.Parse(broker)
+	if err != nil {
+		return err
+	}
+	log.Println("Rendezvous using Broker at:", broker)
+	b := &brokerEndpoint{url: targetURL}
+	if front != "" { // Optional front domain.
+		log.Println("Domain fronting using:", front)
+		b.host = b.url.Host
+		b.url.Host = front
+	}
+	bc.lock.Lock()
+	bc.brokers = append(bc.brokers, b)
+	bc.lock.Unlock()
+	return nil
+}
+
 func limitedRead(r io.Reader, limit int64) ([]byte, error) {
 	p, err := ioutil.ReadAll(&io.LimitedReader{R: r, N: limit + 1})
 	if err != nil {
@@ -89,62 +249,247 @@ func limitedRead(r io.Reader, limit int64) ([]byte, error) {
 // Roundtrip HTTP POST using WebRTC SessionDescriptions.
 //
 // Send an SDP offer to the broker, which assigns a proxy and responds
-// with an SDP answer from a designated remote WebRTC peer.
+// with an SDP answer from a designated remote WebRTC peer. If there are
+// several brokers, each is tried in turn, starting from the one that last
+// answered, until one returns an answer.
 func (bc *BrokerChannel) Negotiate(offer *webrtc.SessionDescription) (
 	*webrtc.SessionDescription, error) {
-	log.Println("Negotiating via BrokerChannel...\nTarget URL: ",
-		bc.Host, "\nFront URL:  ", bc.url.Host)
+	answer, _, err := bc.NegotiateNAT(offer)
+	return answer, err
+}
+
+// Like Negotiate, but also returns the NAT type of the proxy that answered, as
+// reported by the broker, or NATUnknown if the broker doesn't say.
+func (bc *BrokerChannel) NegotiateNAT(offer *webrtc.SessionDescription) (
+	*webrtc.SessionDescription, string, error) {
+	return bc.NegotiateNATContext(context.Background(), offer)
+}
+
+// Like NegotiateNAT, but gives up when ctx is done.
+func (bc *BrokerChannel) NegotiateNATContext(ctx context.Context, offer *webrtc.SessionDescription) (
+	*webrtc.SessionDescription, string, error) {
 	// Ideally, we could specify an `RTCIceTransportPolicy` that would handle
 	// this for us.  However, "public" was removed from the draft spec.
 	// See https://developer.mozilla.org/en-US/docs/Web/API/RTCConfiguration#RTCIceTransportPolicy_enum
-	if !bc.keepLocalAddresses {
+	policy := util.ScrubPolicy{
+		StripLocalCandidates: !bc.keepLocalAddresses,
+		Normalize:            bc.MinifySDP,
+	}
+	if policy != (util.ScrubPolicy{}) {
 		offer = &webrtc.SessionDescription{
 			Type: offer.Type,
-			SDP:  util.StripLocalAddresses(offer.SDP),
+			SDP:  util.ScrubSDP(offer.SDP, policy),
 		}
 	}
 	offerSDP, err := util.SerializeSessionDescription(offer)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	bc.lock.Lock()
+	brokers := bc.brokers
+	start := bc.current
+	natType := bc.NATType
+	bc.lock.Unlock()
+	if len(brokers) == 0 {
+		return nil, "", errors.New("no broker to rendezvous with")
 	}
+
+	for i := 0; i < len(brokers); i++ {
+		n := (start + i) % len(brokers)
+		var answer *webrtc.SessionDescription
+		var proxyNATType string
+		startTime := time.Now()
+		answer, proxyNATType, err = bc.negotiate(ctx, brokers[n], offerSDP, natType)
+		if err == nil && !bc.isNewAnswer(answer) {
+			log.Println("Broker gave an answer it had given before.")
+			err = ErrBrokerStaleAnswer
+		}
+		if err == nil {
+			rtt := time.Since(startTime)
+			log.Printf("Broker RTT: %v", rtt.Round(time.Millisecond))
+			Summary.AddBrokerRTT(rtt)
+			bc.lock.Lock()
+			bc.rtt = rtt
+			if n != start {
+				log.Println("Switching to Broker at:", brokers[n].url.Host)
+				bc.current = n
+			}
+			bc.lock.Unlock()
+			return answer, proxyNATType, nil
+		}
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		if len(brokers) > 1 {
+			log.Printf("Broker at %s failed: %v", brokers[n].url.Host, err)
+		}
+	}
+	return nil, "", err
+}
+
+// Records answer as the last one received, and returns whether it differs from
+// the one before. Every real answer has a new ice-ufrag; an answer without one
+// is left for util.CheckAnswer to reject.
+func (bc *BrokerChannel) isNewAnswer(answer *webrtc.SessionDescription) bool {
+	ufrag := util.ICEUfrag(answer.SDP)
+	if ufrag == "" {
+		return true
+	}
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	if ufrag == bc.lastUfrag {
+		return false
+	}
+	bc.lastUfrag = ufrag
+	return true
+}
+
+// Returns a random string to send with an offer, for the broker to echo with
+// the answer.
+func newNonce() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// Checks the nonce that the broker echoed with an answer against the one sent
+// with the offer. Brokers that don't echo nonces send back an empty one.
+func checkNonce(sent, echoed string) error {
+	if echoed != "" && echoed != sent {
+		log.Println("Broker answered with the nonce of another offer.")
+		return ErrBrokerStaleAnswer
+	}
+	return nil
+}
+
+// Sends a serialized offer to a single broker.
+func (bc *BrokerChannel) negotiate(ctx context.Context, b *brokerEndpoint, offerSDP string, natType string) (
+	*webrtc.SessionDescription, string, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, "", err
+	}
+	if bc.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bc.Timeout)
+		defer cancel()
+	}
+	if bc.AMPCache != nil {
+		return bc.negotiateAMP(ctx, b, offerSDP, natType, nonce)
+	}
+	log.Println("Negotiating via BrokerChannel...\nTarget URL: ",
+		b.host, "\nFront URL:  ", b.url.Host)
 	data := bytes.NewReader([]byte(offerSDP))
 	// Suffix with broker's client registration handler.
-	clientURL := bc.url.ResolveReference(&url.URL{Path: "client"})
+	clientURL := b.url.ResolveReference(&url.URL{Path: "client"})
 	request, err := http.NewRequest("POST", clientURL.String(), data)
 	if nil != err {
-		return nil, err
+		return nil, "", err
 	}
-	if "" != bc.Host { // Set true host if necessary.
-		request.Host = bc.Host
+	request = request.WithContext(ctx)
+	if "" != b.host { // Set true host if necessary.
+		request.Host = b.host
 	}
 	// include NAT-TYPE
-	bc.lock.Lock()
-	request.Header.Set("Snowflake-NAT-TYPE", bc.NATType)
-	bc.lock.Unlock()
+	request.Header.Set("Snowflake-NAT-TYPE", natType)
+	request.Header.Set(messages.NonceHeader, nonce)
 	resp, err := bc.transport.RoundTrip(request)
 	if nil != err {
-		return nil, err
+		return nil, "", &brokerUnreachableError{err}
 	}
 	defer resp.Body.Close()
 	log.Printf("BrokerChannel Response:\n%s\n\n", resp.Status)
 
 	switch resp.StatusCode {
 	case http.StatusOK:
+		if err := checkNonce(nonce, resp.Header.Get(messages.NonceHeader)); err != nil {
+			return nil, "", err
+		}
 		body, err := limitedRead(resp.Body, readLimit)
 		if nil != err {
-			return nil, err
+			return nil, "", err
 		}
-		log.Printf("Received answer: %s", string(body))
-		return util.DeserializeSessionDescription(string(body))
+		answer, err := util.DeserializeSessionDescription(string(body))
+		if err != nil {
+			return nil, "", err
+		}
+		logAnswer(answer)
+		// Older brokers don't report the proxy's NAT type.
+		proxyNATType := resp.Header.Get("Snowflake-NAT-Type")
+		if proxyNATType == "" {
+			proxyNATType = nat.NATUnknown
+		}
+		return answer, proxyNATType, nil
 	case http.StatusServiceUnavailable:
-		return nil, errors.New(BrokerError503)
+		return nil, "", brokerError(ErrBrokerUnavailable, resp)
 	case http.StatusBadRequest:
-		return nil, errors.New(BrokerError400)
+		return nil, "", ErrBrokerBadRequest
+	case http.StatusGatewayTimeout:
+		return nil, "", brokerError(ErrBrokerUnexpected, resp)
 	default:
-		return nil, errors.New(BrokerErrorUnexpected)
+		return nil, "", ErrBrokerUnexpected
 	}
 }
 
+// Asks the broker that last answered how many proxies are waiting for a
+// client, and the estimated wait for a match. This is cheaper for the broker
+// than an offer, and doesn't need one.
+func (bc *BrokerChannel) Status() (int, time.Duration, error) {
+	if bc.AMPCache != nil {
+		return 0, 0, errors.New("broker status is not available through an AMP cache")
+	}
+	bc.lock.Lock()
+	if len(bc.brokers) == 0 {
+		bc.lock.Unlock()
+		return 0, 0, errors.New("no broker to rendezvous with")
+	}
+	b := bc.brokers[bc.current]
+	bc.lock.Unlock()
+
+	statusURL := b.url.ResolveReference(&url.URL{Path: "status"})
+	request, err := http.NewRequest("GET", statusURL.String(), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if b.host != "" {
+		request.Host = b.host
+	}
+	resp, err := bc.transport.RoundTrip(request)
+	if err != nil {
+		return 0, 0, &brokerUnreachableError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("broker status: %s", resp.Status)
+	}
+	body, err := limitedRead(resp.Body, readLimit)
+	if err != nil {
+		return 0, 0, err
+	}
+	proxies, wait, err := messages.DecodeClientStatusResponse(body)
+	if err != nil {
+		return 0, 0, err
+	}
+	return proxies, time.Duration(wait) * time.Second, nil
+}
+
+// Returns the round-trip time of the last successful negotiation, from sending
+// the offer to receiving the answer, or 0 if there has been none.
+func (bc *BrokerChannel) RTT() time.Duration {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return bc.rtt
+}
+
+func (bc *BrokerChannel) getNATType() string {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return bc.NATType
+}
+
 func (bc *BrokerChannel) SetNATType(NATType string) {
 	bc.lock.Lock()
 	bc.NATType = NATType
@@ -152,30 +497,85 @@ func (bc *BrokerChannel) SetNATType(NATType string) {
 	log.Printf("NAT Type: %s", NATType)
 }
 
-// Implements the |Tongue| interface to catch snowflakes, using BrokerChannel.
+// Implements the |Tongue| interface to catch snowflakes, using a Rendezvous
+// such as BrokerChannel.
 type WebRTCDialer struct {
-	*BrokerChannel
+	Rendezvous   Rendezvous
 	webrtcConfig *webrtc.Configuration
 	max          int
+	// How the snowflakes caught combine small writes. Off by default.
+	Coalesce CoalesceConfig
+	// Whether to ask the broker for its status before each offer, and not
+	// make one when it has no proxies. Only for a Rendezvous that has a
+	// Status method, like BrokerChannel.
+	CheckStatus bool
+	// The ordering and reliability of the snowflakes' DataChannels.
+	// Ordered and reliable by default.
+	DataChannel DataChannelConfig
+	// If not nil, which of the ICE servers to use, instead of all of them.
+	ICEServerHealth *ICEServerHealth
 }
 
-func NewWebRTCDialer(broker *BrokerChannel, iceServers []webrtc.ICEServer, max int) *WebRTCDialer {
+func NewWebRTCDialer(rendezvous Rendezvous, iceServers []webrtc.ICEServer, max int) *WebRTCDialer {
 	config := webrtc.Configuration{
 		ICEServers: iceServers,
 	}
 
 	return &WebRTCDialer{
-		BrokerChannel: broker,
-		webrtcConfig:  &config,
-		max:           max,
+		Rendezvous:   rendezvous,
+		webrtcConfig: &config,
+		max:          max,
+	}
+}
+
+// Returns a copy of the dialer that uses other ICE servers, and the same
+// rendezvous.
+func (w *WebRTCDialer) WithICEServers(iceServers []webrtc.ICEServer) *WebRTCDialer {
+	d := *w
+	d.webrtcConfig = &webrtc.Configuration{
+		ICEServers: iceServers,
 	}
+	// The health of the default servers says nothing about these.
+	d.ICEServerHealth = nil
+	return &d
+}
+
+func (w *WebRTCDialer) ICEServers() []webrtc.ICEServer {
+	return w.webrtcConfig.ICEServers
 }
 
-// Initialize a WebRTC Connection by signaling through the broker.
+// Initialize a WebRTC Connection by signaling through the rendezvous.
 func (w WebRTCDialer) Catch() (*WebRTCPeer, error) {
+	return w.CatchContext(context.Background())
+}
+
+// Like Catch, but gives up, closing the half-made peer, when ctx is done.
+// Implements |ContextTongue|.
+func (w WebRTCDialer) CatchContext(ctx context.Context) (*WebRTCPeer, error) {
 	// TODO: [#25591] Fetch ICE server information from Broker.
 	// TODO: [#25596] Consider TURN servers here too.
-	return NewWebRTCPeer(w.webrtcConfig, w.BrokerChannel)
+	status, canStatus := w.Rendezvous.(interface {
+		Status() (int, time.Duration, error)
+	})
+	if w.CheckStatus && canStatus {
+		proxies, wait, err := status.Status()
+		if err != nil {
+			// Make the offer anyway; the broker may not serve status.
+			log.Printf("Broker status failed: %v", err)
+		} else if proxies == 0 {
+			return nil, &BrokerRetryError{err: ErrBrokerUnavailable, RetryAfter: wait}
+		}
+	}
+	config := w.webrtcConfig
+	if w.ICEServerHealth != nil {
+		config = &webrtc.Configuration{ICEServers: w.ICEServerHealth.Servers()}
+	}
+	peer, err := NewWebRTCPeerWithOptions(ctx, config, w.Rendezvous, w.DataChannel)
+	if err != nil {
+		return nil, err
+	}
+	peer.coalesce = w.Coalesce
+	return peer, nil
 }
 
 // Returns the maximum number of snowflakes to collect
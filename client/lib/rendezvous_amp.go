@@ -0,0 +1,89 @@
+// AMP cache rendezvous. Instead of sending its offer to the broker, the client
+// asks an AMP cache for a page of the broker whose URL encodes the offer. The
+// cache fetches the page from the broker, which returns the answer armored in
+// an AMP document. The request to the cache may itself be domain fronted.
+
+package lib
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/common/amp"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/messages"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/util"
+	"github.com/pion/webrtc/v3"
+)
+
+// Sends a serialized offer to a single broker, through the AMP cache at
+// bc.AMPCache. The nonce goes in the query string, and also makes the URL
+// unique, so that the cache can't serve the answer to an earlier offer.
+func (bc *BrokerChannel) negotiateAMP(ctx context.Context, b *brokerEndpoint, offerSDP string, natType string,
+	nonce string) (*webrtc.SessionDescription, string, error) {
+	// The cache must fetch from the broker itself, not from the front.
+	brokerURL := *b.url
+	if b.host != "" {
+		brokerURL.Host = b.host
+	}
+	pubURL := brokerURL.ResolveReference(&url.URL{
+		Path: "amp/client/" + url.PathEscape(natType) + "/" +
+			base64.RawURLEncoding.EncodeToString([]byte(offerSDP)),
+		RawQuery: url.Values{"nonce": {nonce}}.Encode(),
+	})
+	cacheURL, err := amp.CacheURL(pubURL, bc.AMPCache, "c")
+	if err != nil {
+		return nil, "", err
+	}
+	log.Println("Negotiating via AMP cache...\nTarget URL: ",
+		brokerURL.Host, "\nCache URL:  ", cacheURL.Host)
+
+	request, err := http.NewRequest("GET", cacheURL.String(), nil)
+	if nil != err {
+		return nil, "", err
+	}
+	request = request.WithContext(ctx)
+	if "" != b.host { // Front the request to the cache too.
+		request.URL.Host = b.url.Host
+		request.Host = cacheURL.Host
+	}
+	resp, err := bc.transport.RoundTrip(request)
+	if nil != err {
+		return nil, "", &brokerUnreachableError{err}
+	}
+	defer resp.Body.Close()
+	log.Printf("AMP cache Response:\n%s\n\n", resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", ErrBrokerUnexpected
+	}
+
+	// Armoring roughly doubles the size of the broker's message.
+	body, err := amp.Dearmor(resp.Body, 2*readLimit)
+	if err != nil {
+		return nil, "", err
+	}
+	answerSDP, proxyNATType, echoedNonce, errorMessage, err := messages.DecodeAMPClientResponse(body)
+	if err != nil {
+		return nil, "", err
+	}
+	switch errorMessage {
+	case "":
+	case messages.AMPErrorNoProxies:
+		return nil, "", ErrBrokerUnavailable
+	case messages.AMPErrorBadOffer:
+		return nil, "", ErrBrokerBadRequest
+	default:
+		return nil, "", ErrBrokerUnexpected
+	}
+	if err := checkNonce(nonce, echoedNonce); err != nil {
+		return nil, "", err
+	}
+	answer, err := util.DeserializeSessionDescription(answerSDP)
+	if err != nil {
+		return nil, "", err
+	}
+	logAnswer(answer)
+	return answer, proxyNATType, nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"time"
 
@@ -18,8 +19,23 @@ const (
 	SnowflakeTimeout = 20 * time.Second
 	// How long to wait for the OnOpen callback on a DataChannel.
 	DataChannelTimeout = 10 * time.Second
+	// How many received messages may wait for the SOCKS side to read them
+	// before a WebRTCPeer gives up on it and closes.
+	RecvQueueSize = 1024
 )
 
+// The bounds of the exponential backoff between failed attempts to collect a
+// snowflake. After a success, the next attempt waits ReconnectBackoffBase.
+var (
+	ReconnectBackoffBase = ReconnectTimeout
+	ReconnectBackoffMax  = 5 * time.Minute
+)
+
+// How long to wait for ICE candidate gathering to complete before making an
+// offer with the candidates gathered so far. Gathering may never complete
+// when STUN servers are blocked.
+var ICEGatheringTimeout = 10 * time.Second
+
 type dummyAddr struct{}
 
 func (addr dummyAddr) Network() string { return "dummy" }
@@ -36,6 +52,7 @@ func newSession(snowflakes SnowflakeCollector) (net.PacketConn, *smux.Session, e
 	// WebRTC connection when the previous one dies. Inside each WebRTC
 	// connection, we use EncapsulationPacketConn to encode packets into a
 	// stream.
+	dialed := false
 	dialContext := func(ctx context.Context) (net.PacketConn, error) {
 		log.Printf("redialing on same connection")
 		// Obtain an available WebRTC remote. May block.
@@ -44,6 +61,11 @@ func newSession(snowflakes SnowflakeCollector) (net.PacketConn, *smux.Session, e
 			return nil, errors.New("handler: Received invalid Snowflake")
 		}
 		log.Println("---- Handler: snowflake assigned ----")
+		Summary.AddSnowflake()
+		if dialed {
+			Summary.AddReconnect()
+		}
+		dialed = true
 		// Send the magic Turbo Tunnel token.
 		_, err := conn.Write(turbotunnel.Token[:])
 		if err != nil {
@@ -103,8 +125,9 @@ func Handler(socks net.Conn, tongue Tongue) error {
 		return err
 	}
 
-	// Use a real logger to periodically output how much traffic is happening.
-	snowflakes.BytesLogger = NewBytesSyncLogger()
+	// Use a real logger to periodically output how much traffic is happening,
+	// and add the traffic to the run summary.
+	snowflakes.BytesLogger = multiBytesLogger{newBytesSyncLogger(snowflakes), Summary}
 
 	log.Printf("---- Handler: begin collecting snowflakes ---")
 	go connectLoop(snowflakes)
@@ -138,14 +161,18 @@ func Handler(socks net.Conn, tongue Tongue) error {
 // Maintain |SnowflakeCapacity| number of available WebRTC connections, to
 // transfer to the Tor SOCKS handler when needed.
 func connectLoop(snowflakes SnowflakeCollector) {
+	b := &backoff{base: ReconnectBackoffBase, max: ReconnectBackoffMax}
 	for {
-		timer := time.After(ReconnectTimeout)
+		var delay time.Duration
 		_, err := snowflakes.Collect()
-		if err != nil {
-			log.Printf("WebRTC: %v  Retrying...", err)
+		if err != nil && !errors.Is(err, errAtCapacity) {
+			delay = b.failureAtLeast(brokerRetryAfter(err))
+			log.Printf("WebRTC: %v  Retrying in %v...", err, delay.Round(time.Second))
+		} else {
+			delay = b.success()
 		}
 		select {
-		case <-timer:
+		case <-time.After(delay):
 			continue
 		case <-snowflakes.Melted():
 			log.Println("ConnectLoop: stopped.")
@@ -154,6 +181,49 @@ func connectLoop(snowflakes SnowflakeCollector) {
 	}
 }
 
+// Exponential backoff with jitter. Each consecutive failure doubles the delay,
+// up to max, and a success resets it to base.
+type backoff struct {
+	base    time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+// Returns how long to wait after a success.
+func (b *backoff) success() time.Duration {
+	b.current = 0
+	return b.base
+}
+
+// Returns how long to wait after a failure: a random time between half the
+// current delay and all of it, so that clients that failed together don't
+// retry together.
+func (b *backoff) failure() time.Duration {
+	if b.current == 0 {
+		b.current = b.base
+	} else if b.current < b.max {
+		b.current *= 2
+	}
+	if b.current > b.max {
+		b.current = b.max
+	}
+	half := b.current / 2
+	return half + time.Duration(rand.Int63n(int64(b.current-half)+1))
+}
+
+// Like failure, but waits at least min, as when the broker asks for that long,
+// though never longer than max.
+func (b *backoff) failureAtLeast(min time.Duration) time.Duration {
+	delay := b.failure()
+	if min > delay {
+		delay = min
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	return delay
+}
+
 // Exchanges bytes between two ReadWriters.
 // (In this case, between a SOCKS connection and smux stream.)
 func copyLoop(socks, stream io.ReadWriter) {
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// RunSummary accumulates totals over the whole run of the client, across all
+// SOCKS sessions, to be reported when it shuts down.
+// Implements |BytesLogger|.
+type RunSummary struct {
+	// Accessed atomically, so kept first for 64-bit alignment.
+	inbound    int64
+	outbound   int64
+	snowflakes uint64
+	reconnects uint64
+	// Round trips to the broker, in nanoseconds.
+	brokerRTTs     uint64
+	brokerRTTTotal int64
+	lastBrokerRTT  int64
+
+	start time.Time
+}
+
+// The summary of the current run of the client.
+var Summary = NewRunSummary()
+
+func NewRunSummary() *RunSummary {
+	return &RunSummary{start: time.Now()}
+}
+
+// Records that a snowflake was assigned to a session.
+func (s *RunSummary) AddSnowflake() { atomic.AddUint64(&s.snowflakes, 1) }
+
+// Records that a session lost its snowflake and had to redial.
+func (s *RunSummary) AddReconnect() { atomic.AddUint64(&s.reconnects, 1) }
+
+// Records the round-trip time of a successful negotiation with the broker.
+func (s *RunSummary) AddBrokerRTT(rtt time.Duration) {
+	atomic.AddUint64(&s.brokerRTTs, 1)
+	atomic.AddInt64(&s.brokerRTTTotal, int64(rtt))
+	atomic.StoreInt64(&s.lastBrokerRTT, int64(rtt))
+}
+
+// Returns the round-trip time of the most recent successful negotiation with
+// the broker, or 0 if there has been none.
+func (s *RunSummary) LastBrokerRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.lastBrokerRTT))
+}
+
+func (s *RunSummary) AddOutbound(amount int) { atomic.AddInt64(&s.outbound, int64(amount)) }
+func (s *RunSummary) AddInbound(amount int)  { atomic.AddInt64(&s.inbound, int64(amount)) }
+
+func (s *RunSummary) summary(now time.Time) string {
+	str := fmt.Sprintf("Run summary: %v running, %d snowflakes used, %d reconnects, Traffic Bytes (in|out): %d | %d",
+		now.Sub(s.start).Round(time.Second),
+		atomic.LoadUint64(&s.snowflakes),
+		atomic.LoadUint64(&s.reconnects),
+		atomic.LoadInt64(&s.inbound),
+		atomic.LoadInt64(&s.outbound))
+	if n := atomic.LoadUint64(&s.brokerRTTs); n > 0 {
+		avg := time.Duration(atomic.LoadInt64(&s.brokerRTTTotal) / int64(n))
+		str += fmt.Sprintf(", Broker RTT avg: %v", avg.Round(time.Millisecond))
+	}
+	return str
+}
+
+func (s *RunSummary) String() string {
+	return s.summary(time.Now())
+}
+
+// Passes traffic counts on to each of several BytesLoggers.
+type multiBytesLogger []BytesLogger
+
+func (m multiBytesLogger) AddOutbound(amount int) {
+	for _, b := range m {
+		b.AddOutbound(amount)
+	}
+}
+
+func (m multiBytesLogger) AddInbound(amount int) {
+	for _, b := range m {
+		b.AddInbound(amount)
+	}
+}
@@ -1,7 +1,11 @@
 package lib
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"sync"
 	"time"
 )
 
@@ -9,6 +13,11 @@ const (
 	LogTimeInterval = 5 * time.Second
 )
 
+// How often each SOCKS connection logs a line of the traffic it has carried
+// since the last one. 0 or less means never. Set it before the client starts
+// handling connections.
+var SummaryInterval = LogTimeInterval
+
 type BytesLogger interface {
 	AddOutbound(int)
 	AddInbound(int)
@@ -20,32 +29,121 @@ type BytesNullLogger struct{}
 func (b BytesNullLogger) AddOutbound(amount int) {}
 func (b BytesNullLogger) AddInbound(amount int)  {}
 
+// Statistics for one LogTimeInterval of a SOCKS connection, in a form meant
+// for programs rather than people.
+type Stats struct {
+	Time        time.Time `json:"time"`
+	Inbound     int       `json:"inbound_bytes"`
+	Outbound    int       `json:"outbound_bytes"`
+	InEvents    int       `json:"inbound_events"`
+	OutEvents   int       `json:"outbound_events"`
+	ActivePeers int       `json:"active_peers"`
+	// The most recent error from connecting to a snowflake, if any.
+	LastError string `json:"last_error,omitempty"`
+	// Round-trip time of the most recent negotiation with the broker.
+	BrokerRTT float64 `json:"broker_rtt_ms,omitempty"`
+}
+
+// If not nil, called with the Stats of every SOCKS connection every
+// LogTimeInterval. Set it before the client starts handling connections.
+var StatsCallback func(Stats)
+
+// Writes Stats as JSON lines. Safe for use by concurrent connections.
+type StatsWriter struct {
+	enc  *json.Encoder
+	lock sync.Mutex
+}
+
+func NewStatsWriter(w io.Writer) *StatsWriter {
+	return &StatsWriter{enc: json.NewEncoder(w)}
+}
+
+func (s *StatsWriter) Write(stats Stats) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.enc.Encode(stats); err != nil {
+		log.Printf("error writing stats: %v", err)
+	}
+}
+
 // BytesSyncLogger uses channels to safely log from multiple sources with output
 // occuring at reasonable intervals.
 type BytesSyncLogger struct {
 	outboundChan chan int
 	inboundChan  chan int
+	// If not nil, where to get the peer count and last error for Stats.
+	peers *Peers
 }
 
 // NewBytesSyncLogger returns a new BytesSyncLogger and starts it loggin.
 func NewBytesSyncLogger() *BytesSyncLogger {
+	return newBytesSyncLogger(nil)
+}
+
+func newBytesSyncLogger(peers *Peers) *BytesSyncLogger {
 	b := &BytesSyncLogger{
 		outboundChan: make(chan int, 5),
 		inboundChan:  make(chan int, 5),
+		peers:        peers,
 	}
 	go b.log()
 	return b
 }
 
+// Counts of traffic over some interval.
+type trafficCounts struct {
+	inbound, outbound, inEvents, outEvents int
+}
+
+func (c trafficCounts) String() string {
+	return fmt.Sprintf("Traffic Bytes (in|out): %d | %d -- (%d OnMessages, %d Sends)",
+		c.inbound, c.outbound, c.inEvents, c.outEvents)
+}
+
 func (b *BytesSyncLogger) log() {
 	var outbound, inbound, outEvents, inEvents int
+	// Traffic since the last summary line, which has its own interval.
+	var sinceSummary trafficCounts
+	var summaryTicks <-chan time.Time
+	if SummaryInterval > 0 {
+		summaryTicker := time.NewTicker(SummaryInterval)
+		defer summaryTicker.Stop()
+		summaryTicks = summaryTicker.C
+	}
+	// Stats stop once the connection's peers have melted.
+	var melted <-chan struct{}
+	if b.peers != nil {
+		melted = b.peers.Melted()
+	}
+	ended := false
 	ticker := time.NewTicker(LogTimeInterval)
 	for {
 		select {
-		case <-ticker.C:
-			if outEvents > 0 || inEvents > 0 {
-				log.Printf("Traffic Bytes (in|out): %d | %d -- (%d OnMessages, %d Sends)",
-					inbound, outbound, inEvents, outEvents)
+		case <-melted:
+			ended = true
+			melted = nil
+		case <-summaryTicks:
+			if sinceSummary.outEvents > 0 || sinceSummary.inEvents > 0 {
+				log.Println(sinceSummary)
+			}
+			sinceSummary = trafficCounts{}
+		case now := <-ticker.C:
+			if callback := StatsCallback; callback != nil && !ended {
+				stats := Stats{
+					Time:      now.UTC(),
+					Inbound:   inbound,
+					Outbound:  outbound,
+					InEvents:  inEvents,
+					OutEvents: outEvents,
+					BrokerRTT: Summary.LastBrokerRTT().Seconds() * 1000,
+				}
+				if b.peers != nil {
+					stats.ActivePeers = b.peers.Count()
+					if err := b.peers.LastError(); err != nil {
+						stats.LastError = err.Error()
+					}
+				}
+				callback(stats)
 			}
 			outbound = 0
 			outEvents = 0
@@ -54,9 +152,13 @@ func (b *BytesSyncLogger) log() {
 		case amount := <-b.outboundChan:
 			outbound += amount
 			outEvents++
+			sinceSummary.outbound += amount
+			sinceSummary.outEvents++
 		case amount := <-b.inboundChan:
 			inbound += amount
 			inEvents++
+			sinceSummary.inbound += amount
+			sinceSummary.inEvents++
 		}
 	}
 }
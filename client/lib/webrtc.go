@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
@@ -9,9 +10,50 @@ import (
 	"sync"
 	"time"
 
+	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/util"
 	"github.com/pion/webrtc/v3"
 )
 
+// The parts of a webrtc.DataChannel that a WebRTCPeer uses once it is created.
+type dataChannel interface {
+	Send([]byte) error
+	Close() error
+}
+
+// Options for combining small writes into fewer DataChannel messages.
+type CoalesceConfig struct {
+	// How long a write may wait for others to join it. Zero disables
+	// coalescing.
+	Delay time.Duration
+	// How many waiting bytes cause them to be sent at once.
+	Size int
+}
+
+// Options for the ordering and reliability of a peer's DataChannel. The zero
+// value is ordered and reliable. The snowflake's traffic has its own sequencing
+// and retransmission, so it can run over an unordered or partially reliable
+// channel, at most one of whose limits may be set.
+type DataChannelConfig struct {
+	Unordered bool
+	// If not nil, how many times a message may be retransmitted.
+	MaxRetransmits *uint16
+	// If not nil, for how many milliseconds a message may be retransmitted.
+	MaxPacketLifeTime *uint16
+}
+
+func (d DataChannelConfig) init() (*webrtc.DataChannelInit, error) {
+	if d.MaxRetransmits != nil && d.MaxPacketLifeTime != nil {
+		return nil, errors.New("only one of MaxRetransmits and MaxPacketLifeTime may be set")
+	}
+	ordered := !d.Unordered
+	return &webrtc.DataChannelInit{
+		Ordered:           &ordered,
+		MaxRetransmits:    d.MaxRetransmits,
+		MaxPacketLifeTime: d.MaxPacketLifeTime,
+	}, nil
+}
+
 // Remote WebRTC peer.
 //
 // Handles preparation of go-webrtc PeerConnection. Only ever has
@@ -19,13 +61,28 @@ import (
 type WebRTCPeer struct {
 	id        string
 	pc        *webrtc.PeerConnection
-	transport *webrtc.DataChannel
+	transport dataChannel
+	// The NAT type of the proxy, as reported by the broker.
+	proxyNATType string
+
+	// Coalescing of writes. writeBuf holds bytes not yet sent, and
+	// flushTimer, if not nil, will send them. An error sending them is
+	// kept in writeErr and returned by the next Write.
+	coalesce   CoalesceConfig
+	writeLock  sync.Mutex
+	writeBuf   []byte
+	flushTimer *time.Timer
+	writeErr   error
 
 	recvPipe    *io.PipeReader
 	writePipe   *io.PipeWriter
 	lastReceive time.Time
+	// Received messages waiting to be written to writePipe. Bounded so that
+	// a SOCKS side that stops reading can't stall the DataChannel callback.
+	recvQueue chan []byte
 
 	open   chan struct{} // Channel to notify when datachannel opens
+	done   chan struct{} // Closed along with the peer
 	closed bool
 
 	once sync.Once // Synchronization for PeerConnection destruction
@@ -33,14 +90,26 @@ type WebRTCPeer struct {
 	BytesLogger BytesLogger
 }
 
-// Construct a WebRTC PeerConnection.
+// Construct a WebRTC PeerConnection, exchanging SessionDescriptions through
+// rendezvous.
 func NewWebRTCPeer(config *webrtc.Configuration,
-	broker *BrokerChannel) (*WebRTCPeer, error) {
+	rendezvous Rendezvous) (*WebRTCPeer, error) {
+	return NewWebRTCPeerWithOptions(context.Background(), config, rendezvous, DataChannelConfig{})
+}
+
+// Like NewWebRTCPeer, with the given options for the DataChannel. Gives up,
+// closing the half-made PeerConnection, when ctx is done.
+func NewWebRTCPeerWithOptions(ctx context.Context, config *webrtc.Configuration,
+	rendezvous Rendezvous, dataChannelConfig DataChannelConfig) (*WebRTCPeer, error) {
+	dataChannelOptions, err := dataChannelConfig.init()
+	if err != nil {
+		return nil, err
+	}
 	connection := new(WebRTCPeer)
 	{
 		var buf [8]byte
 		if _, err := rand.Read(buf[:]); err != nil {
-			panic(err)
+			return nil, err
 		}
 		connection.id = "snowflake-" + hex.EncodeToString(buf[:])
 	}
@@ -50,8 +119,11 @@ func NewWebRTCPeer(config *webrtc.Configuration,
 
 	// Pipes remain the same even when DataChannel gets switched.
 	connection.recvPipe, connection.writePipe = io.Pipe()
+	connection.recvQueue = make(chan []byte, RecvQueueSize)
+	connection.done = make(chan struct{})
+	go connection.recvLoop()
 
-	err := connection.connect(config, broker)
+	err = connection.connect(ctx, config, rendezvous, dataChannelOptions)
 	if err != nil {
 		connection.Close()
 		return nil, err
@@ -68,23 +140,163 @@ func (c *WebRTCPeer) Read(b []byte) (int, error) {
 // Writes bytes out to remote WebRTC.
 // As part of |io.ReadWriter|
 func (c *WebRTCPeer) Write(b []byte) (int, error) {
+	if c.coalesce.Delay <= 0 {
+		err := c.send(b)
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	c.writeBuf = append(c.writeBuf, b...)
+	if len(c.writeBuf) >= c.coalesce.Size {
+		c.flushLocked()
+		if c.writeErr != nil {
+			return 0, c.writeErr
+		}
+	} else if c.flushTimer == nil {
+		c.flushTimer = time.AfterFunc(c.coalesce.Delay, c.flush)
+	}
+	return len(b), nil
+}
+
+func (c *WebRTCPeer) send(b []byte) error {
 	err := c.transport.Send(b)
 	if err != nil {
-		return 0, err
+		return err
 	}
 	c.BytesLogger.AddOutbound(len(b))
-	return len(b), nil
+	return nil
+}
+
+// Sends any coalesced bytes that are waiting.
+func (c *WebRTCPeer) flush() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.flushLocked()
+}
+
+func (c *WebRTCPeer) flushLocked() {
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	if len(c.writeBuf) == 0 || c.writeErr != nil {
+		return
+	}
+	c.writeErr = c.send(c.writeBuf)
+	// Don't reuse the buffer; the DataChannel may still refer to it.
+	c.writeBuf = nil
 }
 
 func (c *WebRTCPeer) Close() error {
 	c.once.Do(func() {
+		c.writeLock.Lock()
+		c.flushLocked()
+		c.writeErr = io.ErrClosedPipe
+		c.writeLock.Unlock()
 		c.closed = true
+		if c.done != nil { // c.done can be nil in tests.
+			close(c.done)
+		}
 		c.cleanup()
 		log.Printf("WebRTC: Closing")
 	})
 	return nil
 }
 
+// Queues a message received on the DataChannel for recvLoop, without blocking.
+// If the queue is full, the SOCKS side has stopped reading, so the peer is
+// closed and false is returned.
+func (c *WebRTCPeer) queueMessage(data []byte) bool {
+	// Copy, because the DataChannel may reuse the buffer.
+	p := make([]byte, len(data))
+	copy(p, data)
+	select {
+	case c.recvQueue <- p:
+		// Traffic in the other direction, such as acknowledgements and
+		// replies, should not wait for the coalescing delay.
+		if c.coalesce.Delay > 0 {
+			c.flush()
+		}
+		return true
+	default:
+		log.Printf("WebRTC: %d received messages not read -- closing connection.",
+			cap(c.recvQueue))
+		// Don't close the PeerConnection from within its own callback.
+		go c.Close()
+		return false
+	}
+}
+
+// Handles an error on the DataChannel, such as a failure of the underlying
+// SCTP association. The channel is not usable after one, so close the peer
+// now, rather than waiting for checkForStaleness to notice the silence.
+func (c *WebRTCPeer) onDataChannelError(err error) {
+	log.Printf("WebRTC: DataChannel.OnError: %v", err)
+	// Don't close the PeerConnection from within its own callback.
+	go c.Close()
+}
+
+// Handles a DataChannel that the proxy opened. The client opens the only
+// DataChannel a peer has, so one from the proxy means that it is misbehaving;
+// close the channel and the peer, and leave it to the connect loop to collect
+// another.
+func (c *WebRTCPeer) onUnexpectedDataChannel(dc dataChannel) {
+	log.Println("WebRTC: unexpected DataChannel from the proxy -- closing connection.")
+	dc.Close()
+	// Don't close the PeerConnection from within its own callback.
+	go c.Close()
+}
+
+// Handles a change in the state of the ICE connection. WebRTC reports a lost
+// connection within seconds, so close the peer then, rather than waiting for
+// checkForStaleness to notice the silence.
+func (c *WebRTCPeer) onICEConnectionStateChange(state webrtc.ICEConnectionState) {
+	switch state {
+	case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed:
+		log.Printf("WebRTC: ICE connection %s -- closing connection.", state)
+		// Don't close the PeerConnection from within its own callback.
+		go c.Close()
+	}
+}
+
+// Like onICEConnectionStateChange, for the state of the PeerConnection as a
+// whole, which also covers DTLS.
+func (c *WebRTCPeer) onConnectionStateChange(state webrtc.PeerConnectionState) {
+	switch state {
+	case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+		log.Printf("WebRTC: PeerConnection %s -- closing connection.", state)
+		go c.Close()
+	}
+}
+
+// Writes received messages to the SOCKS pipe until the peer is closed.
+func (c *WebRTCPeer) recvLoop() {
+	for {
+		select {
+		case p := <-c.recvQueue:
+			n, err := c.writePipe.Write(p)
+			c.BytesLogger.AddInbound(n)
+			if err != nil {
+				// TODO: Maybe shouldn't actually close.
+				log.Println("Error writing to SOCKS pipe")
+				if inerr := c.writePipe.CloseWithError(err); inerr != nil {
+					log.Printf("c.writePipe.CloseWithError returned error: %v", inerr)
+				}
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
 // Prevent long-lived broken remotes.
 // Should also update the DataChannel in underlying go-webrtc's to make Closes
 // more immediate / responsive.
@@ -104,16 +316,26 @@ func (c *WebRTCPeer) checkForStaleness() {
 	}
 }
 
-func (c *WebRTCPeer) connect(config *webrtc.Configuration, broker *BrokerChannel) error {
+func (c *WebRTCPeer) connect(ctx context.Context, config *webrtc.Configuration, rendezvous Rendezvous,
+	dataChannelOptions *webrtc.DataChannelInit) error {
 	log.Println(c.id, " connecting...")
 	// TODO: When go-webrtc is more stable, it's possible that a new
 	// PeerConnection won't need to be re-prepared each time.
-	c.preparePeerConnection(config)
-	answer, err := broker.Negotiate(c.pc.LocalDescription())
+	err := c.preparePeerConnection(ctx, config, dataChannelOptions)
 	if err != nil {
 		return err
 	}
-	log.Printf("Received Answer.\n")
+	answer, proxyNATType, err := negotiate(ctx, rendezvous, c.pc.LocalDescription())
+	if err != nil {
+		return err
+	}
+	c.proxyNATType = proxyNATType
+	log.Printf("Received Answer from a proxy with NAT type %s.\n", proxyNATType)
+	err = util.CheckAnswer(c.pc.LocalDescription(), answer)
+	if err != nil {
+		log.Println("WebRTC: Answer does not match offer:", err)
+		return err
+	}
 	err = c.pc.SetRemoteDescription(*answer)
 	if nil != err {
 		log.Println("WebRTC: Unable to SetRemoteDescription:", err)
@@ -123,8 +345,14 @@ func (c *WebRTCPeer) connect(config *webrtc.Configuration, broker *BrokerChannel
 	// Wait for the datachannel to open or time out
 	select {
 	case <-c.open:
+	case <-c.done:
+		return errors.New("connection lost before DataChannel.OnOpen")
+	case <-ctx.Done():
+		return ctx.Err()
 	case <-time.After(DataChannelTimeout):
 		c.transport.Close()
+		log.Printf("WebRTC: Matched with a proxy with NAT type %s, and our NAT type is %s.",
+			c.proxyNATType, localNATType(rendezvous))
 		return errors.New("timeout waiting for DataChannel.OnOpen")
 	}
 
@@ -132,19 +360,40 @@ func (c *WebRTCPeer) connect(config *webrtc.Configuration, broker *BrokerChannel
 	return nil
 }
 
+// Exchanges offer for an answer through rendezvous, and returns the answer and
+// the NAT type of the proxy, if rendezvous can tell it.
+func negotiate(ctx context.Context, rendezvous Rendezvous, offer *webrtc.SessionDescription) (
+	*webrtc.SessionDescription, string, error) {
+	if r, ok := rendezvous.(ContextRendezvous); ok {
+		return r.NegotiateNATContext(ctx, offer)
+	}
+	answer, err := rendezvous.Negotiate(offer)
+	return answer, nat.NATUnknown, err
+}
+
+// Returns the client's own NAT type, as known to rendezvous, or NATUnknown.
+func localNATType(rendezvous Rendezvous) string {
+	if r, ok := rendezvous.(interface{ getNATType() string }); ok {
+		return r.getNATType()
+	}
+	return nat.NATUnknown
+}
+
 // preparePeerConnection creates a new WebRTC PeerConnection and returns it
 // after ICE candidate gathering is complete..
-func (c *WebRTCPeer) preparePeerConnection(config *webrtc.Configuration) error {
+func (c *WebRTCPeer) preparePeerConnection(ctx context.Context, config *webrtc.Configuration,
+	dataChannelOptions *webrtc.DataChannelInit) error {
 	var err error
 	c.pc, err = webrtc.NewPeerConnection(*config)
 	if err != nil {
 		log.Printf("NewPeerConnection ERROR: %s", err)
 		return err
 	}
-	ordered := true
-	dataChannelOptions := &webrtc.DataChannelInit{
-		Ordered: &ordered,
-	}
+	c.pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		c.onUnexpectedDataChannel(dc)
+	})
+	c.pc.OnICEConnectionStateChange(c.onICEConnectionStateChange)
+	c.pc.OnConnectionStateChange(c.onConnectionStateChange)
 	// We must create the data channel before creating an offer
 	// https://github.com/pion/webrtc/wiki/Release-WebRTC@v3.0.0
 	dc, err := c.pc.CreateDataChannel(c.id, dataChannelOptions)
@@ -160,19 +409,12 @@ func (c *WebRTCPeer) preparePeerConnection(config *webrtc.Configuration) error {
 		log.Println("WebRTC: DataChannel.OnClose")
 		c.Close()
 	})
+	dc.OnError(c.onDataChannelError)
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
 		if len(msg.Data) <= 0 {
 			log.Println("0 length message---")
 		}
-		n, err := c.writePipe.Write(msg.Data)
-		c.BytesLogger.AddInbound(n)
-		if err != nil {
-			// TODO: Maybe shouldn't actually close.
-			log.Println("Error writing to SOCKS pipe")
-			if inerr := c.writePipe.CloseWithError(err); inerr != nil {
-				log.Printf("c.writePipe.CloseWithError returned error: %v", inerr)
-			}
-		}
+		c.queueMessage(msg.Data)
 		c.lastReceive = time.Now()
 	})
 	c.transport = dc
@@ -197,11 +439,30 @@ func (c *WebRTCPeer) preparePeerConnection(config *webrtc.Configuration) error {
 	}
 	log.Println("WebRTC: Set local description")
 
-	<-done // Wait for ICE candidate gathering to complete.
+	err = waitForGathering(ctx, done, ICEGatheringTimeout)
+	if err != nil {
+		return err
+	}
 	log.Println("WebRTC: PeerConnection created.")
 	return nil
 }
 
+// Waits for ICE candidate gathering to complete, which done signals. If it
+// hasn't after timeout, returns anyway, so that the offer is made with the
+// candidates gathered so far. Returns an error only if ctx is done first.
+func waitForGathering(ctx context.Context, done <-chan struct{}, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Printf("WebRTC: ICE gathering incomplete after %v -- making an offer with the candidates gathered so far.", timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
 // Close all channels and transports
 func (c *WebRTCPeer) cleanup() {
 	// Close this side of the SOCKS pipe.
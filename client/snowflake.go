@@ -2,15 +2,20 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"syscall"
@@ -20,6 +25,7 @@ import (
 	sf "git.torproject.org/pluggable-transports/snowflake.git/client/lib"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/safelog"
+	"github.com/pion/ice/v2"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -27,6 +33,9 @@ const (
 	DefaultSnowflakeCapacity = 1
 )
 
+// Matches the IDs of snowflakes in the log, for -scrub-session-ids.
+var snowflakeIDPattern = regexp.MustCompile(`snowflake-[0-9a-f]{16}`)
+
 // Accept local SOCKS connections and pass them to the handler.
 func socksAcceptLoop(ln *pt.SocksListener, tongue sf.Tongue, shutdown chan struct{}, wg *sync.WaitGroup) {
 	defer ln.Close()
@@ -39,37 +48,114 @@ func socksAcceptLoop(ln *pt.SocksListener, tongue sf.Tongue, shutdown chan struc
 			log.Printf("SOCKS accept error: %s", err)
 			break
 		}
-		log.Printf("SOCKS accepted: %v", conn.Req)
-		go func() {
-			wg.Add(1)
-			defer wg.Done()
-			defer conn.Close()
+		// Don't log the args, which may hold TURN credentials.
+		log.Printf("SOCKS accepted: %v", conn.Req.Target)
+		go handleSocks(conn, tongueForArgs(conn.Req.Args, tongue), shutdown, wg)
+	}
+}
+
+// Returns a Tongue that uses the ICE servers in the "ice" SOCKS arg, a
+// comma-separated list like -ice, so that each bridge line can recommend its
+// own STUN and TURN servers. Invalid servers are skipped; if none are left, or
+// there is no "ice" arg, tongue itself is returned.
+func tongueForArgs(args pt.Args, tongue sf.Tongue) sf.Tongue {
+	iceArg, ok := args.Get("ice")
+	if !ok {
+		return tongue
+	}
+	dialer, ok := tongue.(*sf.WebRTCDialer)
+	if !ok {
+		return tongue
+	}
+	var servers []webrtc.ICEServer
+	for _, server := range parseIceServers(iceArg) {
+		if _, err := ice.ParseURL(server.URLs[0]); err != nil {
+			log.Printf("ignoring invalid ICE server in SOCKS args: %v", err)
+			continue
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		log.Printf("no valid ICE servers in SOCKS args; using -ice")
+		return tongue
+	}
+	return dialer.WithICEServers(servers)
+}
+
+// Grants a SOCKS connection and runs the handler on it until it ends or the
+// client shuts down.
+func handleSocks(conn sf.SocksConnector, tongue sf.Tongue, shutdown chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	defer wg.Done()
+	defer conn.Close()
+
+	err := conn.Grant(&net.TCPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		log.Printf("conn.Grant error: %s", err)
+		return
+	}
 
-			err := conn.Grant(&net.TCPAddr{IP: net.IPv4zero, Port: 0})
+	handler := make(chan struct{})
+	go func() {
+		err = sf.Handler(conn, tongue)
+		if err != nil {
+			log.Printf("handler error: %s", err)
+		}
+		close(handler)
+		return
+
+	}()
+	select {
+	case <-shutdown:
+		log.Println("Received shutdown signal")
+	case <-handler:
+		log.Println("Handler ended")
+	}
+}
+
+// Reports whether tor launched us as a managed pluggable transport. If not,
+// the client runs standalone, as a plain SOCKS proxy.
+func ptManaged() bool {
+	return os.Getenv("TOR_PT_MANAGED_TRANSPORT_VER") != ""
+}
+
+// Starts a SOCKS listener at addr for each supported method, and reports the
+// listeners to tor.
+func startListeners(methodNames []string, addr string, tongue sf.Tongue,
+	shutdown chan struct{}, wg *sync.WaitGroup) []net.Listener {
+	listeners := make([]net.Listener, 0)
+	for _, methodName := range methodNames {
+		switch methodName {
+		case "snowflake":
+			// TODO: Be able to recover when SOCKS dies.
+			ln, err := pt.ListenSocks("tcp", addr)
 			if err != nil {
-				log.Printf("conn.Grant error: %s", err)
-				return
+				pt.CmethodError(methodName, err.Error())
+				break
 			}
+			log.Printf("Started SOCKS listener at %v.", ln.Addr())
+			go socksAcceptLoop(ln, tongue, shutdown, wg)
+			pt.Cmethod(methodName, ln.Version(), ln.Addr())
+			listeners = append(listeners, ln)
+		default:
+			pt.CmethodError(methodName, "no such method")
+		}
+	}
+	return listeners
+}
 
-			handler := make(chan struct{})
-			go func() {
-				err = sf.Handler(conn, tongue)
-				if err != nil {
-					log.Printf("handler error: %s", err)
-				}
-				close(handler)
-				return
-
-			}()
-			select {
-			case <-shutdown:
-				log.Println("Received shutdown signal")
-			case <-handler:
-				log.Println("Handler ended")
-			}
-			return
-		}()
+// Starts a SOCKS5 listener at addr, for when tor is not running the client.
+// If username is not empty, SOCKS clients must authenticate with it and
+// password.
+func startStandaloneListener(addr, username, password string, tongue sf.Tongue,
+	shutdown chan struct{}, wg *sync.WaitGroup) (net.Listener, error) {
+	ln, err := listenSocks5("tcp", addr, username, password)
+	if err != nil {
+		return nil, err
 	}
+	log.Printf("Started SOCKS5 listener at %v.", ln.Addr())
+	go socks5AcceptLoop(ln, tongue, shutdown, wg)
+	return ln, nil
 }
 
 // s is a comma-separated list of ICE server URLs.
@@ -82,23 +168,111 @@ func parseIceServers(s string) []webrtc.ICEServer {
 	urls := strings.Split(s, ",")
 	for _, url := range urls {
 		url = strings.TrimSpace(url)
-		servers = append(servers, webrtc.ICEServer{
-			URLs: []string{url},
-		})
+		servers = append(servers, parseIceServer(url))
 	}
 	return servers
 }
 
+// Parses a single ICE server URL. TURN URLs may carry credentials in the form
+// turn:username:password@host:port, in which case they are moved from the URL
+// into the Username and Credential fields. The username and password may be
+// percent-encoded, if they contain ':' or '@'.
+func parseIceServer(rawURL string) webrtc.ICEServer {
+	server := webrtc.ICEServer{URLs: []string{rawURL}}
+	colon := strings.Index(rawURL, ":")
+	if colon < 0 {
+		return server
+	}
+	scheme, rest := rawURL[:colon], rawURL[colon+1:]
+	if scheme != "turn" && scheme != "turns" {
+		return server
+	}
+	at := strings.LastIndex(rest, "@")
+	if at < 0 {
+		return server
+	}
+	userinfo, host := rest[:at], rest[at+1:]
+	username, password := userinfo, ""
+	if i := strings.Index(userinfo, ":"); i >= 0 {
+		username, password = userinfo[:i], userinfo[i+1:]
+	}
+	server.URLs = []string{scheme + ":" + host}
+	server.Username = unescapeCredential(username)
+	server.Credential = unescapeCredential(password)
+	server.CredentialType = webrtc.ICECredentialTypePassword
+	return server
+}
+
+func unescapeCredential(s string) string {
+	unescaped, err := url.PathUnescape(s)
+	if err != nil {
+		return s
+	}
+	return unescaped
+}
+
+// Returns the DataChannel options for the -datachannel-* flags, whose limits
+// are -1 if not set.
+func dataChannelConfig(unordered bool, maxRetransmits, maxPacketLifeTime int) (sf.DataChannelConfig, error) {
+	config := sf.DataChannelConfig{Unordered: unordered}
+	limit := func(name string, n int) (*uint16, error) {
+		if n == -1 {
+			return nil, nil
+		}
+		if n < 0 || n > math.MaxUint16 {
+			return nil, fmt.Errorf("%s must be between 0 and %d, or -1", name, math.MaxUint16)
+		}
+		v := uint16(n)
+		return &v, nil
+	}
+	var err error
+	config.MaxRetransmits, err = limit("max retransmits", maxRetransmits)
+	if err != nil {
+		return config, err
+	}
+	config.MaxPacketLifeTime, err = limit("max packet lifetime", maxPacketLifeTime)
+	if err != nil {
+		return config, err
+	}
+	if config.MaxRetransmits != nil && config.MaxPacketLifeTime != nil {
+		return config, errors.New("only one of max retransmits and max packet lifetime may be set")
+	}
+	return config, nil
+}
+
 func main() {
-	iceServersCommas := flag.String("ice", "", "comma-separated list of ICE servers")
-	brokerURL := flag.String("url", "", "URL of signaling broker")
-	frontDomain := flag.String("front", "", "front domain")
+	iceServersCommas := flag.String("ice", "", "comma-separated list of ICE servers; TURN servers may include credentials as turn:username:password@host")
+	brokerURL := flag.String("url", "", "URL of signaling broker, or a comma-separated list of brokers to try in turn")
+	frontDomain := flag.String("front", "", "front domain, or a comma-separated list of front domains for the brokers in -url")
+	ampCacheURL := flag.String("ampcache", "", "URL of an AMP cache to use as a proxy for signaling, instead of contacting the broker directly")
+	brokerTimeout := flag.Duration("broker-timeout", sf.DefaultBrokerTimeout, "how long to wait for the broker to respond to an offer; must be longer than the broker's -client-timeout")
 	logFilename := flag.String("log", "", "name of log file")
 	logToStateDir := flag.Bool("log-to-state-dir", false, "resolve the log file relative to tor's pt state dir")
 	keepLocalAddresses := flag.Bool("keep-local-addresses", false, "keep local LAN address ICE candidates")
 	unsafeLogging := flag.Bool("unsafe-logging", false, "prevent logs from being scrubbed")
+	scrubSessionIDs := flag.Bool("scrub-session-ids", false, "also scrub snowflake IDs from logs")
+	minifySDP := flag.Bool("minify-sdp", false, "remove non-essential attributes from SDP offers sent to the broker")
 	max := flag.Int("max", DefaultSnowflakeCapacity,
 		"capacity for number of multiplexed WebRTC peers")
+	backoffBase := flag.Duration("reconnect-backoff-base", sf.ReconnectBackoffBase,
+		"time to wait between collecting snowflakes, and after a first failure")
+	backoffMax := flag.Duration("reconnect-backoff-max", sf.ReconnectBackoffMax,
+		"longest time to wait after repeated failures to collect a snowflake")
+	iceGatheringTimeout := flag.Duration("ice-gathering-timeout", sf.ICEGatheringTimeout,
+		"how long to wait for ICE candidate gathering before offering the candidates gathered so far")
+	iceProbeInterval := flag.Duration("ice-probe-interval", 10*time.Minute, "how often to check that the STUN servers in -ice work, and skip those that don't (0 to use them all without checking)")
+	natProbeInterval := flag.Duration("nat-probe-interval", time.Hour, "how often to test the NAT type again using the STUN servers in -ice (0 to test only at startup)")
+	coalesceDelay := flag.Duration("coalesce-delay", 0, "how long small writes may wait to be combined into one WebRTC message (0 to send each write at once)")
+	coalesceSize := flag.Int("coalesce-size", 4096, "number of waiting bytes that are sent at once, with -coalesce-delay")
+	dataChannelUnordered := flag.Bool("datachannel-unordered", false, "let the WebRTC DataChannel deliver messages out of order")
+	dataChannelMaxRetransmits := flag.Int("datachannel-max-retransmits", -1, "how many times the DataChannel may retransmit a message (-1 for no limit)")
+	dataChannelMaxPacketLifeTime := flag.Int("datachannel-max-packet-lifetime", -1, "for how many milliseconds the DataChannel may retransmit a message (-1 for no limit)")
+	checkBrokerStatus := flag.Bool("check-broker-status", false, "ask the broker whether proxies are available before making an offer")
+	summaryInterval := flag.Duration("summary-interval", sf.SummaryInterval, "how often to log the traffic of each connection since the last such line (0 to not log it)")
+	statsFilename := flag.String("stats-file", "", "name of a file to append JSON traffic statistics to, one line per connection every few seconds")
+	socksAddr := flag.String("socks", "127.0.0.1:1080", "address of the SOCKS listener when not run by tor")
+	socksUsername := flag.String("socks-username", "", "username that SOCKS clients must give when not run by tor (none required if empty)")
+	socksPassword := flag.String("socks-password", "", "password that SOCKS clients must give with -socks-username")
 
 	// Deprecated
 	oldLogToStateDir := flag.Bool("logToStateDir", false, "use -log-to-state-dir instead")
@@ -114,6 +288,10 @@ func main() {
 	// https://bugs.torproject.org/26360
 	// https://bugs.torproject.org/25600#comment:14
 	var logOutput = ioutil.Discard
+	if !ptManaged() {
+		// Standalone, nobody is reading stderr through a pipe.
+		logOutput = os.Stderr
+	}
 	if *logFilename != "" {
 		if *logToStateDir || *oldLogToStateDir {
 			stateDir, err := pt.MakeStateDir()
@@ -132,13 +310,39 @@ func main() {
 	}
 	if *unsafeLogging {
 		log.SetOutput(logOutput)
+		sf.LogFullSDP = true
 	} else {
 		// We want to send the log output through our scrubber first
-		log.SetOutput(&safelog.LogScrubber{Output: logOutput})
+		scrubber := &safelog.LogScrubber{Output: logOutput}
+		if *scrubSessionIDs {
+			scrubber.AddPattern(snowflakeIDPattern, "snowflake-[scrubbed]")
+		}
+		log.SetOutput(scrubber)
 	}
 
 	log.Println("\n\n\n --- Starting Snowflake Client ---")
 
+	if *statsFilename != "" {
+		statsFile, err := os.OpenFile(*statsFilename,
+			os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer statsFile.Close()
+		sf.StatsCallback = sf.NewStatsWriter(statsFile).Write
+	}
+
+	if *backoffBase <= 0 || *backoffMax < *backoffBase {
+		log.Fatalf("need 0 < -reconnect-backoff-base <= -reconnect-backoff-max")
+	}
+	sf.ReconnectBackoffBase = *backoffBase
+	sf.ReconnectBackoffMax = *backoffMax
+	if *iceGatheringTimeout <= 0 {
+		log.Fatalf("-ice-gathering-timeout must be positive")
+	}
+	sf.ICEGatheringTimeout = *iceGatheringTimeout
+	sf.SummaryInterval = *summaryInterval
+
 	iceServers := parseIceServers(*iceServersCommas)
 	// chooses a random subset of servers from inputs
 	rand.Seed(time.Now().UnixNano())
@@ -150,54 +354,94 @@ func main() {
 	}
 	log.Printf("Using ICE servers:")
 	for _, server := range iceServers {
-		log.Printf("url: %v", strings.Join(server.URLs, " "))
+		if server.Username != "" {
+			log.Printf("url: %v (with credentials)", strings.Join(server.URLs, " "))
+		} else {
+			log.Printf("url: %v", strings.Join(server.URLs, " "))
+		}
 	}
 
-	// Use potentially domain-fronting broker to rendezvous.
+	// Use potentially domain-fronting brokers to rendezvous. The i'th front
+	// domain goes with the i'th broker URL.
+	brokerURLs := strings.Split(*brokerURL, ",")
+	fronts := strings.Split(*frontDomain, ",")
+	front := func(i int) string {
+		if i < len(fronts) {
+			return strings.TrimSpace(fronts[i])
+		}
+		return ""
+	}
 	broker, err := sf.NewBrokerChannel(
-		*brokerURL, *frontDomain, sf.CreateBrokerTransport(),
+		strings.TrimSpace(brokerURLs[0]), front(0), sf.CreateBrokerTransport(),
 		*keepLocalAddresses || *oldKeepLocalAddresses)
 	if err != nil {
 		log.Fatalf("parsing broker URL: %v", err)
 	}
-	go updateNATType(iceServers, broker)
+	for i := 1; i < len(brokerURLs); i++ {
+		err = broker.AddBroker(strings.TrimSpace(brokerURLs[i]), front(i))
+		if err != nil {
+			log.Fatalf("parsing broker URL: %v", err)
+		}
+	}
+	broker.MinifySDP = *minifySDP
+	broker.Timeout = *brokerTimeout
+	if *ampCacheURL != "" {
+		broker.AMPCache, err = url.Parse(*ampCacheURL)
+		if err != nil {
+			log.Fatalf("parsing AMP cache URL: %v", err)
+		}
+		log.Println("Rendezvous through AMP cache at:", *ampCacheURL)
+	}
+	go natProbeLoop(iceServers, broker, *natProbeInterval)
 
 	// Create a new WebRTCDialer to use as the |Tongue| to catch snowflakes
 	dialer := sf.NewWebRTCDialer(broker, iceServers, *max)
-
-	// Begin goptlib client process.
-	ptInfo, err := pt.ClientSetup(nil)
+	dialer.Coalesce = sf.CoalesceConfig{Delay: *coalesceDelay, Size: *coalesceSize}
+	dialer.CheckStatus = *checkBrokerStatus
+	dialer.DataChannel, err = dataChannelConfig(*dataChannelUnordered,
+		*dataChannelMaxRetransmits, *dataChannelMaxPacketLifeTime)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("DataChannel options: %v", err)
 	}
-	if ptInfo.ProxyURL != nil {
-		pt.ProxyError("proxy is not supported")
-		os.Exit(1)
+	if *iceProbeInterval > 0 {
+		dialer.ICEServerHealth = sf.NewICEServerHealth(iceServers)
+		go iceProbeLoop(iceServers, dialer.ICEServerHealth, *iceProbeInterval)
 	}
-	listeners := make([]net.Listener, 0)
+
 	shutdown := make(chan struct{})
 	var wg sync.WaitGroup
-	for _, methodName := range ptInfo.MethodNames {
-		switch methodName {
-		case "snowflake":
-			// TODO: Be able to recover when SOCKS dies.
-			ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
-			if err != nil {
-				pt.CmethodError(methodName, err.Error())
-				break
-			}
-			log.Printf("Started SOCKS listener at %v.", ln.Addr())
-			go socksAcceptLoop(ln, dialer, shutdown, &wg)
-			pt.Cmethod(methodName, ln.Version(), ln.Addr())
-			listeners = append(listeners, ln)
-		default:
-			pt.CmethodError(methodName, "no such method")
+	var listeners []net.Listener
+	// Begin goptlib client process, unless we are not being run by tor.
+	if ptManaged() {
+		ptInfo, err := pt.ClientSetup(nil)
+		if err != nil {
+			log.Fatal(err)
 		}
+		if ptInfo.ProxyURL != nil {
+			pt.ProxyError("proxy is not supported")
+			os.Exit(1)
+		}
+		listeners = startListeners(ptInfo.MethodNames, "127.0.0.1:0", dialer, shutdown, &wg)
+		pt.CmethodsDone()
+	} else {
+		log.Printf("Not run by tor; running standalone.")
+		if *socksPassword != "" && *socksUsername == "" {
+			log.Fatalf("-socks-password needs -socks-username")
+		}
+		ln, err := startStandaloneListener(*socksAddr, *socksUsername, *socksPassword,
+			dialer, shutdown, &wg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, ln)
 	}
-	pt.CmethodsDone()
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM)
+	if !ptManaged() {
+		// Without tor to stop us, Ctrl-C is how we are stopped.
+		signal.Notify(sigChan, syscall.SIGINT)
+	}
 
 	if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
 		// This environment variable means we should treat EOF on stdin
@@ -221,16 +465,66 @@ func main() {
 	}
 	close(shutdown)
 	wg.Wait()
+	log.Println(sf.Summary)
 	log.Println("snowflake is done.")
 }
 
+// Probes the NAT type now, and again every interval, if it is positive, so that
+// the type sent to the broker follows changes of network.
+func natProbeLoop(servers []webrtc.ICEServer, broker *sf.BrokerChannel, interval time.Duration) {
+	updateNATType(servers, broker)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		updateNATType(servers, broker)
+	}
+}
+
+// Probes the STUN servers now and every interval, so that the dialer stops
+// using those that are blocked or broken.
+func iceProbeLoop(servers []webrtc.ICEServer, health *sf.ICEServerHealth, interval time.Duration) {
+	probe := func(addr string) error {
+		_, err := nat.GetReflexiveAddress(addr)
+		return err
+	}
+	probeICEServers(servers, health, probe)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		probeICEServers(servers, health, probe)
+	}
+}
+
+// Probes each STUN server in servers, and records in health whether it
+// answered. TURN servers are not probed.
+func probeICEServers(servers []webrtc.ICEServer, health *sf.ICEServerHealth, probe func(addr string) error) {
+	for _, server := range servers {
+		if !strings.HasPrefix(server.URLs[0], "stun:") {
+			continue
+		}
+		err := probe(strings.TrimPrefix(server.URLs[0], "stun:"))
+		if err != nil {
+			log.Printf("STUN server %s failed: %v", server.URLs[0], err)
+		}
+		health.Record(server.URLs[0], err == nil)
+	}
+	log.Printf("STUN server successes: %s", health)
+}
+
 // loop through all provided STUN servers until we exhaust the list or find
 // one that is compatable with RFC 5780
 func updateNATType(servers []webrtc.ICEServer, broker *sf.BrokerChannel) {
 
 	var restrictedNAT bool
-	var err error
+	err := errors.New("no STUN servers")
 	for _, server := range servers {
+		// TURN servers can't be used for the test.
+		if !strings.HasPrefix(server.URLs[0], "stun:") {
+			continue
+		}
 		addr := strings.TrimPrefix(server.URLs[0], "stun:")
 		restrictedNAT, err = nat.CheckIfRestrictedNAT(addr)
 		if err == nil {
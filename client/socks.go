@@ -0,0 +1,267 @@
+/*
+A SOCKS5 listener (RFC 1928) for running the client standalone, outside of tor.
+
+goptlib's SOCKS listener treats the username and password of a SOCKS5
+connection as pluggable transport arguments, and rejects those that are not of
+the form key=value. This listener instead checks them against a configured
+username and password (RFC 1929), like any other SOCKS5 proxy.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	sf "git.torproject.org/pluggable-transports/snowflake.git/client/lib"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone             = 0x00
+	socks5AuthUsernamePassword = 0x02
+	socks5AuthNoAcceptable     = 0xff
+
+	socks5UserPassVersion = 0x01
+	socks5UserPassSuccess = 0x00
+	socks5UserPassFailure = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded          = 0x00
+	socks5RepGeneralFailure     = 0x01
+	socks5RepCommandUnsupported = 0x07
+	socks5RepAddressUnsupported = 0x08
+)
+
+// How long a client has to finish the SOCKS handshake.
+const socks5HandshakeTimeout = 5 * time.Second
+
+// Accepts SOCKS5 connections. If username is not empty, clients must
+// authenticate with it and password.
+type socks5Listener struct {
+	net.Listener
+	username string
+	password string
+}
+
+func listenSocks5(network, addr, username, password string) (*socks5Listener, error) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &socks5Listener{Listener: ln, username: username, password: password}, nil
+}
+
+// A connection that has completed the SOCKS5 handshake, up to the reply to
+// its CONNECT request. Implements |SocksConnector|.
+type socks5Conn struct {
+	net.Conn
+	// The host:port that the client asked to connect to. The client
+	// ignores it; the snowflake decides where traffic goes.
+	target string
+}
+
+func (c *socks5Conn) Grant(addr *net.TCPAddr) error {
+	return c.reply(socks5RepSucceeded)
+}
+
+func (c *socks5Conn) Reject() error {
+	return c.reply(socks5RepGeneralFailure)
+}
+
+func (c *socks5Conn) reply(rep byte) error {
+	// The bound address is always sent as 0.0.0.0:0.
+	_, err := c.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// Does the server side of the SOCKS5 handshake on conn, up to the reply to the
+// client's CONNECT request, which is left to Grant or Reject.
+func (ln *socks5Listener) handshake(conn net.Conn) (*socks5Conn, error) {
+	err := conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	method, err := ln.negotiateMethod(conn)
+	if err != nil {
+		return nil, err
+	}
+	if method == socks5AuthUsernamePassword {
+		err = ln.authenticate(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := &socks5Conn{Conn: conn}
+	c.target, err = readSocks5Request(c)
+	if err != nil {
+		return nil, err
+	}
+	return c, conn.SetDeadline(time.Time{})
+}
+
+// Reads the client's authentication methods and chooses one.
+func (ln *socks5Listener) negotiateMethod(conn net.Conn) (byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, err
+	}
+	if header[0] != socks5Version {
+		return 0, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return 0, err
+	}
+
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		if m == socks5AuthUsernamePassword {
+			// Prefer username and password, even when they are
+			// not required, to accept clients that insist on them.
+			method = m
+			break
+		}
+		if m == socks5AuthNone && ln.username == "" {
+			method = m
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return 0, err
+	}
+	if method == socks5AuthNoAcceptable {
+		return 0, errors.New("no acceptable SOCKS authentication method")
+	}
+	return method, nil
+}
+
+// Reads the client's username and password, and checks them if a username is
+// configured.
+func (ln *socks5Listener) authenticate(conn net.Conn) error {
+	var version [1]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return err
+	}
+	if version[0] != socks5UserPassVersion {
+		return fmt.Errorf("unsupported SOCKS username/password version %d", version[0])
+	}
+	username, err := readSocks5String(conn)
+	if err != nil {
+		return err
+	}
+	password, err := readSocks5String(conn)
+	if err != nil {
+		return err
+	}
+
+	status := byte(socks5UserPassSuccess)
+	if ln.username != "" &&
+		(subtle.ConstantTimeCompare([]byte(username), []byte(ln.username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(ln.password)) != 1) {
+		status = socks5UserPassFailure
+	}
+	if _, err := conn.Write([]byte{socks5UserPassVersion, status}); err != nil {
+		return err
+	}
+	if status != socks5UserPassSuccess {
+		return errors.New("wrong SOCKS username or password")
+	}
+	return nil
+}
+
+// Reads a CONNECT request, and returns the address it asks for.
+func readSocks5Request(c *socks5Conn) (string, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	if header[1] != socks5CmdConnect {
+		c.reply(socks5RepCommandUnsupported)
+		return "", fmt.Errorf("unsupported SOCKS command %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(c, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		name, err := readSocks5String(c)
+		if err != nil {
+			return "", err
+		}
+		host = name
+	default:
+		c.reply(socks5RepAddressUnsupported)
+		return "", fmt.Errorf("unsupported SOCKS address type %d", header[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(c, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// Reads a string prefixed by its length in one byte.
+func readSocks5String(r io.Reader) (string, error) {
+	var length [1]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, length[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Accept SOCKS5 connections and pass them to the handler. Handshakes happen
+// concurrently, so a slow client doesn't hold up the others.
+func socks5AcceptLoop(ln *socks5Listener, tongue sf.Tongue, shutdown chan struct{}, wg *sync.WaitGroup) {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			log.Printf("SOCKS accept error: %s", err)
+			break
+		}
+		go func() {
+			c, err := ln.handshake(conn)
+			if err != nil {
+				log.Printf("SOCKS handshake error: %s", err)
+				conn.Close()
+				return
+			}
+			log.Printf("SOCKS accepted: %v", c.target)
+			handleSocks(c, tongue, shutdown, wg)
+		}()
+	}
+}
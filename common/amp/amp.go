@@ -0,0 +1,148 @@
+// Package amp supports rendezvous through an AMP cache, as an alternative to
+// domain fronting. A client asks an AMP cache, such as the Google AMP cache at
+// cdn.ampproject.org, for a page of the broker whose path encodes the request.
+// The cache fetches the page from the broker and returns it. The response is
+// "armored" in an AMP HTML document, which the cache will accept and serve.
+//
+// https://developers.google.com/amp/cache/overview
+package amp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Returns the URL at which an AMP cache serves pubURL, the URL of a page on
+// the origin server. contentType is "c" for an HTML document.
+//
+// https://developers.google.com/amp/cache/overview#amp-cache-url-format
+func CacheURL(pubURL, cacheURL *url.URL, contentType string) (*url.URL, error) {
+	if pubURL.Port() != "" {
+		return nil, fmt.Errorf("AMP cache can't fetch from port %s", pubURL.Port())
+	}
+	prefix, err := domainPrefix(pubURL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/" + contentType
+	if pubURL.Scheme == "https" {
+		path += "/s"
+	}
+	path += "/" + pubURL.Host + pubURL.EscapedPath()
+
+	u := &url.URL{
+		Scheme:   cacheURL.Scheme,
+		Host:     prefix + "." + cacheURL.Hostname(),
+		RawQuery: pubURL.RawQuery,
+	}
+	if cacheURL.Port() != "" {
+		u.Host = net.JoinHostPort(u.Host, cacheURL.Port())
+	}
+	u.RawPath = path
+	u.Path, err = url.PathUnescape(path)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Returns the subdomain of an AMP cache under which the cache serves pages of
+// host. Each "-" becomes "--" and each "." becomes "-".
+func domainPrefix(host string) (string, error) {
+	for _, c := range host {
+		if c > 0x7f {
+			return "", fmt.Errorf("AMP cache domain for non-ASCII host %q not supported", host)
+		}
+	}
+	if net.ParseIP(host) != nil {
+		return "", fmt.Errorf("AMP cache can't fetch from IP address %s", host)
+	}
+	prefix := strings.ToLower(host)
+	prefix = strings.Replace(prefix, "-", "--", -1)
+	prefix = strings.Replace(prefix, ".", "-", -1)
+	if len(prefix) > 63 {
+		return "", fmt.Errorf("AMP cache domain for %q is too long", host)
+	}
+	return prefix, nil
+}
+
+// The AMP document that data is armored in. The data goes in the <pre>
+// element, as a version byte "0" followed by base64, in lines of at most
+// armorLineLength characters.
+const (
+	armorHeader = `<!doctype html>
+<html amp>
+<head>
+<meta charset="utf-8">
+<script async src="https://cdn.ampproject.org/v0.js"></script>
+<link rel="canonical" href="#">
+<meta name="viewport" content="width=device-width">
+<style amp-boilerplate>body{-webkit-animation:-amp-start 8s steps(1,end) 0s 1 normal both;-moz-animation:-amp-start 8s steps(1,end) 0s 1 normal both;-ms-animation:-amp-start 8s steps(1,end) 0s 1 normal both;animation:-amp-start 8s steps(1,end) 0s 1 normal both}@-webkit-keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}@-moz-keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}@-ms-keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}@-o-keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}@keyframes -amp-start{from{visibility:hidden}to{visibility:visible}}</style><noscript><style amp-boilerplate>body{-webkit-animation:none;-moz-animation:none;-ms-animation:none;animation:none}</style></noscript>
+</head>
+<body>
+<pre>
+`
+	armorFooter = `
+</pre>
+</body>
+</html>
+`
+	armorVersion    = '0'
+	armorLineLength = 76
+)
+
+// Writes data to w, armored in an AMP document.
+func Armor(w io.Writer, data []byte) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(armorHeader)
+	encoded := base64.StdEncoding.EncodeToString(data)
+	line := string(armorVersion)
+	for {
+		n := armorLineLength - len(line)
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+		line += encoded[:n]
+		encoded = encoded[n:]
+		bw.WriteString(line)
+		if len(encoded) == 0 {
+			break
+		}
+		bw.WriteString("\n")
+		line = ""
+	}
+	bw.WriteString(armorFooter)
+	return bw.Flush()
+}
+
+// Reads an AMP document from r, which may have been rewritten by an AMP cache,
+// and returns the data armored in it. At most limit bytes are read.
+func Dearmor(r io.Reader, limit int64) ([]byte, error) {
+	doc, err := ioutil.ReadAll(io.LimitReader(r, limit))
+	if err != nil {
+		return nil, err
+	}
+	start := bytes.Index(doc, []byte("<pre>"))
+	if start < 0 {
+		return nil, fmt.Errorf("no <pre> element in AMP document")
+	}
+	doc = doc[start+len("<pre>"):]
+	end := bytes.Index(doc, []byte("</pre>"))
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated <pre> element in AMP document")
+	}
+	// Lines may be rewrapped, so ignore all whitespace.
+	encoded := strings.Join(strings.Fields(string(doc[:end])), "")
+	if len(encoded) == 0 || encoded[0] != armorVersion {
+		return nil, fmt.Errorf("unknown AMP armor version")
+	}
+	return base64.StdEncoding.DecodeString(encoded[1:])
+}
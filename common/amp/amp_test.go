@@ -0,0 +1,75 @@
+package amp
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCacheURL(t *testing.T) {
+	Convey("CacheURL", t, func() {
+		cache, _ := url.Parse("https://cdn.ampproject.org/")
+		for _, test := range []struct {
+			pub      string
+			expected string
+		}{
+			{"https://example.com/", "https://example-com.cdn.ampproject.org/c/s/example.com/"},
+			{"http://example.com/page?q=1", "https://example-com.cdn.ampproject.org/c/example.com/page?q=1"},
+			{"https://Snowflake-Broker.Example.org/amp/client/x", "https://snowflake--broker-example-org.cdn.ampproject.org/c/s/Snowflake-Broker.Example.org/amp/client/x"},
+		} {
+			pub, err := url.Parse(test.pub)
+			So(err, ShouldBeNil)
+			u, err := CacheURL(pub, cache, "c")
+			So(err, ShouldBeNil)
+			So(u.String(), ShouldEqual, test.expected)
+		}
+
+		for _, bad := range []string{
+			"https://example.com:8443/",
+			"https://192.0.2.1/",
+			"https://" + strings.Repeat("a", 60) + ".example/",
+		} {
+			pub, err := url.Parse(bad)
+			So(err, ShouldBeNil)
+			_, err = CacheURL(pub, cache, "c")
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestArmor(t *testing.T) {
+	Convey("Armor", t, func() {
+		for _, data := range [][]byte{
+			{},
+			[]byte(`{"Answer":"fake"}`),
+			bytes.Repeat([]byte{0xfe, 0x00, 0x41}, 1000),
+		} {
+			var buf bytes.Buffer
+			So(Armor(&buf, data), ShouldBeNil)
+			So(buf.String(), ShouldStartWith, "<!doctype html>")
+			decoded, err := Dearmor(&buf, 100000)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, data)
+		}
+
+		Convey("survives rewrapping by the cache", func() {
+			var buf bytes.Buffer
+			data := bytes.Repeat([]byte("snowflake"), 100)
+			So(Armor(&buf, data), ShouldBeNil)
+			rewrapped := strings.Replace(buf.String(), "\n", "\r\n  ", -1)
+			decoded, err := Dearmor(strings.NewReader(rewrapped), 100000)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldResemble, data)
+		})
+
+		Convey("rejects documents without armored data", func() {
+			_, err := Dearmor(strings.NewReader("<html><body></body></html>"), 100000)
+			So(err, ShouldNotBeNil)
+			_, err = Dearmor(strings.NewReader("<pre>1AAAA</pre>"), 100000)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
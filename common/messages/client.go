@@ -0,0 +1,123 @@
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/* Client AMP cache rendezvous specification:
+
+== AMPClientRequest ==
+GET /amp/client/[NAT type]/[base64url-encoded SDP offer]?nonce=[nonce]
+
+The nonce is optional. The client makes a new one for each offer, so that it
+can tell that the answer is for that offer.
+
+== AMPClientResponse ==
+Always HTTP 200 OK, because an AMP cache does not pass on error responses.
+The JSON message is armored in an AMP document (see common/amp).
+
+1) If a proxy was matched:
+{
+  Answer: [SDP answer],
+  NAT: ["unknown"|"restricted"|"unrestricted"],
+  Nonce: [the nonce from the request, if any]
+}
+
+2) Otherwise:
+{
+  Error: ["no snowflake proxies currently available"|"timed out waiting for answer"|"malformed offer"]
+}
+
+== ClientStatusRequest ==
+GET /status
+
+== ClientStatusResponse ==
+HTTP 200 OK
+{
+  Proxies: [number of proxies waiting for a client],
+  Wait: [estimated seconds until an offer could be matched]
+}
+
+*/
+
+const (
+	AMPErrorNoProxies = "no snowflake proxies currently available"
+	AMPErrorTimeout   = "timed out waiting for answer"
+	AMPErrorBadOffer  = "malformed offer"
+)
+
+// The HTTP header in which a client may send a nonce with its offer, and in
+// which the broker echoes it with the answer. Like the nonce in an
+// AMPClientRequest, it lets the client tell that the answer is for its offer.
+const NonceHeader = "Snowflake-Nonce"
+
+type AMPClientResponse struct {
+	Answer string `json:",omitempty"`
+	NAT    string `json:",omitempty"`
+	Nonce  string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+func EncodeAMPClientResponse(answer string, natType string, nonce string, errorMessage string) ([]byte, error) {
+	return json.Marshal(AMPClientResponse{
+		Answer: answer,
+		NAT:    natType,
+		Nonce:  nonce,
+		Error:  errorMessage,
+	})
+}
+
+// Decodes an AMP rendezvous response from the broker and returns the answer,
+// the proxy's NAT type, and the nonce echoed from the request, which is empty
+// if the broker doesn't echo nonces. The error message from the broker, if
+// any, is returned as a non-empty string.
+func DecodeAMPClientResponse(data []byte) (string, string, string, string, error) {
+	var message AMPClientResponse
+
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	if message.Error != "" {
+		return "", "", "", message.Error, nil
+	}
+	if message.Answer == "" {
+		return "", "", "", "", fmt.Errorf("no supplied answer")
+	}
+
+	natType := message.NAT
+	if natType == "" {
+		natType = "unknown"
+	}
+
+	return message.Answer, natType, message.Nonce, "", nil
+}
+
+type ClientStatusResponse struct {
+	Proxies int
+	Wait    int
+}
+
+func EncodeClientStatusResponse(proxies int, wait int) ([]byte, error) {
+	return json.Marshal(ClientStatusResponse{
+		Proxies: proxies,
+		Wait:    wait,
+	})
+}
+
+// Decodes a status response from the broker and returns the number of proxies
+// waiting for a client and the estimated wait, in seconds, for a match.
+func DecodeClientStatusResponse(data []byte) (int, int, error) {
+	var message ClientStatusResponse
+
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		return 0, 0, err
+	}
+	if message.Proxies < 0 || message.Wait < 0 {
+		return 0, 0, fmt.Errorf("received invalid data")
+	}
+
+	return message.Proxies, message.Wait, nil
+}
@@ -6,17 +6,22 @@ package messages
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
 )
 
-const version = "1.2"
+// The version of the protocol that this package speaks.
+var CurrentVersion = Version{1, 4}
 
-/* Version 1.2 specification:
+var version = CurrentVersion.String()
+
+/* Version 1.4 specification:
 
 == ProxyPollRequest ==
 {
   Sid: [generated session id of proxy],
-  Version: 1.2,
+  Version: 1.4,
   Type: ["badge"|"webext"|"standalone"]
   NAT: ["unknown"|"restricted"|"unrestricted"]
 }
@@ -30,9 +35,17 @@ HTTP 200 OK
     type: offer,
     sdp: [WebRTC SDP]
   },
-  NAT: ["unknown"|"restricted"|"unrestricted"]
+  NAT: ["unknown"|"restricted"|"unrestricted"],
+  RelayURL: [optional WebSocket URL of the bridge to relay the client to],
+  Version: [negotiated version]
 }
 
+The negotiated version is the lower of the proxy's version and the broker's.
+It is absent in responses from brokers older than 1.2. NAT is sent to proxies
+of every version, as it always has been, but RelayURL only to those whose
+version supports it. Without a RelayURL, the proxy relays
+the client to the bridge it is configured with.
+
 2) If a client is not matched:
 HTTP 200 OK
 
@@ -46,7 +59,7 @@ HTTP 400 BadRequest
 == ProxyAnswerRequest ==
 {
   Sid: [generated session id of proxy],
-  Version: 1.2,
+  Version: 1.4,
   Answer:
   {
     type: answer,
@@ -54,6 +67,15 @@ HTTP 400 BadRequest
   }
 }
 
+A proxy that can't answer its client, for example because it found no ICE
+candidates the client could use, sends an Error in place of the Answer, so that
+the client can try another proxy at once:
+{
+  Sid: [generated session id of proxy],
+  Version: 1.4,
+  Error: [reason]
+}
+
 == ProxyAnswerResponse ==
 1) If the client retrieved the answer:
 HTTP 200 OK
@@ -74,6 +96,80 @@ HTTP 400 BadRequest
 
 */
 
+// A protocol version, major.minor. Versions with the same major number are
+// compatible; each minor version adds optional fields.
+type Version struct {
+	Major, Minor int
+}
+
+func ParseVersion(s string) (Version, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return Version{}, fmt.Errorf("malformed version %q", s)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 0 {
+		return Version{}, fmt.Errorf("malformed version %q", s)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil || minor < 0 {
+		return Version{}, fmt.Errorf("malformed version %q", s)
+	}
+	return Version{major, minor}, nil
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// An optional field of the protocol.
+type Capability string
+
+const (
+	// The Type field of a poll request.
+	CapabilityProxyType Capability = "proxy-type"
+	// The NAT fields of poll requests and responses.
+	CapabilityNAT Capability = "nat"
+	// The RelayURL field of poll responses.
+	CapabilityRelayURL Capability = "relay-url"
+	// The Error field of answer requests.
+	CapabilityAnswerError Capability = "answer-error"
+)
+
+// The minor version of major version 1 that introduced each capability.
+var capabilityMinorVersions = map[Capability]int{
+	CapabilityProxyType:   1,
+	CapabilityNAT:         2,
+	CapabilityRelayURL:    3,
+	CapabilityAnswerError: 4,
+}
+
+// Returns whether a peer speaking version v understands capability c.
+func (v Version) Supports(c Capability) bool {
+	minor, ok := capabilityMinorVersions[c]
+	return ok && v.Major == 1 && v.Minor >= minor
+}
+
+// Returns the set of capabilities of version v.
+func (v Version) Capabilities() map[Capability]bool {
+	capabilities := make(map[Capability]bool)
+	for c := range capabilityMinorVersions {
+		if v.Supports(c) {
+			capabilities[c] = true
+		}
+	}
+	return capabilities
+}
+
+// Returns the version to use with a peer that speaks version peer: the lower
+// of it and CurrentVersion. The major versions must already be known to match.
+func NegotiateVersion(peer Version) Version {
+	if peer.Minor < CurrentVersion.Minor {
+		return peer
+	}
+	return CurrentVersion
+}
+
 type ProxyPollRequest struct {
 	Sid     string
 	Version string
@@ -90,73 +186,135 @@ func EncodePollRequest(sid string, proxyType string, natType string) ([]byte, er
 	})
 }
 
-// Decodes a poll message from a snowflake proxy and returns the
-// sid and proxy type of the proxy on success and an error if it failed
-func DecodePollRequest(data []byte) (string, string, string, error) {
+// Decodes a poll message from a snowflake proxy and returns the sid, proxy
+// type, and NAT type of the proxy, and the version of the protocol it speaks,
+// on success and an error if it failed
+func DecodePollRequest(data []byte) (string, string, string, Version, error) {
 	var message ProxyPollRequest
 
 	err := json.Unmarshal(data, &message)
 	if err != nil {
-		return "", "", "", err
+		return "", "", "", Version{}, err
 	}
 
-	majorVersion := strings.Split(message.Version, ".")[0]
-	if majorVersion != "1" {
-		return "", "", "", fmt.Errorf("using unknown version")
+	v, err := ParseVersion(message.Version)
+	if err != nil || v.Major != 1 {
+		return "", "", "", Version{}, fmt.Errorf("using unknown version")
 	}
 
 	// Version 1.x requires an Sid
 	if message.Sid == "" {
-		return "", "", "", fmt.Errorf("no supplied session id")
+		return "", "", "", Version{}, fmt.Errorf("no supplied session id")
 	}
 
+	// Fields are read even if the proxy's version predates them, because
+	// some proxies send them without updating their version.
 	natType := message.NAT
 	if natType == "" {
 		natType = "unknown"
 	}
 
-	return message.Sid, message.Type, natType, nil
+	return message.Sid, message.Type, natType, v, nil
 }
 
 type ProxyPollResponse struct {
-	Status string
-	Offer  string
-	NAT    string
+	Status   string
+	Offer    string
+	NAT      string
+	RelayURL string `json:",omitempty"`
+	Version  string `json:",omitempty"`
+}
+
+// Returns an error unless relayURL is an absolute ws or wss URL, which a proxy
+// can connect to.
+func validateRelayURL(relayURL string) error {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return fmt.Errorf("malformed relay URL: %v", err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return fmt.Errorf("relay URL %q is not a WebSocket URL", relayURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("relay URL %q has no host", relayURL)
+	}
+	return nil
+}
+
+// Encodes a poll response for a proxy that speaks the given version, which
+// should come from NegotiateVersion.
+func EncodePollResponse(offer string, success bool, natType string, v Version) ([]byte, error) {
+	return EncodePollResponseWithRelayURL(offer, success, natType, "", v)
 }
 
-func EncodePollResponse(offer string, success bool, natType string) ([]byte, error) {
+// Like EncodePollResponse, but also tells the proxy which bridge to relay the
+// client to. relayURL may be empty, for the proxy's own bridge; otherwise the
+// proxy must speak a version that supports it.
+func EncodePollResponseWithRelayURL(offer string, success bool, natType, relayURL string, v Version) ([]byte, error) {
 	if success {
+		if relayURL != "" {
+			if !v.Supports(CapabilityRelayURL) {
+				return nil, fmt.Errorf("version %s doesn't support a relay URL", v)
+			}
+			if err := validateRelayURL(relayURL); err != nil {
+				return nil, err
+			}
+		}
 		return json.Marshal(ProxyPollResponse{
-			Status: "client match",
-			Offer:  offer,
-			NAT:    natType,
+			Status:   "client match",
+			Offer:    offer,
+			NAT:      natType,
+			RelayURL: relayURL,
+			Version:  v.String(),
 		})
 
 	}
 	return json.Marshal(ProxyPollResponse{
-		Status: "no match",
+		Status:  "no match",
+		Version: v.String(),
 	})
 }
 
 // Decodes a poll response from the broker and returns an offer and the client's NAT type
 // If there is a client match, the returned offer string will be non-empty
+// A response that names a bridge to relay to is an error, because the caller
+// would relay the client to the wrong one.
 func DecodePollResponse(data []byte) (string, string, error) {
+	offer, natType, relayURL, err := DecodePollResponseWithRelayURL(data)
+	if err != nil {
+		return "", "", err
+	}
+	if relayURL != "" {
+		return "", "", fmt.Errorf("received unexpected relay URL")
+	}
+	return offer, natType, nil
+}
+
+// Like DecodePollResponse, but also returns the URL of the bridge to relay the
+// client to, or "" if the proxy should use its own.
+func DecodePollResponseWithRelayURL(data []byte) (string, string, string, error) {
 	var message ProxyPollResponse
 
 	err := json.Unmarshal(data, &message)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 	if message.Status == "" {
-		return "", "", fmt.Errorf("received invalid data")
+		return "", "", "", fmt.Errorf("received invalid data")
 	}
 
 	if message.Status == "client match" {
 		if message.Offer == "" {
-			return "", "", fmt.Errorf("no supplied offer")
+			return "", "", "", fmt.Errorf("no supplied offer")
+		}
+		if message.RelayURL != "" {
+			if err := validateRelayURL(message.RelayURL); err != nil {
+				return "", "", "", err
+			}
 		}
 	} else {
 		message.Offer = ""
+		message.RelayURL = ""
 	}
 
 	natType := message.NAT
@@ -164,13 +322,34 @@ func DecodePollResponse(data []byte) (string, string, error) {
 		natType = "unknown"
 	}
 
-	return message.Offer, natType, nil
+	return message.Offer, natType, message.RelayURL, nil
+}
+
+// Returns the version of the protocol that a poll response from the broker was
+// encoded with. Brokers older than 1.2 don't give one, and are taken to speak
+// 1.1.
+func DecodePollResponseVersion(data []byte) (Version, error) {
+	var message ProxyPollResponse
+
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		return Version{}, err
+	}
+	if message.Version == "" {
+		return Version{1, 1}, nil
+	}
+	v, err := ParseVersion(message.Version)
+	if err != nil || v.Major != 1 {
+		return Version{}, fmt.Errorf("using unknown version")
+	}
+	return v, nil
 }
 
 type ProxyAnswerRequest struct {
 	Version string
 	Sid     string
-	Answer  string
+	Answer  string `json:",omitempty"`
+	Error   string `json:",omitempty"`
 }
 
 func EncodeAnswerRequest(answer string, sid string) ([]byte, error) {
@@ -181,25 +360,50 @@ func EncodeAnswerRequest(answer string, sid string) ([]byte, error) {
 	})
 }
 
+// Encodes the request of a proxy that can't answer its client, giving the
+// reason.
+func EncodeAnswerErrorRequest(reason string, sid string) ([]byte, error) {
+	return json.Marshal(ProxyAnswerRequest{
+		Version: version,
+		Sid:     sid,
+		Error:   reason,
+	})
+}
+
 // Returns the sdp answer and proxy sid
 func DecodeAnswerRequest(data []byte) (string, string, error) {
+	answer, answerError, sid, err := DecodeAnswerRequestWithError(data)
+	if err != nil {
+		return "", "", err
+	}
+	if answerError != "" {
+		return "", "", fmt.Errorf("no supplied sid or answer")
+	}
+	return answer, sid, nil
+}
+
+// Like DecodeAnswerRequest, but also accepts a request without an answer that
+// gives the reason the proxy couldn't answer instead. Returns the sdp answer,
+// that reason, and the proxy sid; exactly one of the answer and the reason is
+// non-empty.
+func DecodeAnswerRequestWithError(data []byte) (string, string, string, error) {
 	var message ProxyAnswerRequest
 
 	err := json.Unmarshal(data, &message)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
 
 	majorVersion := strings.Split(message.Version, ".")[0]
 	if majorVersion != "1" {
-		return "", "", fmt.Errorf("using unknown version")
+		return "", "", "", fmt.Errorf("using unknown version")
 	}
 
-	if message.Sid == "" || message.Answer == "" {
-		return "", "", fmt.Errorf("no supplied sid or answer")
+	if message.Sid == "" || (message.Answer == "") == (message.Error == "") {
+		return "", "", "", fmt.Errorf("no supplied sid or answer")
 	}
 
-	return message.Answer, message.Sid, nil
+	return message.Answer, message.Error, message.Sid, nil
 }
 
 type ProxyAnswerResponse struct {
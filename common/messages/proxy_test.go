@@ -78,7 +78,7 @@ func TestDecodeProxyPollRequest(t *testing.T) {
 				fmt.Errorf(""),
 			},
 		} {
-			sid, proxyType, natType, err := DecodePollRequest([]byte(test.data))
+			sid, proxyType, natType, _, err := DecodePollRequest([]byte(test.data))
 			So(sid, ShouldResemble, test.sid)
 			So(proxyType, ShouldResemble, test.proxyType)
 			So(natType, ShouldResemble, test.natType)
@@ -92,14 +92,61 @@ func TestEncodeProxyPollRequests(t *testing.T) {
 	Convey("Context", t, func() {
 		b, err := EncodePollRequest("ymbcCMto7KHNGYlp", "standalone", "unknown")
 		So(err, ShouldEqual, nil)
-		sid, proxyType, natType, err := DecodePollRequest(b)
+		sid, proxyType, natType, v, err := DecodePollRequest(b)
 		So(sid, ShouldEqual, "ymbcCMto7KHNGYlp")
 		So(proxyType, ShouldEqual, "standalone")
 		So(natType, ShouldEqual, "unknown")
+		So(v, ShouldResemble, CurrentVersion)
 		So(err, ShouldEqual, nil)
 	})
 }
 
+func TestVersions(t *testing.T) {
+	Convey("Versions", t, func() {
+		Convey("are parsed", func() {
+			v, err := ParseVersion("1.2")
+			So(err, ShouldBeNil)
+			So(v, ShouldResemble, Version{1, 2})
+			So(v.String(), ShouldEqual, "1.2")
+			for _, bad := range []string{"", "1", "1.", "1.x", "1.2.3", "-1.0"} {
+				_, err := ParseVersion(bad)
+				So(err, ShouldNotBeNil)
+			}
+		})
+
+		Convey("have the capabilities of their minor version", func() {
+			So(Version{1, 0}.Capabilities(), ShouldBeEmpty)
+			So(Version{1, 1}.Capabilities(), ShouldResemble,
+				map[Capability]bool{CapabilityProxyType: true})
+			So(Version{1, 2}.Capabilities(), ShouldResemble,
+				map[Capability]bool{CapabilityProxyType: true, CapabilityNAT: true})
+			So(Version{2, 5}.Supports(CapabilityNAT), ShouldBeFalse)
+		})
+
+		Convey("are negotiated down to the lower one", func() {
+			So(NegotiateVersion(Version{1, 0}), ShouldResemble, Version{1, 0})
+			So(NegotiateVersion(Version{1, 9}), ShouldResemble, CurrentVersion)
+		})
+
+		Convey("are returned from poll requests", func() {
+			_, proxyType, _, v, err := DecodePollRequest(
+				[]byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.0","Type":"standalone"}`))
+			So(err, ShouldBeNil)
+			So(v, ShouldResemble, Version{1, 0})
+			So(v.Supports(CapabilityProxyType), ShouldBeFalse)
+			// Fields are read even if the version predates them.
+			So(proxyType, ShouldEqual, "standalone")
+
+			// A newer proxy is understood as far as this version goes.
+			_, _, natType, v, err := DecodePollRequest(
+				[]byte(`{"Sid":"ymbcCMto7KHNGYlp","Version":"1.7","NAT":"restricted"}`))
+			So(err, ShouldBeNil)
+			So(v, ShouldResemble, Version{1, 7})
+			So(natType, ShouldEqual, "restricted")
+		})
+	})
+}
+
 func TestDecodeProxyPollResponse(t *testing.T) {
 	Convey("Context", t, func() {
 		for _, test := range []struct {
@@ -138,14 +185,20 @@ func TestDecodeProxyPollResponse(t *testing.T) {
 
 func TestEncodeProxyPollResponse(t *testing.T) {
 	Convey("Context", t, func() {
-		b, err := EncodePollResponse("fake offer", true, "restricted")
+		b, err := EncodePollResponse("fake offer", true, "restricted", CurrentVersion)
 		So(err, ShouldEqual, nil)
+		So(string(b), ShouldContainSubstring, `"Version":"`+CurrentVersion.String()+`"`)
 		offer, natType, err := DecodePollResponse(b)
 		So(offer, ShouldEqual, "fake offer")
 		So(natType, ShouldEqual, "restricted")
 		So(err, ShouldEqual, nil)
 
-		b, err = EncodePollResponse("", false, "unknown")
+		// Older proxies are sent the NAT type too, as they always were.
+		b, err = EncodePollResponse("fake offer", true, "restricted", Version{1, 1})
+		So(err, ShouldEqual, nil)
+		So(string(b), ShouldEqual, `{"Status":"client match","Offer":"fake offer","NAT":"restricted","Version":"1.1"}`)
+
+		b, err = EncodePollResponse("", false, "unknown", CurrentVersion)
 		So(err, ShouldEqual, nil)
 		offer, natType, err = DecodePollResponse(b)
 		So(offer, ShouldEqual, "")
@@ -153,6 +206,75 @@ func TestEncodeProxyPollResponse(t *testing.T) {
 		So(err, ShouldEqual, nil)
 	})
 }
+
+func TestEncodeProxyPollResponseWithRelayURL(t *testing.T) {
+	Convey("Context", t, func() {
+		b, err := EncodePollResponseWithRelayURL("fake offer", true, "restricted",
+			"wss://bridge.example/", CurrentVersion)
+		So(err, ShouldEqual, nil)
+		offer, natType, relayURL, err := DecodePollResponseWithRelayURL(b)
+		So(err, ShouldEqual, nil)
+		So(offer, ShouldEqual, "fake offer")
+		So(natType, ShouldEqual, "restricted")
+		So(relayURL, ShouldEqual, "wss://bridge.example/")
+
+		// A proxy that doesn't know about relay URLs must not get one.
+		_, _, err = DecodePollResponse(b)
+		So(err, ShouldNotBeNil)
+		_, err = EncodePollResponseWithRelayURL("fake offer", true, "restricted",
+			"wss://bridge.example/", Version{1, 2})
+		So(err, ShouldNotBeNil)
+
+		// Without a relay URL, the response is as before.
+		b, err = EncodePollResponseWithRelayURL("fake offer", true, "restricted", "", Version{1, 2})
+		So(err, ShouldEqual, nil)
+		So(string(b), ShouldEqual, `{"Status":"client match","Offer":"fake offer","NAT":"restricted","Version":"1.2"}`)
+		offer, _, relayURL, err = DecodePollResponseWithRelayURL(b)
+		So(err, ShouldEqual, nil)
+		So(offer, ShouldEqual, "fake offer")
+		So(relayURL, ShouldEqual, "")
+
+		for _, bad := range []string{
+			"bridge.example",
+			"https://bridge.example/",
+			"wss:///path",
+			"ws://[::1",
+		} {
+			_, err = EncodePollResponseWithRelayURL("fake offer", true, "", bad, CurrentVersion)
+			So(err, ShouldNotBeNil)
+			_, _, _, err = DecodePollResponseWithRelayURL([]byte(
+				`{"Status":"client match","Offer":"fake offer","RelayURL":"` + bad + `"}`))
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+func TestDecodeProxyPollResponseVersion(t *testing.T) {
+	Convey("Context", t, func() {
+		b, err := EncodePollResponse("fake offer", true, "restricted", Version{1, 3})
+		So(err, ShouldEqual, nil)
+		v, err := DecodePollResponseVersion(b)
+		So(err, ShouldEqual, nil)
+		So(v, ShouldResemble, Version{1, 3})
+		So(v.Supports(CapabilityAnswerError), ShouldBeFalse)
+
+		b, err = EncodePollResponse("", false, "", CurrentVersion)
+		So(err, ShouldEqual, nil)
+		v, err = DecodePollResponseVersion(b)
+		So(err, ShouldEqual, nil)
+		So(v, ShouldResemble, CurrentVersion)
+
+		// Brokers older than 1.2 don't send a version.
+		v, err = DecodePollResponseVersion([]byte(`{"Status":"no match"}`))
+		So(err, ShouldEqual, nil)
+		So(v, ShouldResemble, Version{1, 1})
+
+		_, err = DecodePollResponseVersion([]byte(`{"Status":"no match","Version":"2.0"}`))
+		So(err, ShouldNotBeNil)
+		_, err = DecodePollResponseVersion([]byte("test"))
+		So(err, ShouldNotBeNil)
+	})
+}
+
 func TestDecodeProxyAnswerRequest(t *testing.T) {
 	Convey("Context", t, func() {
 		for _, test := range []struct {
@@ -204,6 +326,35 @@ func TestEncodeProxyAnswerRequest(t *testing.T) {
 		So(sid, ShouldEqual, "test sid")
 		So(err, ShouldEqual, nil)
 	})
+
+	Convey("Answer requests may carry an error instead", t, func() {
+		b, err := EncodeAnswerErrorRequest("no candidates", "test sid")
+		So(err, ShouldBeNil)
+		So(string(b), ShouldNotContainSubstring, "Answer")
+		answer, answerError, sid, err := DecodeAnswerRequestWithError(b)
+		So(err, ShouldBeNil)
+		So(answer, ShouldEqual, "")
+		So(answerError, ShouldEqual, "no candidates")
+		So(sid, ShouldEqual, "test sid")
+
+		// DecodeAnswerRequest wants an answer.
+		_, _, err = DecodeAnswerRequest(b)
+		So(err, ShouldNotBeNil)
+
+		answer, answerError, _, err = DecodeAnswerRequestWithError(
+			[]byte(`{"Version":"1.0","Sid":"test","Answer":"test"}`))
+		So(err, ShouldBeNil)
+		So(answer, ShouldEqual, "test")
+		So(answerError, ShouldEqual, "")
+
+		// Not both, and not neither.
+		_, _, _, err = DecodeAnswerRequestWithError(
+			[]byte(`{"Version":"1.4","Sid":"test","Answer":"test","Error":"test"}`))
+		So(err, ShouldNotBeNil)
+		_, _, _, err = DecodeAnswerRequestWithError(
+			[]byte(`{"Version":"1.4","Sid":"test"}`))
+		So(err, ShouldNotBeNil)
+	})
 }
 
 func TestDecodeProxyAnswerResponse(t *testing.T) {
@@ -40,6 +40,57 @@ func CheckIfRestrictedNAT(server string) (bool, error) {
 	return isRestrictedMapping(server)
 }
 
+// The results of the RFC 5780 mapping and filtering tests.
+type Behavior struct {
+	// Whether the NAT mapping is address-dependent.
+	RestrictedMapping bool
+	// Whether the NAT filtering is port-dependent.
+	RestrictedFiltering bool
+}
+
+// NATType returns NATRestricted if either the mapping or the filtering is
+// restrictive, and NATUnrestricted otherwise.
+func (b Behavior) NATType() string {
+	if b.RestrictedMapping || b.RestrictedFiltering {
+		return NATRestricted
+	}
+	return NATUnrestricted
+}
+
+// This function runs both the mapping and the filtering tests, for reporting
+// the full behaviour of a NAT. The server must support RFC 5780.
+func CheckNATBehavior(server string) (Behavior, error) {
+	var b Behavior
+	var err error
+	b.RestrictedMapping, err = isRestrictedMapping(server)
+	if err != nil {
+		return b, err
+	}
+	b.RestrictedFiltering, err = isRestrictedFiltering(server)
+	return b, err
+}
+
+// Sends a binding request to a STUN server and returns the reflexive address
+// that it reports, to check that the server is reachable and working.
+func GetReflexiveAddress(server string) (*net.UDPAddr, error) {
+	conn, err := connect(server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	resp, err := conn.RoundTrip(message, conn.PrimaryAddr)
+	if err != nil {
+		return nil, err
+	}
+	var xorAddr stun.XORMappedAddress
+	if err = xorAddr.GetFrom(resp); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: xorAddr.IP, Port: xorAddr.Port}, nil
+}
+
 // Performs two tests from RFC 5780 to determine whether the mapping type
 // of the client's NAT is address-independent or address-dependent
 // Returns true if the mapping is address-dependent and false otherwise
@@ -110,9 +161,8 @@ func isRestrictedMapping(addrStr string) (bool, error) {
 // Performs two tests from RFC 5780 to determine whether the filtering type
 // of the client's NAT is port-dependent.
 // Returns true if the filtering is port-dependent and false otherwise
-// Note: This function is no longer used because a client's NAT type is
-// determined only by their mapping type, but the functionality might
-// be useful in the future and remains here.
+// Note: A client's NAT type is determined only by their mapping type, so
+// this function is used only by CheckNATBehavior.
 func isRestrictedFiltering(addrStr string) (bool, error) {
 	var xorAddr stun.XORMappedAddress
 
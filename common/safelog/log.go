@@ -31,10 +31,26 @@ var addressRegexp = regexp.MustCompile(addressPattern)
 type LogScrubber struct {
 	Output io.Writer
 	buffer []byte
+	// Patterns added with AddPattern, scrubbed after IP addresses.
+	patterns []extraPattern
 
 	lock sync.Mutex
 }
 
+type extraPattern struct {
+	re          *regexp.Regexp
+	replacement []byte
+}
+
+// Adds a pattern to scrub, in addition to IP addresses. Matches of re are
+// replaced with replacement, in which $1 and so on stand for submatches, as in
+// regexp.Regexp.ReplaceAll. Patterns apply in the order they were added.
+func (ls *LogScrubber) AddPattern(re *regexp.Regexp, replacement string) {
+	ls.Lock()
+	defer ls.Unlock()
+	ls.patterns = append(ls.patterns, extraPattern{re, []byte(replacement)})
+}
+
 func (ls *LogScrubber) Lock()   { (*ls).lock.Lock() }
 func (ls *LogScrubber) Unlock() { (*ls).lock.Unlock() }
 
@@ -61,8 +77,11 @@ func (ls *LogScrubber) Write(b []byte) (n int, err error) {
 		if i == -1 {
 			return
 		}
-		fullLines := ls.buffer[:i+1]
-		_, err = ls.Output.Write(scrub(fullLines))
+		fullLines := scrub(ls.buffer[:i+1])
+		for _, p := range ls.patterns {
+			fullLines = p.re.ReplaceAll(fullLines, p.replacement)
+		}
+		_, err = ls.Output.Write(fullLines)
 		if err != nil {
 			return
 		}
@@ -3,6 +3,7 @@ package safelog
 import (
 	"bytes"
 	"log"
+	"regexp"
 	"testing"
 )
 
@@ -77,6 +78,35 @@ func TestLogScrubberMessages(t *testing.T) {
 			"2019/05/08 15:37:31 starting",
 			"2019/05/08 15:37:31 starting\n",
 		},
+		{
+			//Make sure it doesn't scrub version numbers
+			"snowflake-client 1.2.3 (pt version 2.0.1)",
+			"snowflake-client 1.2.3 (pt version 2.0.1)\n",
+		},
+		{
+			//IPv6 ICE candidates, full and compressed
+			"a=candidate:3769337065 1 udp 2122260223 2001:db8:85a3:0:0:8a2e:370:7334 56688 typ host generation 0",
+			"a=candidate:3769337065 1 udp 2122260223 [scrubbed] 56688 typ host generation 0\n",
+		},
+		{
+			"a=candidate:1694354427 1 udp 1686052607 2001:db8::1 56688 typ srflx raddr fe80::1 rport 56688",
+			"a=candidate:1694354427 1 udp 1686052607 [scrubbed] 56688 typ srflx raddr [scrubbed] rport 56688\n",
+		},
+		{
+			//IPv4-mapped IPv6 candidate
+			"a=candidate:1 1 udp 2122260223 ::ffff:192.0.2.1 56688 typ host",
+			"a=candidate:1 1 udp 2122260223 [scrubbed] 56688 typ host\n",
+		},
+		{
+			//IPv6 in an SDP serialized as JSON, with escaped line breaks
+			`{"type":"offer","sdp":"v=0\r\no=- 1 2 IN IP6 2001:db8::1\r\nc=IN IP6 2001:db8::dead:beef\r\n"}`,
+			`{"type":"offer","sdp":"v=0\r\no=- 1 2 IN IP6 [scrubbed]\r\nc=IN IP6 [scrubbed]\r\n"}` + "\n",
+		},
+		{
+			//IPv6 with a port in an error message
+			"error dialing [2001:db8::1]:443: connection refused",
+			"error dialing [scrubbed]: connection refused\n",
+		},
 	} {
 		var buff bytes.Buffer
 		log.SetFlags(0) //remove all extra log output for test comparisons
@@ -146,3 +176,16 @@ func TestLogScrubberGoodFormats(t *testing.T) {
 		}
 	}
 }
+
+func TestLogScrubberAddPattern(t *testing.T) {
+	var buff bytes.Buffer
+	scrubber := &LogScrubber{Output: &buff}
+	scrubber.AddPattern(regexp.MustCompile(`session ([0-9a-f]+)`), "session [id]")
+	scrubber.AddPattern(regexp.MustCompile(`(token=)\w+`), "${1}[redacted]")
+	logger := log.New(scrubber, "", 0)
+	logger.Print("session 0123abcd from 1.2.3.4:5678 with token=s3cr3t")
+	expected := "session [id] from [scrubbed] with token=[redacted]\n"
+	if buff.String() != expected {
+		t.Errorf("Got %q, expected %q", buff.String(), expected)
+	}
+}
@@ -0,0 +1,183 @@
+package turbotunnel
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// lossyPacketConn wraps a net.PacketConn and drops, duplicates, reorders, and
+// delays the packets written to it, for testing what runs over a PacketConn in
+// adverse conditions. Its decisions come from a seeded source of randomness, so
+// that a failing test can be repeated.
+type lossyPacketConn struct {
+	net.PacketConn
+	// Probabilities that a packet is dropped, duplicated, or held back to
+	// be sent after the next one.
+	Loss      float64
+	Duplicate float64
+	Reorder   float64
+	// Each packet is delayed by a random time up to MaxDelay.
+	MaxDelay time.Duration
+
+	lock sync.Mutex
+	rng  *rand.Rand
+	held []byte
+}
+
+func newLossyPacketConn(conn net.PacketConn, seed int64) *lossyPacketConn {
+	return &lossyPacketConn{PacketConn: conn, rng: rand.New(rand.NewSource(seed))}
+}
+
+func (c *lossyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.rng.Float64() < c.Loss {
+		return len(p), nil
+	}
+	// Copy the slice so that the caller may reuse it.
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	if c.held == nil && c.rng.Float64() < c.Reorder {
+		c.held = buf
+		return len(p), nil
+	}
+	packets := [][]byte{buf}
+	if c.rng.Float64() < c.Duplicate {
+		packets = append(packets, buf)
+	}
+	if c.held != nil {
+		packets = append(packets, c.held)
+		c.held = nil
+	}
+	for _, packet := range packets {
+		var delay time.Duration
+		if c.MaxDelay > 0 {
+			delay = time.Duration(c.rng.Int63n(int64(c.MaxDelay)))
+		}
+		packet := packet
+		time.AfterFunc(delay, func() { c.PacketConn.WriteTo(packet, addr) })
+	}
+	return len(p), nil
+}
+
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "fake" }
+func (a fakeAddr) String() string  { return string(a) }
+
+// Returns two QueuePacketConns, each of which receives what the other writes
+// to its address.
+func queuePacketConnPair() (*QueuePacketConn, *QueuePacketConn) {
+	addrA, addrB := fakeAddr("a"), fakeAddr("b")
+	a := NewQueuePacketConn(addrA, time.Minute)
+	b := NewQueuePacketConn(addrB, time.Minute)
+	pump := func(from, to *QueuePacketConn, toAddr net.Addr) {
+		for {
+			select {
+			case p := <-from.OutgoingQueue(toAddr):
+				to.QueueIncoming(p, from.LocalAddr())
+			case <-from.closed:
+				return
+			}
+		}
+	}
+	go pump(a, b, addrB)
+	go pump(b, a, addrA)
+	return a, b
+}
+
+func TestLossyPacketConn(t *testing.T) {
+	a, b := queuePacketConnPair()
+	defer a.Close()
+	defer b.Close()
+
+	// With no loss, everything arrives, once.
+	lossy := newLossyPacketConn(a, 1)
+	for i := 0; i < 10; i++ {
+		lossy.WriteTo([]byte{byte(i)}, b.LocalAddr())
+	}
+	seen := make(map[byte]bool)
+	for i := 0; i < 10; i++ {
+		var buf [1]byte
+		_, _, err := b.ReadFrom(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[buf[0]] {
+			t.Fatalf("packet %d received twice", buf[0])
+		}
+		seen[buf[0]] = true
+	}
+}
+
+// KCP, which carries turbotunnel sessions, must deliver a complete stream in
+// order through a channel that loses, duplicates, reorders, and delays packets.
+func TestKCPOverLossyPacketConn(t *testing.T) {
+	a, b := queuePacketConnPair()
+	defer a.Close()
+	defer b.Close()
+
+	clientConn := newLossyPacketConn(a, 1)
+	serverConn := newLossyPacketConn(b, 2)
+	for _, c := range []*lossyPacketConn{clientConn, serverConn} {
+		c.Loss = 0.1
+		c.Duplicate = 0.05
+		c.Reorder = 0.1
+		c.MaxDelay = 5 * time.Millisecond
+	}
+
+	ln, err := kcp.ServeConn(nil, 0, 0, serverConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+
+	received := make(chan []byte, 1)
+	go func() {
+		defer close(received)
+		conn, err := ln.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetNoDelay(1, 10, 2, 1)
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil {
+			return
+		}
+		received <- buf
+	}()
+
+	conn, err := kcp.NewConn2(b.LocalAddr(), nil, 0, 0, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetNoDelay(1, 10, 2, 1)
+	conn.SetWindowSize(queueSize, queueSize)
+	go conn.Write(data)
+
+	select {
+	case buf, ok := <-received:
+		if !ok {
+			t.Fatal("error receiving stream")
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatal("stream received differs from the one sent")
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("timed out receiving stream")
+	}
+}
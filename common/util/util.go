@@ -3,7 +3,9 @@ package util
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
+	"strings"
 
 	"github.com/pion/ice/v2"
 	"github.com/pion/sdp/v3"
@@ -31,8 +33,13 @@ func DeserializeSessionDescription(msg string) (*webrtc.SessionDescription, erro
 		return nil, errors.New("cannot deserialize SessionDescription without sdp field")
 	}
 
+	sdp, ok := parsed["sdp"].(string)
+	if !ok {
+		return nil, errors.New("SessionDescription sdp field is not a string")
+	}
+
 	var stype webrtc.SDPType
-	switch parsed["type"].(string) {
+	switch parsed["type"] {
 	default:
 		return nil, errors.New("Unknown SDP type")
 	case "offer":
@@ -47,7 +54,7 @@ func DeserializeSessionDescription(msg string) (*webrtc.SessionDescription, erro
 
 	return &webrtc.SessionDescription{
 		Type: stype,
-		SDP:  parsed["sdp"].(string),
+		SDP:  sdp,
 	}, nil
 }
 
@@ -69,27 +76,150 @@ func IsLocal(ip net.IP) bool {
 
 // Removes local LAN address ICE candidates
 func StripLocalAddresses(str string) string {
+	return ScrubSDP(str, ScrubPolicy{StripLocalCandidates: true})
+}
+
+// Returns the number of ICE candidate attributes in an SDP string
+func CountICECandidates(str string) (int, error) {
 	var desc sdp.SessionDescription
 	err := desc.Unmarshal([]byte(str))
 	if err != nil {
-		return str
+		return 0, err
 	}
+	count := 0
 	for _, m := range desc.MediaDescriptions {
-		attrs := make([]sdp.Attribute, 0)
 		for _, a := range m.Attributes {
 			if a.IsICECandidate() {
-				c, err := ice.UnmarshalCandidate(a.Value)
-				if err == nil && c.Type() == ice.CandidateTypeHost {
-					ip := net.ParseIP(c.Address())
-					if ip != nil && (IsLocal(ip) || ip.IsUnspecified() || ip.IsLoopback()) {
-						/* no append in this case */
-						continue
-					}
-				}
+				count++
 			}
-			attrs = append(attrs, a)
 		}
-		m.Attributes = attrs
+	}
+	return count, nil
+}
+
+// Attributes that are needed to establish a data channel connection. All
+// others are removed by MinifySDP.
+var essentialAttributes = map[string]bool{
+	"group":             true,
+	"fingerprint":       true,
+	"setup":             true,
+	"mid":               true,
+	"sctp-port":         true,
+	"sctpmap":           true,
+	"max-message-size":  true,
+	"ice-ufrag":         true,
+	"ice-pwd":           true,
+	"ice-lite":          true,
+	"candidate":         true,
+	"end-of-candidates": true,
+}
+
+// Removes all attributes that are not needed for ICE, DTLS, and SCTP
+// negotiation of a data channel, to make the SDP smaller and more uniform.
+// The result is itself a valid SDP and needs no expansion by the receiver.
+func MinifySDP(str string) string {
+	return ScrubSDP(str, ScrubPolicy{Normalize: true})
+}
+
+// Returns the value of an ICE attribute such as ice-ufrag, which may appear at
+// the session level or in a media description.
+func iceAttribute(desc *sdp.SessionDescription, key string) string {
+	if value, ok := desc.Attribute(key); ok {
+		return value
+	}
+	for _, m := range desc.MediaDescriptions {
+		if value, ok := m.Attribute(key); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// Returns the ice-ufrag of an SDP string, which is different for every session,
+// or "" if it has none or can't be parsed.
+func ICEUfrag(str string) string {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(str)); err != nil {
+		return ""
+	}
+	return iceAttribute(&desc, "ice-ufrag")
+}
+
+// Checks that answer is plausibly a response to offer. An answer made for some
+// other offer may be accepted by SetRemoteDescription, but can never connect.
+// The answer must have the same media sections as the offer, in the same order
+// and with the same mids, and its ICE credentials must not be the offer's own.
+func CheckAnswer(offer, answer *webrtc.SessionDescription) error {
+	if answer.Type != webrtc.SDPTypeAnswer {
+		return fmt.Errorf("expected an answer, got %v", answer.Type)
+	}
+	var offerDesc, answerDesc sdp.SessionDescription
+	if err := offerDesc.Unmarshal([]byte(offer.SDP)); err != nil {
+		return err
+	}
+	if err := answerDesc.Unmarshal([]byte(answer.SDP)); err != nil {
+		return err
+	}
+
+	if len(answerDesc.MediaDescriptions) != len(offerDesc.MediaDescriptions) {
+		return fmt.Errorf("answer has %d media sections, offer has %d",
+			len(answerDesc.MediaDescriptions), len(offerDesc.MediaDescriptions))
+	}
+	for i, m := range offerDesc.MediaDescriptions {
+		offerMid, _ := m.Attribute("mid")
+		answerMid, _ := answerDesc.MediaDescriptions[i].Attribute("mid")
+		if answerMid != offerMid {
+			return fmt.Errorf("answer has mid %q where offer has %q", answerMid, offerMid)
+		}
+	}
+
+	ufrag := iceAttribute(&answerDesc, "ice-ufrag")
+	if ufrag == "" {
+		return errors.New("answer has no ice-ufrag")
+	}
+	if ufrag == iceAttribute(&offerDesc, "ice-ufrag") {
+		return errors.New("answer has the same ice-ufrag as the offer")
+	}
+	return nil
+}
+
+// What ScrubSDP removes from or rewrites in a session description.
+type ScrubPolicy struct {
+	// Remove host candidates with local LAN, loopback, or unspecified
+	// addresses.
+	StripLocalCandidates bool
+	// Remove all host candidates, which reveal the addresses of local
+	// interfaces.
+	StripHostCandidates bool
+	// Remove candidates whose address is an mDNS hostname ending in
+	// ".local".
+	StripMDNSCandidates bool
+	// Replace DTLS certificate fingerprints with a placeholder. The result
+	// can't be used to make a connection, only to log.
+	RedactFingerprints bool
+	// Remove attributes not needed for a data channel, as MinifySDP does.
+	Normalize bool
+}
+
+// The value that RedactFingerprints puts in place of a fingerprint's hash.
+const redactedFingerprint = "[scrubbed]"
+
+// Applies policy to an SDP string. If str can't be parsed, it is returned
+// unchanged.
+func ScrubSDP(str string, policy ScrubPolicy) string {
+	// An SDP must begin with its version line. The parser doesn't insist
+	// on it, and would otherwise turn garbage into an empty description.
+	if !strings.HasPrefix(str, "v=") {
+		return str
+	}
+	var desc sdp.SessionDescription
+	err := desc.Unmarshal([]byte(str))
+	if err != nil {
+		return str
+	}
+	desc.Attributes = policy.scrub(desc.Attributes)
+	for _, m := range desc.MediaDescriptions {
+		m.Attributes = policy.scrub(m.Attributes)
 	}
 	bts, err := desc.Marshal()
 	if err != nil {
@@ -97,3 +227,42 @@ func StripLocalAddresses(str string) string {
 	}
 	return string(bts)
 }
+
+func (policy ScrubPolicy) scrub(attributes []sdp.Attribute) []sdp.Attribute {
+	attrs := make([]sdp.Attribute, 0)
+	for _, a := range attributes {
+		if policy.Normalize && !essentialAttributes[a.Key] {
+			continue
+		}
+		if a.IsICECandidate() && policy.stripCandidate(a.Value) {
+			continue
+		}
+		if a.Key == "fingerprint" && policy.RedactFingerprints {
+			// The value is a hash function name and the hash.
+			hash := strings.SplitN(a.Value, " ", 2)[0]
+			a = sdp.NewAttribute(a.Key, hash+" "+redactedFingerprint)
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+// Reports whether the policy removes the candidate in an a=candidate value.
+func (policy ScrubPolicy) stripCandidate(value string) bool {
+	c, err := ice.UnmarshalCandidate(value)
+	if err != nil {
+		return false
+	}
+	if policy.StripMDNSCandidates && strings.HasSuffix(c.Address(), ".local") {
+		return true
+	}
+	if c.Type() != ice.CandidateTypeHost {
+		return false
+	}
+	if policy.StripHostCandidates {
+		return true
+	}
+	ip := net.ParseIP(c.Address())
+	return policy.StripLocalCandidates &&
+		ip != nil && (IsLocal(ip) || ip.IsUnspecified() || ip.IsLoopback())
+}
@@ -3,6 +3,8 @@ package util
 import (
 	"testing"
 
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -25,4 +27,133 @@ func TestUtil(t *testing.T) {
 
 		So(StripLocalAddresses(offer), ShouldEqual, offerStart+goodCandidate+offerEnd)
 	})
+	Convey("Minify", t, func() {
+		const offer = "v=0\r\no=- 4358805017720277108 2 IN IP4 8.8.8.8\r\ns=-\r\nt=0 0\r\na=group:BUNDLE data\r\na=msid-semantic: WMS\r\nm=application 56688 DTLS/SCTP 5000\r\nc=IN IP4 8.8.8.8\r\n" +
+			"a=candidate:3769337065 1 udp 2122260223 8.8.8.8 56688 typ host generation 0 network-id 1 network-cost 50\r\n" +
+			"a=candidate:1694354427 1 udp 1686052607 1.2.3.4 56688 typ srflx raddr 8.8.8.8 rport 56688 generation 0 network-id 1 network-cost 50\r\n" +
+			"a=ice-ufrag:aMAZ\r\na=ice-pwd:jcHb08Jjgrazp2dzjdrvPPvV\r\na=ice-options:trickle\r\na=fingerprint:sha-256 C8:88:EE:B9:E7:02:2E:21:37:ED:7A:D1:EB:2B:A3:15:A2:3B:5B:1C:3D:D4:D5:1F:06:CF:52:40:03:F8:DD:66\r\na=setup:actpass\r\na=mid:data\r\na=sctpmap:5000 webrtc-datachannel 1024\r\n"
+
+		// Collects the values of the given attribute from every part of
+		// the description.
+		values := func(str string, key string) []string {
+			var desc sdp.SessionDescription
+			So(desc.Unmarshal([]byte(str)), ShouldBeNil)
+			var vals []string
+			for _, a := range desc.Attributes {
+				if a.Key == key {
+					vals = append(vals, a.Value)
+				}
+			}
+			for _, m := range desc.MediaDescriptions {
+				for _, a := range m.Attributes {
+					if a.Key == key {
+						vals = append(vals, a.Value)
+					}
+				}
+			}
+			return vals
+		}
+
+		minified := MinifySDP(offer)
+		So(len(minified), ShouldBeLessThan, len(offer))
+		for _, key := range []string{"candidate", "ice-ufrag", "ice-pwd", "fingerprint", "setup", "mid", "group"} {
+			So(values(minified, key), ShouldResemble, values(offer, key))
+		}
+		So(values(minified, "msid-semantic"), ShouldBeEmpty)
+		So(values(minified, "ice-options"), ShouldBeEmpty)
+
+		// Invalid input is returned unchanged.
+		So(MinifySDP("test"), ShouldEqual, "test")
+	})
+	Convey("Scrub", t, func() {
+		const start = "v=0\r\no=- 4358805017720277108 2 IN IP4 8.8.8.8\r\ns=-\r\nt=0 0\r\na=group:BUNDLE data\r\na=msid-semantic: WMS\r\nm=application 56688 DTLS/SCTP 5000\r\nc=IN IP4 8.8.8.8\r\n"
+		const public = "a=candidate:3769337065 1 udp 2122260223 8.8.8.8 56688 typ host generation 0\r\n"
+		const local = "a=candidate:3769337065 1 udp 2122260223 192.168.0.100 56688 typ host generation 0\r\n"
+		const mdns = "a=candidate:1410536466 1 udp 2122262783 d2b0f5e4-2d36-4e8e-a4a7-0c4e6f9d5b2a.local 56688 typ host generation 0\r\n"
+		const srflx = "a=candidate:1694354427 1 udp 1686052607 1.2.3.4 56688 typ srflx raddr 8.8.8.8 rport 56688 generation 0\r\n"
+		const ice = "a=ice-ufrag:aMAZ\r\na=ice-pwd:jcHb08Jjgrazp2dzjdrvPPvV\r\n"
+		const options = "a=ice-options:trickle\r\n"
+		const fingerprint = "a=fingerprint:sha-256 C8:88:EE:B9:E7:02:2E:21:37:ED:7A:D1:EB:2B:A3:15:A2:3B:5B:1C:3D:D4:D5:1F:06:CF:52:40:03:F8:DD:66\r\n"
+		const end = "a=setup:actpass\r\na=mid:data\r\na=sctpmap:5000 webrtc-datachannel 1024\r\n"
+		const offer = start + public + local + mdns + srflx + ice + options + fingerprint + end
+
+		So(ScrubSDP(offer, ScrubPolicy{}), ShouldEqual, offer)
+
+		So(ScrubSDP(offer, ScrubPolicy{StripLocalCandidates: true}), ShouldEqual,
+			start+public+mdns+srflx+ice+options+fingerprint+end)
+
+		So(ScrubSDP(offer, ScrubPolicy{StripHostCandidates: true}), ShouldEqual,
+			start+srflx+ice+options+fingerprint+end)
+
+		So(ScrubSDP(offer, ScrubPolicy{StripMDNSCandidates: true}), ShouldEqual,
+			start+public+local+srflx+ice+options+fingerprint+end)
+
+		So(ScrubSDP(offer, ScrubPolicy{RedactFingerprints: true}), ShouldEqual,
+			start+public+local+mdns+srflx+ice+options+"a=fingerprint:sha-256 [scrubbed]\r\n"+end)
+
+		normalized := ScrubSDP(offer, ScrubPolicy{Normalize: true})
+		So(normalized, ShouldEqual, MinifySDP(offer))
+		So(normalized, ShouldNotContainSubstring, "ice-options")
+		So(normalized, ShouldNotContainSubstring, "msid-semantic")
+		So(normalized, ShouldContainSubstring, mdns)
+
+		// Policies combine.
+		scrubbed := ScrubSDP(offer, ScrubPolicy{
+			StripLocalCandidates: true,
+			StripMDNSCandidates:  true,
+			RedactFingerprints:   true,
+			Normalize:            true,
+		})
+		So(scrubbed, ShouldContainSubstring, public)
+		So(scrubbed, ShouldContainSubstring, srflx)
+		So(scrubbed, ShouldNotContainSubstring, "192.168.0.100")
+		So(scrubbed, ShouldNotContainSubstring, ".local")
+		So(scrubbed, ShouldNotContainSubstring, "C8:88:EE")
+		So(scrubbed, ShouldNotContainSubstring, "ice-options")
+
+		// Invalid input is returned unchanged.
+		So(ScrubSDP("test", ScrubPolicy{StripHostCandidates: true}), ShouldEqual, "test")
+	})
+	Convey("CheckAnswer", t, func() {
+		description := func(mid, ufrag string) string {
+			return "v=0\r\no=- 4358805017720277108 2 IN IP4 8.8.8.8\r\ns=-\r\nt=0 0\r\na=group:BUNDLE " + mid + "\r\nm=application 56688 DTLS/SCTP 5000\r\nc=IN IP4 8.8.8.8\r\n" +
+				"a=ice-ufrag:" + ufrag + "\r\na=ice-pwd:jcHb08Jjgrazp2dzjdrvPPvV\r\na=fingerprint:sha-256 C8:88:EE:B9:E7:02:2E:21:37:ED:7A:D1:EB:2B:A3:15:A2:3B:5B:1C:3D:D4:D5:1F:06:CF:52:40:03:F8:DD:66\r\na=mid:" + mid + "\r\na=sctpmap:5000 webrtc-datachannel 1024\r\n"
+		}
+		offer := &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: description("0", "aMAZ")}
+
+		Convey("accepts a matching answer", func() {
+			answer := &webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: description("0", "bNBA")}
+			So(CheckAnswer(offer, answer), ShouldBeNil)
+		})
+
+		Convey("rejects an answer to a different offer", func() {
+			answer := &webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: description("data", "bNBA")}
+			So(CheckAnswer(offer, answer), ShouldNotBeNil)
+		})
+
+		Convey("rejects an answer with the offer's own credentials", func() {
+			answer := &webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: description("0", "aMAZ")}
+			So(CheckAnswer(offer, answer), ShouldNotBeNil)
+		})
+
+		Convey("rejects an answer with no media", func() {
+			answer := &webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer,
+				SDP: "v=0\r\no=- 4358805017720277108 2 IN IP4 8.8.8.8\r\ns=-\r\nt=0 0\r\n"}
+			So(CheckAnswer(offer, answer), ShouldNotBeNil)
+		})
+
+		Convey("rejects an offer returned as an answer", func() {
+			So(CheckAnswer(offer, offer), ShouldNotBeNil)
+		})
+
+		Convey("rejects an unparseable answer", func() {
+			answer := &webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "test"}
+			So(CheckAnswer(offer, answer), ShouldNotBeNil)
+		})
+
+		Convey("ICEUfrag finds the ice-ufrag", func() {
+			So(ICEUfrag(description("0", "bNBA")), ShouldEqual, "bNBA")
+			So(ICEUfrag("test"), ShouldEqual, "")
+		})
+	})
 }
@@ -99,7 +99,8 @@ func probeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	offer, _, err := messages.DecodePollResponse(resp)
+	// The probe doesn't relay, so the relay URL doesn't matter.
+	offer, _, _, err := messages.DecodePollResponseWithRelayURL(resp)
 	if err != nil {
 		log.Printf("Error reading offer: %s", err.Error())
 		w.WriteHeader(http.StatusBadRequest)
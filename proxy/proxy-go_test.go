@@ -10,9 +10,12 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/common/messages"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/util"
 	"github.com/pion/webrtc/v3"
 	. "github.com/smartystreets/goconvey/convey"
@@ -34,6 +37,21 @@ func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return r, nil
 }
 
+// Like MockTransport, but keeps the body of the last request.
+type RecordingTransport struct {
+	MockTransport
+	request []byte
+}
+
+func (r *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var err error
+	r.request, err = ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	return r.MockTransport.RoundTrip(req)
+}
+
 // Set up a mock faulty transport
 type FaultyTransport struct {
 	statusOverride int
@@ -330,6 +348,26 @@ func TestSessionDescriptions(t *testing.T) {
 	})
 }
 
+func TestAnswerCandidates(t *testing.T) {
+	Convey("Answers without usable ICE candidates are refused", t, func() {
+		const header = "v=0\r\no=- 4358805017720277108 2 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\na=group:BUNDLE 0\r\nm=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\nc=IN IP4 0.0.0.0\r\na=ice-ufrag:aMAZ\r\na=ice-pwd:jcHb08Jjgrazp2dzjdrvPPvV\r\na=mid:0\r\n"
+		const local = "a=candidate:3769337065 1 udp 2122260223 192.168.1.2 56688 typ host\r\n"
+		const srflx = "a=candidate:1791031112 1 udp 1694498815 8.8.8.8 56688 typ srflx raddr 192.168.1.2 rport 56688\r\n"
+
+		// Gathering found nothing.
+		So(checkAnswerCandidates(header, false), ShouldEqual, errNoCandidates)
+		So(checkAnswerCandidates(header, true), ShouldEqual, errNoCandidates)
+
+		// Only local candidates, which are removed unless kept.
+		So(checkAnswerCandidates(header+local, false), ShouldEqual, errNoCandidates)
+		So(checkAnswerCandidates(header+local, true), ShouldBeNil)
+
+		So(checkAnswerCandidates(header+local+srflx, false), ShouldBeNil)
+
+		So(checkAnswerCandidates("test", false), ShouldNotBeNil)
+	})
+}
+
 func TestBrokerInteractions(t *testing.T) {
 	const sampleSDP = `"v=0\r\no=- 4358805017720277108 2 IN IP4 8.8.8.8\r\ns=-\r\nt=0 0\r\na=group:BUNDLE data\r\na=msid-semantic: WMS\r\nm=application 56688 DTLS/SCTP 5000\r\nc=IN IP4 8.8.8.8\r\na=candidate:3769337065 1 udp 2122260223 8.8.8.8 56688 typ host generation 0 network-id 1 network-cost 50\r\na=candidate:2921887769 1 tcp 1518280447 8.8.8.8 35441 typ host tcptype passive generation 0 network-id 1 network-cost 50\r\na=ice-ufrag:aMAZ\r\na=ice-pwd:jcHb08Jjgrazp2dzjdrvPPvV\r\na=ice-options:trickle\r\na=fingerprint:sha-256 C8:88:EE:B9:E7:02:2E:21:37:ED:7A:D1:EB:2B:A3:15:A2:3B:5B:1C:3D:D4:D5:1F:06:CF:52:40:03:F8:DD:66\r\na=setup:actpass\r\na=mid:data\r\na=sctpmap:5000 webrtc-datachannel 1024\r\n"`
 
@@ -357,16 +395,32 @@ func TestBrokerInteractions(t *testing.T) {
 		Convey("polls broker correctly", func() {
 			var err error
 
-			b, err := messages.EncodePollResponse(sampleOffer, true, "unknown")
+			b, err := messages.EncodePollResponse(sampleOffer, true, "unknown", messages.CurrentVersion)
 			So(err, ShouldEqual, nil)
 			broker.transport = &MockTransport{
 				http.StatusOK,
 				b,
 			}
 
-			sdp := broker.pollOffer(sampleOffer)
+			sdp, relay, _ := broker.pollOffer(sampleOffer)
 			expectedSDP, _ := strconv.Unquote(sampleSDP)
 			So(sdp.SDP, ShouldResemble, expectedSDP)
+			So(relay, ShouldEqual, "")
+			So(chooseRelayURL(relay), ShouldEqual, relayURL)
+		})
+		Convey("relays to the bridge the broker names", func() {
+			b, err := messages.EncodePollResponseWithRelayURL(sampleOffer, true, "unknown",
+				"wss://bridge.example/", messages.CurrentVersion)
+			So(err, ShouldBeNil)
+			broker.transport = &MockTransport{
+				http.StatusOK,
+				b,
+			}
+
+			sdp, relay, _ := broker.pollOffer(sampleOffer)
+			So(sdp, ShouldNotBeNil)
+			So(relay, ShouldEqual, "wss://bridge.example/")
+			So(chooseRelayURL(relay), ShouldEqual, "wss://bridge.example/")
 		})
 		Convey("handles poll error", func() {
 			var err error
@@ -378,7 +432,7 @@ func TestBrokerInteractions(t *testing.T) {
 				b,
 			}
 
-			sdp := broker.pollOffer(sampleOffer)
+			sdp, _, _ := broker.pollOffer(sampleOffer)
 			So(sdp, ShouldBeNil)
 		})
 		Convey("sends answer to broker", func() {
@@ -404,6 +458,26 @@ func TestBrokerInteractions(t *testing.T) {
 			err = broker.sendAnswer(sampleAnswer, pc)
 			So(err, ShouldNotBeNil)
 		})
+		Convey("tells broker when it can't answer", func() {
+			b, err := messages.EncodeAnswerResponse(true)
+			So(err, ShouldBeNil)
+			transport := &RecordingTransport{MockTransport: MockTransport{http.StatusOK, b}}
+			broker.transport = transport
+
+			err = broker.sendAnswerError("test sid", messages.CurrentVersion, errNoCandidates)
+			So(err, ShouldBeNil)
+			answer, answerError, sid, err := messages.DecodeAnswerRequestWithError(transport.request)
+			So(err, ShouldBeNil)
+			So(answer, ShouldEqual, "")
+			So(answerError, ShouldEqual, errNoCandidates.Error())
+			So(sid, ShouldEqual, "test sid")
+
+			// Brokers older than 1.4 aren't told.
+			transport.request = nil
+			err = broker.sendAnswerError("test sid", messages.Version{Major: 1, Minor: 3}, errNoCandidates)
+			So(err, ShouldBeNil)
+			So(transport.request, ShouldBeNil)
+		})
 		Convey("handles answer error", func() {
 			//Error if faulty transport
 			broker.transport = &FaultyTransport{}
@@ -439,6 +513,32 @@ func TestBrokerInteractions(t *testing.T) {
 	})
 }
 
+func TestWebRTCConnByteCounts(t *testing.T) {
+	Convey("webRTCConn counts bytes in each direction", t, func() {
+		pr, pw := io.Pipe()
+		conn := &webRTCConn{pr: pr, bytesLogger: BytesNullLogger{}}
+
+		for _, p := range [][]byte{make([]byte, 100), make([]byte, 23)} {
+			n, err := conn.Write(p)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(p))
+		}
+
+		go func() {
+			pw.Write(make([]byte, 50))
+			pw.Write(make([]byte, 7))
+			pw.Close()
+		}()
+		p, err := ioutil.ReadAll(conn)
+		So(err, ShouldBeNil)
+		So(len(p), ShouldEqual, 57)
+
+		inbound, outbound := conn.Bytes()
+		So(inbound, ShouldEqual, 123)
+		So(outbound, ShouldEqual, 57)
+	})
+}
+
 func TestUtilityFuncs(t *testing.T) {
 	Convey("LimitedRead", t, func() {
 		c, s := net.Pipe()
@@ -505,3 +605,89 @@ func TestUtilityFuncs(t *testing.T) {
 		So(err, ShouldNotBeNil)
 	})
 }
+
+type nopCloser struct{ io.ReadWriter }
+
+func (nopCloser) Close() error { return nil }
+
+func TestDescribeNATBehavior(t *testing.T) {
+	Convey("NAT test report", t, func() {
+		report := describeNATBehavior(nat.Behavior{})
+		So(report, ShouldContainSubstring, "NAT mapping: endpoint-independent\n")
+		So(report, ShouldContainSubstring, "NAT filtering: not port-dependent\n")
+		So(report, ShouldNotContainSubstring, "NAT type")
+
+		report = describeNATBehavior(nat.Behavior{RestrictedFiltering: true})
+		So(report, ShouldContainSubstring, "NAT filtering: port-dependent\n")
+
+		report = describeNATBehavior(nat.Behavior{RestrictedMapping: true})
+		So(report, ShouldContainSubstring, "NAT mapping: address-dependent\n")
+
+		// The verdict comes from the probe test, not the behavior above.
+		So(describeNATType(NATUnrestricted), ShouldStartWith, "NAT type: unrestricted (")
+		So(describeNATType(NATRestricted), ShouldStartWith, "NAT type: restricted (")
+		So(describeNATType(NATUnknown), ShouldStartWith, "NAT type: unknown (")
+	})
+}
+
+func TestProxyStats(t *testing.T) {
+	Convey("Proxy stats", t, func() {
+		start := time.Now()
+		s := newProxyStats(start)
+		So(s.summary(start.Add(time.Hour)), ShouldEqual,
+			"heartbeat: up 1h0m0s, served 0 clients, 0 active, relayed 0 bytes inbound, 0 bytes outbound")
+
+		a, b := &webRTCConn{}, &webRTCConn{}
+		s.connOpened(a)
+		s.connOpened(b)
+		a.inboundBytes, a.outboundBytes = 100, 10
+		b.inboundBytes, b.outboundBytes = 200, 20
+		So(s.summary(start.Add(time.Minute)), ShouldEqual,
+			"heartbeat: up 1m0s, served 2 clients, 2 active, relayed 300 bytes inbound, 30 bytes outbound")
+
+		// Closed connections still count toward the totals.
+		s.connClosed(a)
+		s.connClosed(a)
+		So(s.summary(start.Add(time.Minute)), ShouldEqual,
+			"heartbeat: up 1m0s, served 2 clients, 1 active, relayed 300 bytes inbound, 30 bytes outbound")
+	})
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	Convey("A bandwidth limit", t, func() {
+		const rate = 200000
+		const size = 100000
+		bucket := newTokenBucket(rate)
+
+		Convey("keeps sustained throughput under the limit", func() {
+			src := nopCloser{bytes.NewBuffer(make([]byte, size))}
+			start := time.Now()
+			n, err := io.Copy(ioutil.Discard, limitConn(src, bucket))
+			elapsed := time.Since(start)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, size)
+			// All but the initial burst must wait for tokens.
+			So(float64(n)-bucket.burst, ShouldBeLessThanOrEqualTo, rate*elapsed.Seconds())
+		})
+
+		Convey("is shared by the connections that use it", func() {
+			var wg sync.WaitGroup
+			start := time.Now()
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					src := nopCloser{bytes.NewBuffer(make([]byte, size/2))}
+					io.Copy(ioutil.Discard, limitConn(src, bucket))
+				}()
+			}
+			wg.Wait()
+			So(size-bucket.burst, ShouldBeLessThanOrEqualTo, rate*time.Since(start).Seconds())
+		})
+
+		Convey("is not applied without a bucket", func() {
+			src := &nopCloser{bytes.NewBuffer(nil)}
+			So(limitConn(src, nil), ShouldEqual, src)
+		})
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -16,9 +17,11 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.torproject.org/pluggable-transports/snowflake.git/common/messages"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/nat"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/safelog"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/util"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/websocketconn"
@@ -48,8 +51,22 @@ const readLimit = 100000 //Maximum number of bytes to be read from an HTTP reque
 var broker *SignalingServer
 var relayURL string
 
+// Whether to send answers that have no ICE candidates the client can use.
+var allowNoCandidates bool
+
+var errNoCandidates = errors.New("answer has no usable ICE candidates")
+
 var currentNATType = NATUnknown
 
+// Limits on relayed bytes per second. If bandwidthLimit is not 0, every
+// session shares globalBandwidth, unless bandwidthPerConnection is set, in
+// which case each session has its own limit.
+var (
+	bandwidthLimit         int
+	bandwidthPerConnection bool
+	globalBandwidth        *tokenBucket
+)
+
 const (
 	sessionIDLength = 16
 )
@@ -58,6 +75,7 @@ var (
 	tokens chan bool
 	config webrtc.Configuration
 	client http.Client
+	stats  = newProxyStats(time.Now())
 )
 
 var remoteIPPatterns = []*regexp.Regexp{
@@ -112,6 +130,12 @@ func remoteIPFromSDP(str string) net.IP {
 }
 
 type webRTCConn struct {
+	// Bytes from the relay to the client (written) and from the client to
+	// the relay (read). Accessed atomically, so kept first for 64-bit
+	// alignment.
+	inboundBytes  uint64
+	outboundBytes uint64
+
 	dc *webrtc.DataChannel
 	pc *webrtc.PeerConnection
 	pr *io.PipeReader
@@ -123,10 +147,13 @@ type webRTCConn struct {
 }
 
 func (c *webRTCConn) Read(b []byte) (int, error) {
-	return c.pr.Read(b)
+	n, err := c.pr.Read(b)
+	atomic.AddUint64(&c.outboundBytes, uint64(n))
+	return n, err
 }
 
 func (c *webRTCConn) Write(b []byte) (int, error) {
+	atomic.AddUint64(&c.inboundBytes, uint64(len(b)))
 	c.bytesLogger.AddInbound(len(b))
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -136,6 +163,12 @@ func (c *webRTCConn) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
+// Returns the number of bytes written to the client (inbound) and read from
+// it (outbound) so far.
+func (c *webRTCConn) Bytes() (inbound uint64, outbound uint64) {
+	return atomic.LoadUint64(&c.inboundBytes), atomic.LoadUint64(&c.outboundBytes)
+}
+
 func (c *webRTCConn) Close() (err error) {
 	c.once.Do(func() {
 		err = c.pc.Close()
@@ -223,7 +256,11 @@ func (s *SignalingServer) Post(path string, payload io.Reader) ([]byte, error) {
 	return limitedRead(resp.Body, readLimit)
 }
 
-func (s *SignalingServer) pollOffer(sid string) *webrtc.SessionDescription {
+// Polls the broker until it matches a client, and returns the client's offer
+// and the URL of the bridge to relay the client to, which is "" if the broker
+// leaves it to the proxy, and the version the broker speaks. Returns a nil
+// offer on error.
+func (s *SignalingServer) pollOffer(sid string) (*webrtc.SessionDescription, string, messages.Version) {
 	brokerPath := s.url.ResolveReference(&url.URL{Path: "proxy"})
 	timeOfNextPoll := time.Now()
 	for {
@@ -241,33 +278,37 @@ func (s *SignalingServer) pollOffer(sid string) *webrtc.SessionDescription {
 		body, err := messages.EncodePollRequest(sid, "standalone", currentNATType)
 		if err != nil {
 			log.Printf("Error encoding poll message: %s", err.Error())
-			return nil
+			return nil, "", messages.Version{}
 		}
 		resp, err := s.Post(brokerPath.String(), bytes.NewBuffer(body))
 		if err != nil {
 			log.Printf("error polling broker: %s", err.Error())
 		}
 
-		offer, _, err := messages.DecodePollResponse(resp)
+		offer, _, relay, err := messages.DecodePollResponseWithRelayURL(resp)
 		if err != nil {
 			log.Printf("Error reading broker response: %s", err.Error())
 			log.Printf("body: %s", resp)
-			return nil
+			return nil, "", messages.Version{}
 		}
 		if offer != "" {
+			v, err := messages.DecodePollResponseVersion(resp)
+			if err != nil {
+				log.Printf("Error reading broker response: %s", err.Error())
+				return nil, "", messages.Version{}
+			}
 			offer, err := util.DeserializeSessionDescription(offer)
 			if err != nil {
 				log.Printf("Error processing session description: %s", err.Error())
-				return nil
+				return nil, "", messages.Version{}
 			}
-			return offer
+			return offer, relay, v
 
 		}
 	}
 }
 
 func (s *SignalingServer) sendAnswer(sid string, pc *webrtc.PeerConnection) error {
-	brokerPath := s.url.ResolveReference(&url.URL{Path: "answer"})
 	ld := pc.LocalDescription()
 	if !s.keepLocalAddresses {
 		ld = &webrtc.SessionDescription{
@@ -283,6 +324,25 @@ func (s *SignalingServer) sendAnswer(sid string, pc *webrtc.PeerConnection) erro
 	if err != nil {
 		return err
 	}
+	return s.postAnswerRequest(body)
+}
+
+// Tells the broker that the client matched with sid can't be answered, and
+// why, so that it can try another proxy rather than wait for an answer. Does
+// nothing if the broker, which speaks version v, is too old to understand.
+func (s *SignalingServer) sendAnswerError(sid string, v messages.Version, reason error) error {
+	if !v.Supports(messages.CapabilityAnswerError) {
+		return nil
+	}
+	body, err := messages.EncodeAnswerErrorRequest(reason.Error(), sid)
+	if err != nil {
+		return err
+	}
+	return s.postAnswerRequest(body)
+}
+
+func (s *SignalingServer) postAnswerRequest(body []byte) error {
+	brokerPath := s.url.ResolveReference(&url.URL{Path: "answer"})
 	resp, err := s.Post(brokerPath.String(), bytes.NewBuffer(body))
 	if err != nil {
 		return fmt.Errorf("error sending answer to broker: %s", err.Error())
@@ -317,15 +377,26 @@ func CopyLoop(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser) {
 	wg.Wait()
 }
 
+// Returns the URL of the bridge to relay a client to: the one the broker named,
+// if any, and otherwise the one given with -relay.
+func chooseRelayURL(brokerRelayURL string) string {
+	if brokerRelayURL != "" {
+		return brokerRelayURL
+	}
+	return relayURL
+}
+
 // We pass conn.RemoteAddr() as an additional parameter, rather than calling
 // conn.RemoteAddr() inside this function, as a workaround for a hang that
 // otherwise occurs inside of conn.pc.RemoteDescription() (called by
 // RemoteAddr). https://bugs.torproject.org/18628#comment:8
-func datachannelHandler(conn *webRTCConn, remoteAddr net.Addr) {
+func datachannelHandler(conn *webRTCConn, remoteAddr net.Addr, relay string) {
 	defer conn.Close()
 	defer retToken()
+	stats.connOpened(conn)
+	defer stats.connClosed(conn)
 
-	u, err := url.Parse(relayURL)
+	u, err := url.Parse(relay)
 	if err != nil {
 		log.Fatalf("invalid relay url: %s", err)
 	}
@@ -348,8 +419,15 @@ func datachannelHandler(conn *webRTCConn, remoteAddr net.Addr) {
 	wsConn := websocketconn.New(ws)
 	log.Printf("connected to relay")
 	defer wsConn.Close()
-	CopyLoop(conn, wsConn)
-	log.Printf("datachannelHandler ends")
+	// The limit counts bytes in both directions, since each byte read from
+	// one side is written to the other.
+	bucket := globalBandwidth
+	if bandwidthLimit > 0 && bandwidthPerConnection {
+		bucket = newTokenBucket(bandwidthLimit)
+	}
+	CopyLoop(limitConn(conn, bucket), limitConn(wsConn, bucket))
+	inbound, outbound := conn.Bytes()
+	log.Printf("datachannelHandler ends after %d bytes inbound, %d bytes outbound", inbound, outbound)
 }
 
 // Create a PeerConnection from an SDP offer. Blocks until the gathering of ICE
@@ -385,6 +463,14 @@ func makePeerConnectionFromOffer(sdp *webrtc.SessionDescription,
 			dc.Close()
 			pw.Close()
 		})
+		dc.OnError(func(err error) {
+			// The channel is unusable; end the session now, rather
+			// than waiting for the client to time out.
+			log.Printf("OnError channel: %v", err)
+			if inerr := pw.CloseWithError(err); inerr != nil {
+				log.Printf("close with error generated an error: %v", inerr)
+			}
+		})
 		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
 			var n int
 			n, err = pw.Write(msg.Data)
@@ -490,20 +576,57 @@ func makeNewPeerConnection(config webrtc.Configuration,
 	return pc, nil
 }
 
+// Returns errNoCandidates if an answer SDP has no ICE candidates that would be
+// sent to the client. Unless keepLocalAddresses is set, local addresses are not
+// sent.
+func checkAnswerCandidates(answer string, keepLocalAddresses bool) error {
+	if !keepLocalAddresses {
+		answer = util.StripLocalAddresses(answer)
+	}
+	count, err := util.CountICECandidates(answer)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errNoCandidates
+	}
+	return nil
+}
+
 func runSession(sid string) {
-	offer := broker.pollOffer(sid)
+	offer, brokerRelayURL, brokerVersion := broker.pollOffer(sid)
 	if offer == nil {
 		log.Printf("bad offer from broker")
 		retToken()
 		return
 	}
+	relay := chooseRelayURL(brokerRelayURL)
 	dataChan := make(chan struct{})
-	pc, err := makePeerConnectionFromOffer(offer, config, dataChan, datachannelHandler)
+	pc, err := makePeerConnectionFromOffer(offer, config, dataChan,
+		func(conn *webRTCConn, remoteAddr net.Addr) {
+			datachannelHandler(conn, remoteAddr, relay)
+		})
 	if err != nil {
 		log.Printf("error making WebRTC connection: %s", err)
 		retToken()
 		return
 	}
+	if !allowNoCandidates {
+		// Rather than send the client an answer it can't connect to,
+		// tell the broker, which tells the client to try again.
+		err = checkAnswerCandidates(pc.LocalDescription().SDP, broker.keepLocalAddresses)
+		if err != nil {
+			log.Printf("not answering client: %s", err)
+			if inerr := broker.sendAnswerError(sid, brokerVersion, err); inerr != nil {
+				log.Printf("error telling broker: %s", inerr)
+			}
+			if inerr := pc.Close(); inerr != nil {
+				log.Printf("error calling pc.Close: %v", inerr)
+			}
+			retToken()
+			return
+		}
+	}
 	err = broker.sendAnswer(sid, pc)
 	if err != nil {
 		log.Printf("error sending answer to client through broker: %s", err)
@@ -535,6 +658,8 @@ func main() {
 	var rawBrokerURL string
 	var unsafeLogging bool
 	var keepLocalAddresses bool
+	var natTest bool
+	var heartbeatInterval time.Duration
 
 	flag.UintVar(&capacity, "capacity", 10, "maximum concurrent clients")
 	flag.StringVar(&rawBrokerURL, "broker", defaultBrokerURL, "broker URL")
@@ -543,8 +668,38 @@ func main() {
 	flag.StringVar(&logFilename, "log", "", "log filename")
 	flag.BoolVar(&unsafeLogging, "unsafe-logging", false, "prevent logs from being scrubbed")
 	flag.BoolVar(&keepLocalAddresses, "keep-local-addresses", false, "keep local LAN address ICE candidates")
+	flag.BoolVar(&allowNoCandidates, "allow-no-candidates", false, "answer clients even if ICE gathering found no usable candidates")
+	flag.IntVar(&bandwidthLimit, "bandwidth-limit", 0, "maximum bytes per second to relay, in both directions together (0 for no limit)")
+	flag.BoolVar(&bandwidthPerConnection, "bandwidth-per-connection", false, "apply -bandwidth-limit to each client separately, rather than to all together")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", time.Hour, "how often to log how many clients the proxy has served (0 to disable)")
+	flag.BoolVar(&natTest, "nat-test", false, "run the NAT probe test, print whether the proxy is restricted or unrestricted, and exit")
 	flag.Parse()
 
+	config = webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{stunURL},
+			},
+		},
+	}
+
+	if natTest {
+		// The mapping and filtering behavior is only for diagnosis; the
+		// probe test decides the NAT type, as it does for the broker.
+		b, err := nat.CheckNATBehavior(strings.TrimPrefix(stunURL, "stun:"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "NAT behavior test failed: %v\n", err)
+		} else {
+			fmt.Print(describeNATBehavior(b))
+		}
+		checkNATType(config, defaultProbeURL)
+		fmt.Print(describeNATType(currentNATType))
+		if currentNATType == NATUnknown {
+			os.Exit(1)
+		}
+		return
+	}
+
 	var logOutput io.Writer = os.Stderr
 	log.SetFlags(log.LstdFlags | log.LUTC)
 	if logFilename != "" {
@@ -582,13 +737,13 @@ func main() {
 
 	broker.transport = http.DefaultTransport.(*http.Transport)
 	broker.transport.(*http.Transport).ResponseHeaderTimeout = 15 * time.Second
-	config = webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{stunURL},
-			},
-		},
+	if bandwidthLimit < 0 {
+		log.Fatalf("invalid bandwidth limit: %d", bandwidthLimit)
 	}
+	if bandwidthLimit > 0 && !bandwidthPerConnection {
+		globalBandwidth = newTokenBucket(bandwidthLimit)
+	}
+
 	tokens = make(chan bool, capacity)
 	for i := uint(0); i < capacity; i++ {
 		tokens <- true
@@ -598,6 +753,10 @@ func main() {
 	checkNATType(config, defaultProbeURL)
 	log.Printf("NAT type: %s", currentNATType)
 
+	if heartbeatInterval > 0 {
+		go heartbeatLoop(stats, heartbeatInterval)
+	}
+
 	for {
 		getToken()
 		sessionID := genSessionID()
@@ -605,6 +764,35 @@ func main() {
 	}
 }
 
+// Returns a report of the NAT behavior found by nat.CheckNATBehavior, for
+// the -nat-test option.
+func describeNATBehavior(b nat.Behavior) string {
+	mapping := "endpoint-independent"
+	if b.RestrictedMapping {
+		mapping = "address-dependent"
+	}
+	filtering := "not port-dependent"
+	if b.RestrictedFiltering {
+		filtering = "port-dependent"
+	}
+	return fmt.Sprintf("NAT mapping: %s\nNAT filtering: %s\n", mapping, filtering)
+}
+
+// Returns the verdict of the -nat-test option, for the NAT type found by
+// checkNATType.
+func describeNATType(natType string) string {
+	var meaning string
+	switch natType {
+	case NATUnrestricted:
+		meaning = "this proxy can serve clients behind any NAT"
+	case NATRestricted:
+		meaning = "this proxy can serve only clients behind unrestricted NATs"
+	default:
+		meaning = "the probe test failed"
+	}
+	return fmt.Sprintf("NAT type: %s (%s)\n", natType, meaning)
+}
+
 func checkNATType(config webrtc.Configuration, probeURL string) {
 
 	var err error
@@ -634,7 +822,7 @@ func checkNATType(config webrtc.Configuration, probeURL string) {
 	}
 
 	// send offer
-	body, err := messages.EncodePollResponse(sdp, true, "")
+	body, err := messages.EncodePollResponse(sdp, true, "", messages.CurrentVersion)
 	if err != nil {
 		log.Printf("Error encoding probe message: %s", err.Error())
 		return
@@ -0,0 +1,68 @@
+package main
+
+// This code keeps track of what the proxy has done, for the periodic heartbeat
+// log message, so that an operator can see whether the proxy is serving
+// anyone.
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type proxyStats struct {
+	lock  sync.Mutex
+	start time.Time
+	// How many clients have connected.
+	served uint64
+	// Bytes relayed by connections that have closed; those of the open
+	// connections in active are added when the summary is made.
+	inbound, outbound uint64
+	active            map[*webRTCConn]struct{}
+}
+
+func newProxyStats(now time.Time) *proxyStats {
+	return &proxyStats{start: now, active: make(map[*webRTCConn]struct{})}
+}
+
+// Records a client connection that has opened.
+func (s *proxyStats) connOpened(conn *webRTCConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.served++
+	s.active[conn] = struct{}{}
+}
+
+// Records that conn has closed, and counts the bytes it relayed.
+func (s *proxyStats) connClosed(conn *webRTCConn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.active[conn]; !ok {
+		return
+	}
+	delete(s.active, conn)
+	inbound, outbound := conn.Bytes()
+	s.inbound += inbound
+	s.outbound += outbound
+}
+
+func (s *proxyStats) summary(now time.Time) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	inbound, outbound := s.inbound, s.outbound
+	for conn := range s.active {
+		in, out := conn.Bytes()
+		inbound += in
+		outbound += out
+	}
+	return fmt.Sprintf("heartbeat: up %v, served %d clients, %d active, relayed %d bytes inbound, %d bytes outbound",
+		now.Sub(s.start).Round(time.Second), s.served, len(s.active), inbound, outbound)
+}
+
+// Logs a summary of stats every interval.
+func heartbeatLoop(stats *proxyStats, interval time.Duration) {
+	for now := range time.Tick(interval) {
+		log.Println(stats.summary(now))
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"sync"
 	"time"
 )
 
@@ -82,3 +84,72 @@ func (b *BytesSyncLogger) ThroughputSummary() string {
 	t := time.Now()
 	return fmt.Sprintf("Traffic throughput (up|down): %d %s|%d %s -- (%d OnMessages, %d Sends, over %d seconds)", inbound, inUnit, outbound, outUnit, b.outEvents, b.inEvents, int(t.Sub(b.start).Seconds()))
 }
+
+// A token bucket that limits a rate of bytes. Tokens accumulate at rate per
+// second, up to burst. Callers may take more tokens than are available, and
+// then wait until the debt is paid off, so that concurrent callers are served
+// in turn.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+// Returns a tokenBucket that allows rate bytes per second, with bursts of up to
+// a tenth of a second's worth.
+func newTokenBucket(rate int) *tokenBucket {
+	burst := float64(rate) / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Takes n tokens, and returns how long to wait before using them.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Delays each Read until the bytes read fit within a tokenBucket. Reads are
+// no larger than the bucket's burst, so that data flows smoothly rather than
+// in large, delayed chunks.
+type rateLimitedConn struct {
+	io.ReadWriteCloser
+	bucket *tokenBucket
+}
+
+// Returns conn, limited by bucket, or conn itself if bucket is nil.
+func limitConn(conn io.ReadWriteCloser, bucket *tokenBucket) io.ReadWriteCloser {
+	if bucket == nil {
+		return conn
+	}
+	return &rateLimitedConn{ReadWriteCloser: conn, bucket: bucket}
+}
+
+func (c *rateLimitedConn) Read(p []byte) (int, error) {
+	if len(p) > int(c.bucket.burst) {
+		p = p[:int(c.bucket.burst)]
+	}
+	n, err := c.ReadWriteCloser.Read(p)
+	time.Sleep(c.bucket.take(n))
+	return n, err
+}
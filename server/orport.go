@@ -0,0 +1,91 @@
+package main
+
+// This code spreads client sessions over one or more ORPorts.
+//
+// By default there is only one: the ORPort (or ExtORPort) that tor tells us
+// about. With the -orport-backends option, each new session instead goes to
+// whichever of a list of ORPorts has the fewest open connections, taking them
+// in turn when there is a tie, so that a busy bridge can share its load among
+// several tor instances.
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+type orBackend struct {
+	info  pt.ServerInfo
+	conns int
+}
+
+type orPool struct {
+	lock     sync.Mutex
+	backends []*orBackend
+	// Where to start looking for the least-loaded backend, so that ties
+	// go to each backend in turn.
+	next int
+}
+
+func newORPool(infos []pt.ServerInfo) *orPool {
+	p := &orPool{}
+	for _, info := range infos {
+		p.backends = append(p.backends, &orBackend{info: info})
+	}
+	return p
+}
+
+// Parses a comma-separated list of ORPort addresses into the configuration to
+// dial each one. The backends are plain ORPorts, not ExtORPorts, so tor does
+// not learn client IP addresses through them.
+func parseORBackends(addrs string) ([]pt.ServerInfo, error) {
+	var infos []pt.ServerInfo
+	for _, addr := range strings.Split(addrs, ",") {
+		orAddr, err := net.ResolveTCPAddr("tcp", strings.TrimSpace(addr))
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve ORPort backend %q: %v", addr, err)
+		}
+		infos = append(infos, pt.ServerInfo{OrAddr: orAddr})
+	}
+	return infos, nil
+}
+
+// Picks the backend with the fewest open connections and counts a new
+// connection against it.
+func (p *orPool) pick() *orBackend {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var best *orBackend
+	for i := range p.backends {
+		b := p.backends[(p.next+i)%len(p.backends)]
+		if best == nil || b.conns < best.conns {
+			best = b
+		}
+	}
+	p.next = (p.next + 1) % len(p.backends)
+	best.conns++
+	return best
+}
+
+func (p *orPool) release(b *orBackend) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	b.conns--
+}
+
+// Connects to an ORPort on behalf of the client at addr. The caller must call
+// the returned function when the connection is finished with.
+func (p *orPool) dial(addr string) (*net.TCPConn, func(), error) {
+	b := p.pick()
+	var once sync.Once
+	release := func() { once.Do(func() { p.release(b) }) }
+	or, err := pt.DialOr(&b.info, addr, ptMethodName)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return or, release, nil
+}
@@ -52,17 +52,34 @@ const clientIDAddrMapCapacity = 1024
 // before deciding that it's not going to return.
 const listenAndServeErrorTimeout = 100 * time.Millisecond
 
+// Which kinds of clients the server accepts: those that use turbotunnel
+// sessions, those that use each WebSocket as a raw pipe, or both.
+const (
+	clientModeAuto        = "auto"
+	clientModeTurbotunnel = "turbotunnel"
+	clientModeOneshot     = "oneshot"
+)
+
 var ptInfo pt.ServerInfo
 
+// The ORPorts that client sessions are forwarded to. Set up in main.
+var orBackends *orPool
+
+// Set by the -client-mode option.
+var clientMode = clientModeAuto
+
 func usage() {
 	fmt.Fprintf(os.Stderr, `Usage: %s [OPTIONS]
 
-WebSocket server pluggable transport for Snowflake. Works only as a managed
-proxy. Uses TLS with ACME (Let's Encrypt) by default. Set the certificate
+WebSocket server pluggable transport for Snowflake. Usually run as a managed
+proxy by tor. Uses TLS with ACME (Let's Encrypt) by default. Set the certificate
 hostnames with the --acme-hostnames option. Use ServerTransportListenAddr in
 torrc to choose the listening port. When using TLS, this program will open an
 additional HTTP listener on port 80 to work with ACME.
 
+When not run by tor, the server runs standalone, listening on the --addr
+address and forwarding connections to the --orport address.
+
 `, os.Args[0])
 	flag.PrintDefaults()
 }
@@ -144,6 +161,10 @@ type HTTPHandler struct {
 	// pconn is the adapter layer between stream-oriented WebSocket
 	// connections and the packet-oriented KCP layer.
 	pconn *turbotunnel.QueuePacketConn
+	// mode is one of clientModeAuto, clientModeTurbotunnel, or
+	// clientModeOneshot. Clients of a kind not permitted by it are
+	// disconnected.
+	mode string
 }
 
 func (handler *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -172,8 +193,13 @@ func (handler *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	isTurbotunnel := bytes.Equal(token[:], turbotunnel.Token[:])
 	switch {
-	case bytes.Equal(token[:], turbotunnel.Token[:]):
+	case isTurbotunnel && handler.mode == clientModeOneshot:
+		log.Println("rejecting turbotunnel client in oneshot mode")
+	case !isTurbotunnel && handler.mode == clientModeTurbotunnel:
+		log.Println("rejecting oneshot client in turbotunnel mode")
+	case isTurbotunnel:
 		err = turbotunnelMode(conn, addr, handler.pconn)
 	default:
 		// We didn't find a matching token, which means that we are
@@ -194,10 +220,11 @@ func (handler *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // their session to begin and end when this single WebSocket does.
 func oneshotMode(conn net.Conn, addr string) error {
 	statsChannel <- addr != ""
-	or, err := pt.DialOr(&ptInfo, addr, ptMethodName)
+	or, release, err := orBackends.dial(addr)
 	if err != nil {
 		return fmt.Errorf("failed to connect to ORPort: %s", err)
 	}
+	defer release()
 	defer or.Close()
 
 	proxy(or, conn)
@@ -273,10 +300,11 @@ func turbotunnelMode(conn net.Conn, addr string, pconn *turbotunnel.QueuePacketC
 // handleStream bidirectionally connects a client stream with the ORPort.
 func handleStream(stream net.Conn, addr string) error {
 	statsChannel <- addr != ""
-	or, err := pt.DialOr(&ptInfo, addr, ptMethodName)
+	or, release, err := orBackends.dial(addr)
 	if err != nil {
 		return fmt.Errorf("connecting to ORPort: %v", err)
 	}
+	defer release()
 	defer or.Close()
 
 	proxy(or, stream)
@@ -377,6 +405,7 @@ func initServer(addr *net.TCPAddr,
 		// overlays packet-based client sessions on top of ephemeral
 		// WebSocket connections.
 		pconn: turbotunnel.NewQueuePacketConn(addr, clientMapTimeout),
+		mode:  clientMode,
 	}
 	server := &http.Server{
 		Addr:        addr.String(),
@@ -456,6 +485,34 @@ func startServerTLS(addr *net.TCPAddr, getCertificate func(*tls.ClientHelloInfo)
 	})
 }
 
+// Reports whether tor launched us as a managed pluggable transport.
+func ptManaged() bool {
+	return os.Getenv("TOR_PT_MANAGED_TRANSPORT_VER") != ""
+}
+
+// Returns the configuration that tor would otherwise provide, for running
+// without tor: a bindaddr at each of the comma-separated addrs, and the ORPort
+// at orAddr.
+func standaloneServerInfo(addrs, orAddr string) (pt.ServerInfo, error) {
+	var bindaddrs []pt.Bindaddr
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		bindaddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return pt.ServerInfo{}, fmt.Errorf("cannot resolve --addr %q: %v", addr, err)
+		}
+		bindaddrs = append(bindaddrs, pt.Bindaddr{MethodName: ptMethodName, Addr: bindaddr})
+	}
+	orTCPAddr, err := net.ResolveTCPAddr("tcp", orAddr)
+	if err != nil {
+		return pt.ServerInfo{}, fmt.Errorf("cannot resolve --orport %q: %v", orAddr, err)
+	}
+	return pt.ServerInfo{
+		Bindaddrs: bindaddrs,
+		OrAddr:    orTCPAddr,
+	}, nil
+}
+
 func getCertificateCacheDir() (string, error) {
 	stateDir, err := pt.MakeStateDir()
 	if err != nil {
@@ -470,6 +527,9 @@ func main() {
 	var disableTLS bool
 	var logFilename string
 	var unsafeLogging bool
+	var standaloneAddr string
+	var standaloneORPort string
+	var orBackendsCommas string
 
 	flag.Usage = usage
 	flag.StringVar(&acmeEmail, "acme-email", "", "optional contact email for Let's Encrypt notifications")
@@ -477,6 +537,10 @@ func main() {
 	flag.BoolVar(&disableTLS, "disable-tls", false, "don't use HTTPS")
 	flag.StringVar(&logFilename, "log", "", "log file to write to")
 	flag.BoolVar(&unsafeLogging, "unsafe-logging", false, "prevent logs from being scrubbed")
+	flag.StringVar(&standaloneAddr, "addr", ":443", "comma-separated addresses to listen on when not run by tor")
+	flag.StringVar(&standaloneORPort, "orport", "127.0.0.1:9001", "address of the ORPort to forward to when not run by tor")
+	flag.StringVar(&orBackendsCommas, "orport-backends", "", "comma-separated ORPort addresses to share client sessions among, instead of tor's")
+	flag.StringVar(&clientMode, "client-mode", clientModeAuto, "which clients to accept: \"turbotunnel\" (sessions that survive proxy changes), \"oneshot\" (raw pipes), or \"auto\" for both")
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.LUTC)
@@ -497,6 +561,12 @@ func main() {
 		log.SetOutput(&safelog.LogScrubber{Output: logOutput})
 	}
 
+	switch clientMode {
+	case clientModeAuto, clientModeTurbotunnel, clientModeOneshot:
+	default:
+		log.Fatalf("unknown --client-mode %q", clientMode)
+	}
+
 	if !disableTLS && acmeHostnamesCommas == "" {
 		log.Fatal("the --acme-hostnames option is required")
 	}
@@ -504,10 +574,26 @@ func main() {
 
 	log.Printf("starting")
 	var err error
-	ptInfo, err = pt.ServerSetup(nil)
+	if ptManaged() {
+		ptInfo, err = pt.ServerSetup(nil)
+	} else {
+		log.Printf("not run by tor; running standalone")
+		ptInfo, err = standaloneServerInfo(standaloneAddr, standaloneORPort)
+	}
 	if err != nil {
 		log.Fatalf("error in setup: %s", err)
 	}
+	if orBackendsCommas != "" {
+		var infos []pt.ServerInfo
+		infos, err = parseORBackends(orBackendsCommas)
+		if err != nil {
+			log.Fatalf("error in setup: %s", err)
+		}
+		log.Printf("sharing sessions among %d ORPort backends", len(infos))
+		orBackends = newORPool(infos)
+	} else {
+		orBackends = newORPool([]pt.ServerInfo{ptInfo})
+	}
 
 	go statsThread()
 
@@ -592,6 +678,10 @@ func main() {
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM)
+	if !ptManaged() {
+		// Without tor to stop us, Ctrl-C is how we are stopped.
+		signal.Notify(sigChan, syscall.SIGINT)
+	}
 
 	if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
 		// This environment variable means we should treat EOF on stdin
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"strconv"
+	"strings"
 	"testing"
 
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/encapsulation"
+	"git.torproject.org/pluggable-transports/snowflake.git/common/turbotunnel"
 	"git.torproject.org/pluggable-transports/snowflake.git/common/websocketconn"
 	"github.com/gorilla/websocket"
 	. "github.com/smartystreets/goconvey/convey"
@@ -151,3 +158,215 @@ func Test(t *testing.T) {
 
 	})
 }
+
+func TestClientMode(t *testing.T) {
+	// Stand in for statsThread.
+	go func() {
+		for range statsChannel {
+		}
+	}()
+
+	Convey("Client modes", t, func() {
+		// Stub ORPort for oneshot clients.
+		or, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+		So(err, ShouldBeNil)
+		defer or.Close()
+		orBackends = newORPool([]pt.ServerInfo{{OrAddr: or.Addr().(*net.TCPAddr)}})
+
+		pconn := turbotunnel.NewQueuePacketConn(nil, clientMapTimeout)
+		defer pconn.Close()
+
+		dial := func(mode string) (net.Conn, func()) {
+			server := httptest.NewServer(&HTTPHandler{pconn: pconn, mode: mode})
+			ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			So(err, ShouldBeNil)
+			conn := websocketconn.New(ws)
+			return conn, func() {
+				conn.Close()
+				server.Close()
+			}
+		}
+
+		relaysOneshot := func(mode string) {
+			conn, done := dial(mode)
+			defer done()
+
+			// Longer than turbotunnel.Token, which is read first.
+			_, err := conn.Write([]byte("Hello, world"))
+			So(err, ShouldBeNil)
+			orConn, err := or.Accept()
+			So(err, ShouldBeNil)
+			defer orConn.Close()
+			b := make([]byte, 12)
+			_, err = io.ReadFull(orConn, b)
+			So(err, ShouldBeNil)
+			So(b, ShouldResemble, []byte("Hello, world"))
+
+			_, err = orConn.Write([]byte("world!"))
+			So(err, ShouldBeNil)
+			b = make([]byte, 6)
+			_, err = io.ReadFull(conn, b)
+			So(err, ShouldBeNil)
+			So(b, ShouldResemble, []byte("world!"))
+		}
+
+		relaysTurbotunnel := func(mode string) {
+			conn, done := dial(mode)
+			defer done()
+
+			clientID := turbotunnel.NewClientID()
+			_, err := conn.Write(append(turbotunnel.Token[:], clientID[:]...))
+			So(err, ShouldBeNil)
+			_, err = encapsulation.WriteData(conn, []byte("Hello"))
+			So(err, ShouldBeNil)
+			b := make([]byte, 100)
+			n, addr, err := pconn.ReadFrom(b)
+			So(err, ShouldBeNil)
+			So(addr, ShouldResemble, clientID)
+			So(b[:n], ShouldResemble, []byte("Hello"))
+
+			_, err = pconn.WriteTo([]byte("world!"), clientID)
+			So(err, ShouldBeNil)
+			p, err := encapsulation.ReadData(conn)
+			So(err, ShouldBeNil)
+			So(p, ShouldResemble, []byte("world!"))
+		}
+
+		rejects := func(mode string, hello []byte) {
+			conn, done := dial(mode)
+			defer done()
+
+			_, err := conn.Write(hello)
+			So(err, ShouldBeNil)
+			_, err = conn.Read(make([]byte, 1))
+			So(err, ShouldNotBeNil)
+		}
+
+		Convey("auto accepts both kinds of client", func() {
+			relaysOneshot(clientModeAuto)
+			relaysTurbotunnel(clientModeAuto)
+		})
+
+		Convey("turbotunnel accepts only turbotunnel clients", func() {
+			relaysTurbotunnel(clientModeTurbotunnel)
+			rejects(clientModeTurbotunnel, []byte("Hello, world"))
+		})
+
+		Convey("oneshot accepts only oneshot clients", func() {
+			relaysOneshot(clientModeOneshot)
+			id := turbotunnel.NewClientID()
+			rejects(clientModeOneshot, append(turbotunnel.Token[:], id[:]...))
+		})
+	})
+}
+
+func TestStandaloneServerInfo(t *testing.T) {
+	Convey("Standalone server configuration", t, func() {
+		info, err := standaloneServerInfo("127.0.0.1:8080", "127.0.0.1:9001")
+		So(err, ShouldBeNil)
+		So(len(info.Bindaddrs), ShouldEqual, 1)
+		So(info.Bindaddrs[0].MethodName, ShouldEqual, ptMethodName)
+		So(info.Bindaddrs[0].Addr.String(), ShouldEqual, "127.0.0.1:8080")
+		So(info.OrAddr.String(), ShouldEqual, "127.0.0.1:9001")
+		So(info.ExtendedOrAddr, ShouldBeNil)
+
+		_, err = standaloneServerInfo("127.0.0.1:8080", "not an address")
+		So(err, ShouldNotBeNil)
+
+		info, err = standaloneServerInfo("127.0.0.1:8080, [::1]:8080", "127.0.0.1:9001")
+		So(err, ShouldBeNil)
+		So(len(info.Bindaddrs), ShouldEqual, 2)
+		So(info.Bindaddrs[1].MethodName, ShouldEqual, ptMethodName)
+		So(info.Bindaddrs[1].Addr.String(), ShouldEqual, "[::1]:8080")
+
+		_, err = standaloneServerInfo("127.0.0.1:8080,not an address", "127.0.0.1:9001")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestStandaloneWithoutTor(t *testing.T) {
+	Convey("Standalone mode without the PT environment", t, func() {
+		// Unset every TOR_PT_ variable, as when not run by tor.
+		for _, kv := range os.Environ() {
+			if !strings.HasPrefix(kv, "TOR_PT_") {
+				continue
+			}
+			name := strings.SplitN(kv, "=", 2)[0]
+			value := os.Getenv(name)
+			So(os.Unsetenv(name), ShouldBeNil)
+			defer os.Setenv(name, value)
+		}
+		So(ptManaged(), ShouldBeFalse)
+
+		info, err := standaloneServerInfo(":443", "127.0.0.1:9001")
+		So(err, ShouldBeNil)
+		So(len(info.Bindaddrs), ShouldEqual, 1)
+		So(info.OrAddr.String(), ShouldEqual, "127.0.0.1:9001")
+
+		So(os.Setenv("TOR_PT_MANAGED_TRANSPORT_VER", "1"), ShouldBeNil)
+		defer os.Unsetenv("TOR_PT_MANAGED_TRANSPORT_VER")
+		So(ptManaged(), ShouldBeTrue)
+	})
+}
+
+func TestORPool(t *testing.T) {
+	Convey("ORPort backends", t, func() {
+		var listeners []*net.TCPListener
+		var infos []pt.ServerInfo
+		for i := 0; i < 3; i++ {
+			ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+			So(err, ShouldBeNil)
+			defer ln.Close()
+			listeners = append(listeners, ln)
+			infos = append(infos, pt.ServerInfo{OrAddr: ln.Addr().(*net.TCPAddr)})
+		}
+		p := newORPool(infos)
+
+		// Returns the index of the listener that the connection went to.
+		backendOf := func(conn *net.TCPConn) int {
+			for i, ln := range listeners {
+				if conn.RemoteAddr().String() == ln.Addr().String() {
+					return i
+				}
+			}
+			return -1
+		}
+
+		// With no connections open, backends are taken in turn.
+		var releases []func()
+		for i := 0; i < 3; i++ {
+			conn, release, err := p.dial("")
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			So(backendOf(conn), ShouldEqual, i)
+			releases = append(releases, release)
+		}
+
+		// A new connection goes to the backend with the fewest.
+		releases[1]()
+		releases[1]()
+		conn, release, err := p.dial("")
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		defer release()
+		So(backendOf(conn), ShouldEqual, 1)
+
+		// A failed dial is not counted.
+		listeners[0].Close()
+		releases[0]()
+		_, _, err = p.dial("")
+		So(err, ShouldNotBeNil)
+		So(p.backends[0].conns, ShouldEqual, 0)
+	})
+
+	Convey("Parsing ORPort backends", t, func() {
+		infos, err := parseORBackends("127.0.0.1:9001, 127.0.0.1:9002")
+		So(err, ShouldBeNil)
+		So(len(infos), ShouldEqual, 2)
+		So(infos[1].OrAddr.String(), ShouldEqual, "127.0.0.1:9002")
+		So(infos[1].ExtendedOrAddr, ShouldBeNil)
+
+		_, err = parseORBackends("127.0.0.1:9001,not an address")
+		So(err, ShouldNotBeNil)
+	})
+}